@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// BIND через видеотуннель (активный режим FTP и подобные протоколы).
+//
+// Клиент отправляет CONNECT с командой socks5CmdBind и адресом, с которого ожидается
+// входящее соединение. Сервер открывает слушающий сокет и возвращает его адрес в
+// CONNACK — это первый ответ SOCKS5. Первое входящее соединение с ожидаемого адреса
+// сервер сообщает пакетом typeBindAccept (второй ответ SOCKS5) и дальше передает
+// данные как обычный поток.
+//
+// Пока соединения нет, клиент раз в bindRetryInterval повторяет CONNECT: сервер
+// отвечает на повтор последним своим ответом, так что потерянный BIND_ACCEPT
+// приходит заново.
+
+const (
+	bindAcceptTimeout = 2 * time.Minute
+	bindRetryInterval = 5 * time.Second
+	// bindEarlyDataLimit — сколько данных клиента SOCKS сохраняется до второго ответа
+	bindEarlyDataLimit = 64 * 1024
+)
+
+// bindListen открывает порт для BIND на адресе, через который сервер достает target,
+// и возвращает IP, с которого ожидается соединение (nil — с любого).
+func bindListen(target string) (net.Listener, net.IP, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		// Маршрут до target определяем UDP-сокетом: он ничего не отправляет
+		if probe, err := net.Dial("udp", target); err == nil {
+			local := probe.LocalAddr().(*net.UDPAddr).IP
+			peer := probe.RemoteAddr().(*net.UDPAddr).IP
+			probe.Close()
+			ln, err := net.Listen("tcp", net.JoinHostPort(local.String(), "0"))
+			return ln, peer, err
+		}
+	}
+	ln, err := net.Listen("tcp", ":0")
+	return ln, nil, err
+}
+
+// runBind ждет входящее соединение на сервере, сообщает о нем клиенту и передает данные.
+// setReply запоминает BIND_ACCEPT для ответа на повторы CONNECT.
+func runBind(ln net.Listener, peer net.IP, video *ScreenVideoConn, margin int, connID uint16, epoch byte, prio byte, incoming chan []byte, setReply func([]byte)) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		defer close(accepted)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			from, _ := c.RemoteAddr().(*net.TCPAddr)
+			if peer != nil && (from == nil || !from.IP.Equal(peer)) {
+				log.Printf("Server: BIND %d: rejecting connection from %s, expected %s", connID, c.RemoteAddr(), peer)
+				c.Close()
+				continue
+			}
+			accepted <- c
+			return
+		}
+	}()
+
+	timer := time.NewTimer(bindAcceptTimeout)
+	defer timer.Stop()
+	var conn net.Conn
+Wait:
+	for {
+		select {
+		case conn = <-accepted:
+			break Wait
+		case data := <-incoming:
+			if data[0] == typeDisconnect {
+				log.Printf("Server: BIND %d cancelled by client", connID)
+				ln.Close()
+				if c, ok := <-accepted; ok {
+					c.Close()
+				}
+				return
+			}
+		case <-timer.C:
+			break Wait
+		}
+	}
+	ln.Close()
+
+	if conn == nil {
+		log.Printf("Server: BIND %d: no connection within %v", connID, bindAcceptTimeout)
+		if c, ok := <-accepted; ok {
+			c.Close()
+		}
+		reply := connAckPayload(typeBindAccept, connID, epoch, socks5RespTTLExpired, nil)
+		setReply(reply)
+		sendControlPacket(reply, margin)
+		recordSentPacket(typeBindAccept)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("Server: BIND %d: accepted connection from %s", connID, conn.RemoteAddr())
+	reply := connAckPayload(typeBindAccept, connID, epoch, socks5RespSuccess, conn.RemoteAddr())
+	setReply(reply)
+	sendControlPacket(reply, margin)
+	recordSentPacket(typeBindAccept)
+
+	runTunnelWithPrefix(conn, video, margin, connID, epoch, prio, incoming)
+}
+
+// serveBind обслуживает запрос BIND на клиенте: отдает клиенту SOCKS оба ответа
+// и после входящего соединения передает данные.
+func serveBind(c net.Conn, req *SocksRequest, pd *PacketDispatcher, video *ScreenVideoConn, margin int, open remoteOpener) {
+	if !peerSupports(capBind) {
+		log.Printf("Client: BIND from %s rejected, server does not support it", c.RemoteAddr())
+		_ = req.Reply(c, errSocksCmdNotSupported, nil)
+		return
+	}
+	prio := priorityForTarget(req.Target)
+	connID, epoch, ch, boundAddr, err := open(socks5CmdBind, req.Target, prio)
+	if err != nil {
+		_ = req.Reply(c, err, nil)
+		return
+	}
+	defer pd.Unregister(connID, epoch)
+
+	cancel := func() {
+		sendControlPacket([]byte{typeDisconnect, byte(connID >> 8), byte(connID), epoch}, margin)
+		recordSentPacket(typeDisconnect)
+	}
+	if err := req.Reply(c, nil, boundAddr); err != nil {
+		cancel()
+		return
+	}
+	log.Printf("Client: BIND %d for %s listening on %v", connID, req.Target, boundAddr)
+
+	// Пока ждем входящее соединение, следим за соединением клиента SOCKS: брошенный
+	// запрос не должен держать порт на сервере. Данные, присланные раньше второго
+	// ответа, сохраняются и уходят в туннель первыми
+	gone := make(chan struct{})
+	watchDone := make(chan struct{})
+	var early bytes.Buffer
+	go func() {
+		defer close(watchDone)
+		buf := make([]byte, 4096)
+		for early.Len() < bindEarlyDataLimit {
+			n, err := c.Read(buf)
+			early.Write(buf[:n])
+			if err != nil {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					close(gone)
+				}
+				return
+			}
+		}
+	}()
+	stopWatch := func() net.Conn {
+		c.SetReadDeadline(time.Now())
+		<-watchDone
+		c.SetReadDeadline(time.Time{})
+		if early.Len() == 0 {
+			return c
+		}
+		return &bufferedConn{Conn: c, r: io.MultiReader(&early, c)}
+	}
+
+	connect := connectPayload(connID, epoch, socks5CmdBind, prio, req.Target)
+	retry := time.NewTicker(bindRetryInterval)
+	defer retry.Stop()
+	deadline := time.After(bindAcceptTimeout + 15*time.Second)
+	for {
+		select {
+		case data := <-ch:
+			switch data[0] {
+			case typeBindAccept:
+				status, peerAddr := parseConnAck(data)
+				if status != socks5RespSuccess {
+					log.Printf("Client: BIND %d failed, status: 0x%02x", connID, status)
+					_ = req.Reply(c, socksReplyError(status), nil)
+					return
+				}
+				if err := req.Reply(c, nil, peerAddr); err != nil {
+					cancel()
+					return
+				}
+				log.Printf("Client: BIND %d accepted connection from %v", connID, peerAddr)
+				runTunnelWithPrefix(stopWatch(), video, margin, connID, epoch, prio, ch)
+				return
+			case typeDisconnect:
+				_ = req.Reply(c, fmt.Errorf("bind closed by server"), nil)
+				return
+			}
+		case <-gone:
+			log.Printf("Client: BIND %d abandoned by SOCKS client, closing", connID)
+			cancel()
+			return
+		case <-retry.C:
+			sendControlPacket(connect, margin)
+			recordSentPacket(typeConnect)
+		case <-deadline:
+			log.Printf("Client: BIND %d timed out", connID)
+			cancel()
+			_ = req.Reply(c, fmt.Errorf("BIND %d: %w", connID, os.ErrDeadlineExceeded), nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Версия протокола туннеля. Версия 1 — исходный формат без согласования
+// (узлы, не присылающие Capabilities); версия 2 — заголовок DATA с FIN и окном;
+// версия 3 — бинарные управляющие сообщения (control.go); версия 4 — эпоха в заголовке соединения;
+// версия 5 — класс приоритета в CONNECT.
+//
+// Узел говорит на всех версиях от minProtoVersion до protoVersion: после согласования
+// пакеты кодируются в формате общей версии (toWire/fromWire, encodeControl). Новые
+// возможности, не меняющие прежних форматов, включаются битами Features, а не версией.
+const (
+	protoVersion    = 5
+	minProtoVersion = 2
+)
+
+// Версии, с которых меняется формат пакетов.
+const (
+	verTLVControl = 3 // Управляющие сообщения в TLV, до нее — JSON
+	verConnEpoch  = 4 // Байт эпохи после connID
+	verConnPrio   = 5 // Байт класса приоритета в CONNECT после команды
+)
+
+// Биты необязательных возможностей. Используется только то, что поддерживают обе стороны.
+const (
+	capFEC      uint32 = 1 << 0 // Прием кадров typeFecData/typeFecParity
+	capResume   uint32 = 1 << 1 // Возобновление сессии без калибровки
+	capProfiles uint32 = 1 << 2 // Короткая проверка кэшированного профиля калибровки
+	capDeflate  uint32 = 1 << 3 // Прием сжатых пакетов DATA (flagDeflate)
+	capSeal     uint32 = 1 << 4 // Шифрование пакетов (crypto.go)
+	capDatagram uint32 = 1 << 5 // UDP ASSOCIATE и пакеты typeDatagram (udp.go)
+	capBind     uint32 = 1 << 6 // Команда BIND и пакет typeBindAccept (bind.go)
+	capReverse  uint32 = 1 << 7 // Обратная переадресация: CONNECT от сервера (reverse.go)
+	capDNS      uint32 = 1 << 8 // Пакеты typeDNSQuery/typeDNSAnswer (dns.go)
+	capCounted  uint32 = 1 << 9 // Счетчик на открытых пакетах, обертка typeCounted (replay.go)
+)
+
+// Capabilities — предложение узла при синхронизации. Параметры кодека должны совпадать
+// точно, из возможностей выбирается общее подмножество.
+type Capabilities struct {
+	Version    int
+	MinVersion int
+	Features   uint32
+	FrameW     int
+	FrameH     int
+	RSParity   int
+}
+
+func localCaps() *Capabilities {
+	return &Capabilities{
+		Version:    protoVersion,
+		MinVersion: minProtoVersion,
+		Features:   capFEC | capResume | capProfiles | capDeflate | capSeal | capDatagram | capBind | capReverse | capDNS | capCounted,
+		FrameW:     width,
+		FrameH:     height,
+		RSParity:   rsParity,
+	}
+}
+
+// negotiateCaps выбирает общую версию и возможности. Возвращает ошибку с понятным
+// описанием, если узлы несовместимы.
+func negotiateCaps(local, remote *Capabilities) (Capabilities, error) {
+	if remote == nil {
+		return Capabilities{}, fmt.Errorf("peer does not negotiate capabilities (protocol v1), need v%d+", local.MinVersion)
+	}
+	if remote.FrameW != local.FrameW || remote.FrameH != local.FrameH {
+		return Capabilities{}, fmt.Errorf("frame size mismatch: local %dx%d, peer %dx%d", local.FrameW, local.FrameH, remote.FrameW, remote.FrameH)
+	}
+	if remote.RSParity != local.RSParity {
+		return Capabilities{}, fmt.Errorf("Reed-Solomon parity mismatch: local %d, peer %d", local.RSParity, remote.RSParity)
+	}
+
+	agreed := Capabilities{
+		Version:    local.Version,
+		MinVersion: local.MinVersion,
+		Features:   local.Features & remote.Features,
+		FrameW:     local.FrameW,
+		FrameH:     local.FrameH,
+		RSParity:   local.RSParity,
+	}
+	if remote.Version < agreed.Version {
+		agreed.Version = remote.Version
+	}
+	if remote.MinVersion > agreed.MinVersion {
+		agreed.MinVersion = remote.MinVersion
+	}
+	if agreed.Version < agreed.MinVersion {
+		return Capabilities{}, fmt.Errorf("no common protocol version: local v%d-v%d, peer v%d-v%d",
+			local.MinVersion, local.Version, remote.MinVersion, remote.Version)
+	}
+	if missing := requiredCaps() &^ agreed.Features; missing != 0 {
+		return Capabilities{}, fmt.Errorf("peer lacks required features 0x%x", missing)
+	}
+	return agreed, nil
+}
+
+var (
+	sessionCapsMu sync.RWMutex
+	sessionCaps   Capabilities
+)
+
+// setSessionCaps запоминает результат согласования для текущей сессии.
+func setSessionCaps(c Capabilities) {
+	sessionCapsMu.Lock()
+	sessionCaps = c
+	sessionCapsMu.Unlock()
+}
+
+// sessionVersion возвращает согласованную версию протокола. До согласования узел
+// говорит на своей версии.
+func sessionVersion() int {
+	sessionCapsMu.RLock()
+	defer sessionCapsMu.RUnlock()
+	if sessionCaps.Version == 0 {
+		return protoVersion
+	}
+	return sessionCaps.Version
+}
+
+// connPacket сообщает, начинается ли пакет типа t с заголовка соединения.
+func connPacket(t byte) bool {
+	switch t {
+	case typeConnect, typeConnAck, typeData, typeDisconnect, typeNack, typeDatagram, typeBindAccept:
+		return true
+	}
+	return false
+}
+
+// toWire переводит пакет из внутреннего формата (текущей версии) в формат версии ver:
+// для версий до verConnPrio из CONNECT убирается класс приоритета, до verConnEpoch из
+// заголовка соединения — эпоха.
+func toWire(p []byte, ver int) []byte {
+	if len(p) < connHeaderLen || !connPacket(p[0]) || ver >= verConnPrio || (ver >= verConnEpoch && p[0] != typeConnect) {
+		return p
+	}
+	out := make([]byte, 0, len(p))
+	out = append(out, p[:3]...)
+	if ver >= verConnEpoch {
+		out = append(out, p[3])
+	}
+	if p[0] == typeConnect && len(p) >= connHeaderLen+2 {
+		out = append(out, p[4])
+		return append(out, p[6:]...)
+	}
+	return append(out, p[4:]...)
+}
+
+// fromWire переводит пакет версии ver во внутренний формат. Узлы без эпох не отличают
+// соединения с одним ID, поэтому пакету подставляется эпоха, которую вернет epochOf;
+// CONNECT без класса приоритета получает prioNormal.
+func fromWire(p []byte, ver int, epochOf func(id uint16) byte) []byte {
+	if len(p) < 3 || !connPacket(p[0]) || ver >= verConnPrio || (ver >= verConnEpoch && p[0] != typeConnect) {
+		return p
+	}
+	out := make([]byte, 0, len(p)+2)
+	out = append(out, p[:3]...)
+	rest := p[3:]
+	if ver >= verConnEpoch {
+		if len(rest) == 0 {
+			return p
+		}
+		out = append(out, rest[0])
+		rest = rest[1:]
+	} else {
+		out = append(out, epochOf(uint16(p[1])<<8|uint16(p[2])))
+	}
+	if p[0] == typeConnect && len(rest) > 0 {
+		out = append(out, rest[0], prioNormal)
+		rest = rest[1:]
+	}
+	return append(out, rest...)
+}
+
+// peerSupports сообщает, согласована ли возможность с удаленной стороной.
+func peerSupports(feature uint32) bool {
+	sessionCapsMu.RLock()
+	defer sessionCapsMu.RUnlock()
+	return sessionCaps.Features&feature != 0
+}
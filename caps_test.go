@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNegotiateCapsCommonSubset(t *testing.T) {
+	local := localCaps()
+	remote := localCaps()
+	remote.Version = protoVersion + 1
+	remote.Features = capFEC | 1<<31
+
+	agreed, err := negotiateCaps(local, remote)
+	if err != nil {
+		t.Fatalf("negotiation failed: %v", err)
+	}
+	if agreed.Version != protoVersion {
+		t.Errorf("expected version %d, got %d", protoVersion, agreed.Version)
+	}
+	if agreed.Features != capFEC {
+		t.Errorf("expected features 0x%x, got 0x%x", capFEC, agreed.Features)
+	}
+}
+
+func TestNegotiateCapsOlderPeer(t *testing.T) {
+	// Узел v3 без эпох: обе стороны приходят к v3, и пакеты идут в его формате
+	remote := localCaps()
+	remote.Version, remote.MinVersion = 3, 2
+	agreed, err := negotiateCaps(localCaps(), remote)
+	if err != nil {
+		t.Fatalf("negotiation with a v3 peer failed: %v", err)
+	}
+	back, err := negotiateCaps(remote, localCaps())
+	if err != nil || back.Version != agreed.Version {
+		t.Fatalf("sides disagree: v%d and v%d (err %v)", agreed.Version, back.Version, err)
+	}
+	if agreed.Version != 3 {
+		t.Fatalf("expected v3, got v%d", agreed.Version)
+	}
+
+	connect := connectPayload(7, 200, socks5CmdConnect, prioInteractive, "example.com:22")
+	wire := toWire(connect, agreed.Version)
+	if want := append([]byte{typeConnect, 0, 7, socks5CmdConnect}, "example.com:22"...); !bytes.Equal(wire, want) {
+		t.Fatalf("v3 CONNECT on the wire %x, want %x", wire, want)
+	}
+	got := fromWire(wire, agreed.Version, func(uint16) byte { return 0 })
+	if want := connectPayload(7, 0, socks5CmdConnect, prioNormal, "example.com:22"); !bytes.Equal(got, want) {
+		t.Fatalf("v3 CONNECT decoded %x, want %x", got, want)
+	}
+}
+
+func TestWireFormats(t *testing.T) {
+	epochOf := func(id uint16) byte { return byte(id) + 1 }
+	data := []byte{typeData, 0, 9, 10, 1, 2, 3, 0, 'x'} // Эпоха 10 = epochOf(9)
+	connect := connectPayload(9, 10, socks5CmdBind, prioBulk, "h:1")
+	tests := []struct {
+		ver       int
+		data      []byte
+		connect   []byte
+		connectIn []byte // Что получатель восстановит из CONNECT
+	}{
+		{2, []byte{typeData, 0, 9, 1, 2, 3, 0, 'x'}, append([]byte{typeConnect, 0, 9, socks5CmdBind}, "h:1"...), connectPayload(9, 10, socks5CmdBind, prioNormal, "h:1")},
+		{verConnEpoch, data, append([]byte{typeConnect, 0, 9, 10, socks5CmdBind}, "h:1"...), connectPayload(9, 10, socks5CmdBind, prioNormal, "h:1")},
+		{verConnPrio, data, connect, connect},
+	}
+	for _, tt := range tests {
+		if got := toWire(data, tt.ver); !bytes.Equal(got, tt.data) {
+			t.Errorf("v%d: DATA on the wire %x, want %x", tt.ver, got, tt.data)
+		}
+		if got := fromWire(tt.data, tt.ver, epochOf); !bytes.Equal(got, data) {
+			t.Errorf("v%d: DATA decoded %x, want %x", tt.ver, got, data)
+		}
+		if got := toWire(connect, tt.ver); !bytes.Equal(got, tt.connect) {
+			t.Errorf("v%d: CONNECT on the wire %x, want %x", tt.ver, got, tt.connect)
+		}
+		if got := fromWire(tt.connect, tt.ver, epochOf); !bytes.Equal(got, tt.connectIn) {
+			t.Errorf("v%d: CONNECT decoded %x, want %x", tt.ver, got, tt.connectIn)
+		}
+	}
+	// Управляющие пакеты не меняются
+	hb := []byte{typeHeartbeat, 1, 2, 3}
+	if got := toWire(hb, 2); !bytes.Equal(got, hb) {
+		t.Errorf("heartbeat changed on the wire: %x", got)
+	}
+}
+
+func TestNegotiateCapsIncompatible(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Capabilities)
+	}{
+		{"frame size", func(c *Capabilities) { c.FrameW = 1280 }},
+		{"rs parity", func(c *Capabilities) { c.RSParity = 16 }},
+		{"too old", func(c *Capabilities) { c.Version, c.MinVersion = 1, 1 }},
+		{"too new", func(c *Capabilities) { c.Version, c.MinVersion = protoVersion+2, protoVersion+1 }},
+	}
+	for _, tt := range tests {
+		remote := localCaps()
+		tt.modify(remote)
+		if _, err := negotiateCaps(localCaps(), remote); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+
+	if _, err := negotiateCaps(localCaps(), nil); err == nil {
+		t.Error("peer without capabilities must be rejected")
+	}
+}
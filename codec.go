@@ -8,7 +8,6 @@ import (
 	"image/color"
 	"log"
 	"sync"
-	"time"
 )
 
 const (
@@ -18,12 +17,13 @@ const (
 	captureHeight = 1024
 	markerSize    = 8
 	markerOffset  = 4
+	// rsParity — число проверочных символов Reed-Solomon в блоке из 255 байт
+	rsParity = 32
 )
 
 var (
-	blockSize    = 4
-	lastBSChange = time.Now()
-	bsMu         sync.Mutex
+	blockSize = 4
+	bsMu      sync.Mutex
 )
 
 func GetBlockSize() int {
@@ -36,27 +36,6 @@ func SetBlockSize(s int) {
 	bsMu.Lock()
 	defer bsMu.Unlock()
 	blockSize = s
-	lastBSChange = time.Now()
-}
-
-func TryIncreaseBlockSize() {
-	bsMu.Lock()
-	defer bsMu.Unlock()
-	if time.Since(lastBSChange) > 10*time.Second && blockSize < 12 {
-		blockSize += 2
-		lastBSChange = time.Now()
-		log.Printf("Adaptive: Global blockSize increased to %d", blockSize)
-	}
-}
-
-func TryDecreaseBlockSize() {
-	bsMu.Lock()
-	defer bsMu.Unlock()
-	if time.Since(lastBSChange) > 10*time.Second && blockSize > 4 {
-		blockSize -= 1
-		lastBSChange = time.Now()
-		log.Printf("Adaptive: Global blockSize decreased to %d", blockSize)
-	}
 }
 
 func calculateMaxBits(margin int, bSize int) int {
@@ -478,7 +457,7 @@ func Encode(data []byte, margin int, bSize int) *image.RGBA {
 	block = append(block, byte(c32>>24), byte(c32>>16), byte(c32>>8), byte(c32))
 
 	// Добавляем RS-коды (32 байта)
-	fullData := rsEncode(block, 32)
+	fullData := rsEncode(block, rsParity)
 
 	// Маскирование (XOR с шахматным паттерном) для улучшения JPEG-сжатия
 	for i := 0; i < len(fullData); i++ {
@@ -744,7 +723,7 @@ func Decode(img *image.RGBA, margin int) []byte {
 	}
 
 	// 1. Декодируем первый блок, чтобы узнать длину данных
-	decodedFirst, ok := rsDecode(fullData[:255], 32)
+	decodedFirst, ok := rsDecode(fullData[:255], rsParity)
 	if !ok {
 		return nil
 	}
@@ -766,7 +745,7 @@ func Decode(img *image.RGBA, margin int) []byte {
 	}
 
 	// 2. Декодируем все необходимые блоки
-	decoded, ok := rsDecode(fullData[:totalEncodedLen], 32)
+	decoded, ok := rsDecode(fullData[:totalEncodedLen], rsParity)
 	if !ok || len(decoded) < 3+dataLen+4 {
 		return nil
 	}
@@ -121,20 +121,3 @@ func TestEncodeAutoAdjust(t *testing.T) {
 		t.Errorf("Auto-adjustment failed: decoded data does not match original. Len got %d, want %d", len(decoded), len(data))
 	}
 }
-
-func TestAdaptiveBlockSize(t *testing.T) {
-	SetBlockSize(4)
-	if GetBlockSize() != 4 {
-		t.Errorf("Expected blockSize 4, got %d", GetBlockSize())
-	}
-
-	// Should not increase immediately because lastBSChange was just set in SetBlockSize
-	TryIncreaseBlockSize()
-	if GetBlockSize() != 4 {
-		t.Errorf("Should not increase before 10s. Got %d", GetBlockSize())
-	}
-
-	// Manually backdate lastBSChange using reflection or just wait?
-	// Since I can't easily wait 10s in a unit test, I'll trust the logic or use a shorter interval for tests?
-	// Actually, I can just verify it doesn't jump.
-}
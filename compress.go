@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Сжатие потока туннеля. Данные потока идут через один DEFLATE-поток на направление:
+// каждое чтение из сокета сжимается с flush, сжатые байты режутся на пакеты DATA
+// с флагом flagDeflate. Словарь (окно 32 КБ) общий для всего потока, поэтому
+// повторяющиеся заголовки HTTP и текстовых протоколов сжимаются от пакета к пакету.
+// Получатель подает сжатые пакеты в распаковщик строго по порядку seq.
+//
+// Поток, начинающийся как TLS, или сжимающийся хуже compressMinGain, передается
+// дальше без сжатия: отправитель закрывает DEFLATE-поток (финальный блок), и
+// следующие пакеты идут без флага.
+
+const (
+	// compressReadFactor — во сколько раз больше емкости кадра читаем за раз при сжатии
+	compressReadFactor = 4
+	// После compressProbeBytes исходных байт поток со слабым сжатием переводится в обычный режим
+	compressProbeBytes = 64 * 1024
+	compressMinGain    = 0.9
+)
+
+const (
+	compUndecided = iota
+	compDeflate
+	compRaw
+)
+
+// compressActive сообщает, сжимать ли исходящие потоки.
+func compressActive() bool {
+	return currentCfg != nil && currentCfg.Compress && peerSupports(capDeflate)
+}
+
+// looksEncrypted распознает начало записи TLS (handshake, alert, application data).
+func looksEncrypted(p []byte) bool {
+	return len(p) >= 3 && p[0] >= 0x14 && p[0] <= 0x17 && p[1] == 0x03 && p[2] <= 0x04
+}
+
+// streamCompressor сжимает исходящее направление одного потока.
+type streamCompressor struct {
+	mode        int
+	fw          *flate.Writer
+	out         bytes.Buffer // Сжатые байты, ожидающие отправки
+	raw, packed int64        // Счетчики для оценки выигрыша
+}
+
+func newStreamCompressor() *streamCompressor {
+	return &streamCompressor{}
+}
+
+// ReadLimit возвращает, сколько байт читать из сокета. Решение о сжатии принимается
+// по первому чтению, поэтому оно не больше емкости кадра. При сжатии читаем больше
+// емкости кадра, но только когда очередь сжатых данных почти пуста.
+func (c *streamCompressor) ReadLimit(maxData int) int {
+	switch {
+	case c.out.Len() >= maxData, c.mode == compRaw && c.out.Len() > 0:
+		return 0 // Сначала отправляем накопленный сжатый поток
+	case c.mode == compDeflate:
+		return maxData * compressReadFactor
+	}
+	return maxData
+}
+
+// Add принимает данные, прочитанные из сокета. Возвращает их обратно, если поток
+// идет без сжатия, иначе данные уходят в Pending.
+func (c *streamCompressor) Add(data []byte) []byte {
+	if c.mode == compUndecided {
+		if looksEncrypted(data) {
+			c.mode = compRaw
+		} else {
+			c.mode = compDeflate
+			c.fw, _ = flate.NewWriter(&c.out, flate.DefaultCompression)
+		}
+	}
+	if c.mode == compRaw {
+		return data
+	}
+
+	before := c.out.Len()
+	c.fw.Write(data)
+	c.fw.Flush()
+	n := c.out.Len() - before
+	c.raw += int64(len(data))
+	c.packed += int64(n)
+	recordCompression(len(data), n)
+
+	if c.raw >= compressProbeBytes && float64(c.packed) > compressMinGain*float64(c.raw) {
+		c.Finish()
+		c.mode = compRaw
+	}
+	return nil
+}
+
+// Pending возвращает число сжатых байт, ожидающих отправки.
+func (c *streamCompressor) Pending() int {
+	return c.out.Len()
+}
+
+// Take возвращает очередную порцию сжатого потока размером до limit.
+func (c *streamCompressor) Take(limit int) []byte {
+	if limit > c.out.Len() {
+		limit = c.out.Len()
+	}
+	return append([]byte(nil), c.out.Next(limit)...)
+}
+
+// Finish завершает DEFLATE-поток, чтобы получатель дописал все данные до FIN.
+func (c *streamCompressor) Finish() {
+	if c.fw != nil {
+		c.fw.Close()
+		c.fw = nil
+	}
+}
+
+// streamInflater распаковывает входящее сжатое направление потока в dst.
+// Сжатые пакеты подаются по порядку через Write, распаковка идет в отдельной горутине.
+type streamInflater struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	n    int64
+	err  error
+}
+
+func startInflater(dst io.Writer) *streamInflater {
+	pr, pw := io.Pipe()
+	z := &streamInflater{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(z.done)
+		fr := flate.NewReader(pr)
+		z.n, z.err = io.Copy(dst, fr)
+		fr.Close()
+		// Отправитель больше не пишет в закрытый поток: разблокируем Write ошибкой
+		pr.CloseWithError(io.ErrClosedPipe)
+	}()
+	return z
+}
+
+// Write передает распаковщику очередной сжатый пакет.
+func (z *streamInflater) Write(p []byte) error {
+	if _, err := z.pw.Write(p); err != nil {
+		// Запись в канал прерывается только после выхода распаковщика
+		<-z.done
+		if z.err != nil {
+			return z.err
+		}
+		return err
+	}
+	return nil
+}
+
+// Finish дожидается записи всех распакованных данных. Возвращает число записанных
+// байт и ошибку распаковки или записи.
+func (z *streamInflater) Finish() (int64, error) {
+	z.pw.Close()
+	<-z.done
+	return z.n, z.err
+}
+
+var (
+	compressMu       sync.Mutex
+	compressRawTotal int64
+	compressOutTotal int64
+)
+
+func recordCompression(raw, packed int) {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+	compressRawTotal += int64(raw)
+	compressOutTotal += int64(packed)
+}
+
+// getCompressionRatio возвращает отношение сжатого объема к исходному с прошлого
+// вызова (0 — сжатых данных не было) и сбрасывает счетчики.
+func getCompressionRatio() float64 {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+	var ratio float64
+	if compressRawTotal > 0 {
+		ratio = float64(compressOutTotal) / float64(compressRawTotal)
+	}
+	compressRawTotal, compressOutTotal = 0, 0
+	return ratio
+}
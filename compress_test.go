@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// pump передает поток через компрессор и распаковщик так же, как туннель: пакетами
+// не больше maxData, сжатые — через inflater, остальные — напрямую.
+func pump(t *testing.T, chunks [][]byte, maxData int) (out []byte, compressed int) {
+	t.Helper()
+	var dst bytes.Buffer
+	var z *streamInflater
+	c := newStreamCompressor()
+	send := func(p []byte, deflate bool) {
+		if deflate {
+			compressed++
+			if z == nil {
+				z = startInflater(&dst)
+			}
+			if err := z.Write(p); err != nil {
+				t.Fatalf("inflate: %v", err)
+			}
+			return
+		}
+		if z != nil {
+			if _, err := z.Finish(); err != nil {
+				t.Fatalf("inflate finish: %v", err)
+			}
+			z = nil
+		}
+		dst.Write(p)
+	}
+	for _, data := range chunks {
+		for len(data) > 0 {
+			limit := c.ReadLimit(maxData)
+			if limit > 0 {
+				n := min(limit, len(data))
+				if raw := c.Add(data[:n]); raw != nil {
+					send(raw, false)
+				}
+				data = data[n:]
+			}
+			for c.Pending() > 0 && c.ReadLimit(maxData) == 0 {
+				send(c.Take(maxData), true)
+			}
+		}
+	}
+	c.Finish()
+	for c.Pending() > 0 {
+		send(c.Take(maxData), true)
+	}
+	send(nil, false)
+	return dst.Bytes(), compressed
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 2000)
+	noise := make([]byte, 2*compressProbeBytes)
+	rand.Read(noise)
+	tail := []byte("plain tail after incompressible data")
+
+	got, compressed := pump(t, [][]byte{text, noise, tail}, 1000)
+	want := append(append(append([]byte(nil), text...), noise...), tail...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+	if compressed == 0 {
+		t.Fatal("text stream was not compressed")
+	}
+}
+
+func TestCompressSkipsTLS(t *testing.T) {
+	hello := append([]byte{0x16, 0x03, 0x01, 0x02, 0x00}, bytes.Repeat([]byte{0}, 512)...)
+	got, compressed := pump(t, [][]byte{hello}, 1000)
+	if !bytes.Equal(got, hello) {
+		t.Fatal("round trip mismatch")
+	}
+	if compressed != 0 {
+		t.Fatalf("TLS stream must not be compressed, got %d compressed packets", compressed)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Бинарное кодирование управляющих сообщений (Heartbeat, Sync, SyncComplete).
+//
+// Формат: [версия кодирования 1], затем поля TLV: [тег 1][длина 1][значение].
+// Нулевые значения не передаются. Неизвестные теги пропускаются, поэтому новые
+// поля не ломают старых получателей; смена версии означает несовместимый формат.
+//
+// Целые числа — uvarint, идентификаторы — 8 байт big-endian, флаги — поле без значения.
+//
+// Узлы протокола v2 передают те же сообщения в JSON. Получатель различает кодировки
+// по первому байту ('{' у JSON), отправитель выбирает ее по согласованной версии
+// (encodeControl).
+
+const controlVersion = 1
+
+// Теги HeartbeatData
+const (
+	tagHBFPS          = 1
+	tagHBProcessingMS = 2
+	tagHBTimestamp    = 3
+	tagHBTargetFPS    = 4
+	tagHBReceivedFPS  = 5
+	tagHBReady        = 6
+	tagHBSessionID    = 7
+	tagHBSeq          = 8
+	tagHBPhase        = 9
+)
+
+// Теги SyncData. Идентификатор сессии в синхропакетах всегда под тегом 1:
+// по нему проверяется счетчик повторов (replay.go).
+const (
+	tagSyncSessionID   = 1
+	tagSyncNonce       = 2
+	tagSyncMeasuredFPS = 3
+	tagSyncResume      = 4
+	tagSyncNodeID      = 5
+	tagSyncCaps        = 6
+	tagSyncReject      = 7
+	tagSyncPubKey      = 8
+)
+
+// Теги SyncCompleteData
+const (
+	tagSCSessionID = 1
+	tagSCFPS       = 2
+)
+
+// Теги Capabilities (вложены в SyncData)
+const (
+	tagCapVersion    = 1
+	tagCapMinVersion = 2
+	tagCapFeatures   = 3
+	tagCapFrameW     = 4
+	tagCapFrameH     = 5
+	tagCapRSParity   = 6
+)
+
+// Теги, общие для всех сообщений. Добавляются при отправке поверх закодированного
+// сообщения; получатели, которые их не знают, пропускают их как неизвестные.
+const (
+	tagControlCounter = 0xFE // Счетчик для защиты от повтора (replay.go)
+	tagControlMAC     = 0xFF // Подпись секретом пары (crypto.go), всегда последнее поле
+)
+
+var errControlTruncated = errors.New("control message truncated")
+
+type tlvWriter struct {
+	buf []byte
+}
+
+func newControlWriter() *tlvWriter {
+	return &tlvWriter{buf: []byte{controlVersion}}
+}
+
+func (w *tlvWriter) raw(tag byte, v []byte) {
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	w.buf = append(w.buf, tag, byte(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *tlvWriter) uint(tag byte, v uint64) {
+	if v != 0 {
+		w.raw(tag, binary.AppendUvarint(nil, v))
+	}
+}
+
+func (w *tlvWriter) int(tag byte, v int) {
+	if v > 0 {
+		w.uint(tag, uint64(v))
+	}
+}
+
+func (w *tlvWriter) id(tag byte, v int64) {
+	if v != 0 {
+		w.raw(tag, binary.BigEndian.AppendUint64(nil, uint64(v)))
+	}
+}
+
+func (w *tlvWriter) flag(tag byte, v bool) {
+	if v {
+		w.raw(tag, nil)
+	}
+}
+
+// parseTLV вызывает fn для каждого поля.
+func parseTLV(data []byte, fn func(tag byte, v []byte)) error {
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return errControlTruncated
+		}
+		n := int(data[1])
+		fn(data[0], data[2:2+n])
+		data = data[2+n:]
+	}
+	return nil
+}
+
+// parseControl проверяет версию кодирования и разбирает поля сообщения.
+func parseControl(data []byte, fn func(tag byte, v []byte)) error {
+	if len(data) < 1 {
+		return errControlTruncated
+	}
+	if data[0] != controlVersion {
+		return fmt.Errorf("unsupported control encoding v%d", data[0])
+	}
+	return parseTLV(data[1:], fn)
+}
+
+func tlvUint(v []byte) uint64 {
+	n, k := binary.Uvarint(v)
+	if k <= 0 {
+		return 0
+	}
+	return n
+}
+
+func tlvInt(v []byte) int {
+	n := tlvUint(v)
+	if n > math.MaxInt32 {
+		return 0
+	}
+	return int(n)
+}
+
+func tlvID(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func (h *HeartbeatData) MarshalBinary() ([]byte, error) {
+	w := newControlWriter()
+	if h.FPS != 0 {
+		w.raw(tagHBFPS, binary.BigEndian.AppendUint32(nil, math.Float32bits(h.FPS)))
+	}
+	w.int(tagHBProcessingMS, h.ProcessingMS)
+	if h.Timestamp > 0 {
+		w.uint(tagHBTimestamp, uint64(h.Timestamp))
+	}
+	w.int(tagHBTargetFPS, h.TargetFPS)
+	w.int(tagHBReceivedFPS, h.ReceivedFPS)
+	w.flag(tagHBReady, h.Ready)
+	w.id(tagHBSessionID, h.SessionID)
+	w.uint(tagHBSeq, uint64(h.Seq))
+	w.int(tagHBPhase, h.Phase)
+	return w.buf, nil
+}
+
+func (h *HeartbeatData) UnmarshalBinary(data []byte) error {
+	*h = HeartbeatData{}
+	if isJSONControl(data) {
+		return json.Unmarshal(data, (*jsonHeartbeat)(h))
+	}
+	return parseControl(data, func(tag byte, v []byte) {
+		switch tag {
+		case tagHBFPS:
+			if len(v) == 4 {
+				h.FPS = math.Float32frombits(binary.BigEndian.Uint32(v))
+			}
+		case tagHBProcessingMS:
+			h.ProcessingMS = tlvInt(v)
+		case tagHBTimestamp:
+			h.Timestamp = int64(tlvUint(v))
+		case tagHBTargetFPS:
+			h.TargetFPS = tlvInt(v)
+		case tagHBReceivedFPS:
+			h.ReceivedFPS = tlvInt(v)
+		case tagHBReady:
+			h.Ready = true
+		case tagHBSessionID:
+			h.SessionID = tlvID(v)
+		case tagHBSeq:
+			h.Seq = uint32(tlvUint(v))
+		case tagHBPhase:
+			h.Phase = tlvInt(v)
+		}
+	})
+}
+
+func (s *SyncData) MarshalBinary() ([]byte, error) {
+	w := newControlWriter()
+	w.id(tagSyncSessionID, s.SessionID)
+	w.raw(tagSyncNonce, binary.BigEndian.AppendUint32(nil, s.Nonce))
+	w.int(tagSyncMeasuredFPS, s.MeasuredFPS)
+	w.flag(tagSyncResume, s.Resume)
+	w.id(tagSyncNodeID, s.NodeID)
+	if s.Caps != nil {
+		cw := &tlvWriter{}
+		cw.int(tagCapVersion, s.Caps.Version)
+		cw.int(tagCapMinVersion, s.Caps.MinVersion)
+		cw.uint(tagCapFeatures, uint64(s.Caps.Features))
+		cw.int(tagCapFrameW, s.Caps.FrameW)
+		cw.int(tagCapFrameH, s.Caps.FrameH)
+		cw.int(tagCapRSParity, s.Caps.RSParity)
+		w.raw(tagSyncCaps, cw.buf)
+	}
+	if s.Reject != "" {
+		w.raw(tagSyncReject, []byte(s.Reject))
+	}
+	if len(s.PubKey) > 0 {
+		w.raw(tagSyncPubKey, s.PubKey)
+	}
+	return w.buf, nil
+}
+
+func (s *SyncData) UnmarshalBinary(data []byte) error {
+	*s = SyncData{}
+	if isJSONControl(data) {
+		return s.unmarshalJSON(data)
+	}
+	var capsErr error
+	err := parseControl(data, func(tag byte, v []byte) {
+		switch tag {
+		case tagSyncSessionID:
+			s.SessionID = tlvID(v)
+		case tagSyncNonce:
+			if len(v) == 4 {
+				s.Nonce = binary.BigEndian.Uint32(v)
+			}
+		case tagSyncMeasuredFPS:
+			s.MeasuredFPS = tlvInt(v)
+		case tagSyncResume:
+			s.Resume = true
+		case tagSyncNodeID:
+			s.NodeID = tlvID(v)
+		case tagSyncCaps:
+			c := &Capabilities{}
+			capsErr = parseTLV(v, func(tag byte, v []byte) {
+				switch tag {
+				case tagCapVersion:
+					c.Version = tlvInt(v)
+				case tagCapMinVersion:
+					c.MinVersion = tlvInt(v)
+				case tagCapFeatures:
+					c.Features = uint32(tlvUint(v))
+				case tagCapFrameW:
+					c.FrameW = tlvInt(v)
+				case tagCapFrameH:
+					c.FrameH = tlvInt(v)
+				case tagCapRSParity:
+					c.RSParity = tlvInt(v)
+				}
+			})
+			s.Caps = c
+		case tagSyncReject:
+			s.Reject = string(v)
+		case tagSyncPubKey:
+			s.PubKey = append([]byte(nil), v...)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return capsErr
+}
+
+func (s *SyncCompleteData) MarshalBinary() ([]byte, error) {
+	w := newControlWriter()
+	w.id(tagSCSessionID, s.SessionID)
+	w.int(tagSCFPS, s.FPS)
+	return w.buf, nil
+}
+
+// errSyncCompleteNoFPS — SYNC_COMPLETE без итоговой частоты: нулевые поля не передаются,
+// поэтому такой пакет неотличим от пакета с FPS 0 и не может задать скорость приема.
+var errSyncCompleteNoFPS = errors.New("sync complete without FPS")
+
+func (s *SyncCompleteData) UnmarshalBinary(data []byte) error {
+	*s = SyncCompleteData{}
+	var err error
+	if isJSONControl(data) {
+		err = json.Unmarshal(data, (*jsonSyncComplete)(s))
+	} else {
+		err = parseControl(data, func(tag byte, v []byte) {
+			switch tag {
+			case tagSCSessionID:
+				s.SessionID = tlvID(v)
+			case tagSCFPS:
+				s.FPS = tlvInt(v)
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if s.FPS <= 0 {
+		return errSyncCompleteNoFPS
+	}
+	return nil
+}
+
+// Кодировка JSON протокола v2. Поля совпадают с внутренними структурами, поэтому
+// те приводятся к этим типам без копирования.
+
+type jsonHeartbeat struct {
+	FPS          float32 `json:"fps"`
+	ProcessingMS int     `json:"ms"`
+	Timestamp    int64   `json:"ts"`
+	TargetFPS    int     `json:"target_fps"`
+	ReceivedFPS  int     `json:"received_fps"`
+	Ready        bool    `json:"ready"`
+	SessionID    int64   `json:"sid"`
+	Seq          uint32  `json:"seq"`
+	Phase        int     `json:"phase"`
+}
+
+type jsonSyncComplete struct {
+	SessionID int64 `json:"sid"`
+	FPS       int   `json:"fps"`
+}
+
+type jsonCaps struct {
+	Version    int    `json:"ver"`
+	MinVersion int    `json:"min_ver"`
+	Features   uint32 `json:"feat"`
+	FrameW     int    `json:"w"`
+	FrameH     int    `json:"h"`
+	RSParity   int    `json:"rs"`
+}
+
+// jsonSync — SyncData протокола v2: вместо Nonce строка rnd, открытого ключа нет.
+type jsonSync struct {
+	SessionID   int64     `json:"sid"`
+	Random      string    `json:"rnd"`
+	MeasuredFPS int       `json:"fps,omitempty"`
+	Resume      bool      `json:"resume,omitempty"`
+	NodeID      int64     `json:"node,omitempty"`
+	Caps        *jsonCaps `json:"caps,omitempty"`
+	Reject      string    `json:"reject,omitempty"`
+}
+
+// isJSONControl сообщает, что сообщение закодировано в JSON (узел протокола v2).
+func isJSONControl(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
+
+func (s *SyncData) unmarshalJSON(data []byte) error {
+	var js jsonSync
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	*s = SyncData{SessionID: js.SessionID, MeasuredFPS: js.MeasuredFPS, Resume: js.Resume, NodeID: js.NodeID, Reject: js.Reject}
+	if js.Caps != nil {
+		s.Caps = (*Capabilities)(js.Caps)
+	}
+	return nil
+}
+
+// controlMessage — управляющее сообщение (HeartbeatData, SyncData, SyncCompleteData).
+type controlMessage interface {
+	MarshalBinary() ([]byte, error)
+}
+
+// encodeControl собирает пакет типа typ в кодировке версии протокола ver.
+func encodeControl(typ byte, m controlMessage, ver int) []byte {
+	var body []byte
+	if ver >= verTLVControl {
+		body, _ = m.MarshalBinary()
+	} else {
+		switch m := m.(type) {
+		case *HeartbeatData:
+			body, _ = json.Marshal((*jsonHeartbeat)(m))
+		case *SyncCompleteData:
+			body, _ = json.Marshal((*jsonSyncComplete)(m))
+		case *SyncData:
+			js := jsonSync{SessionID: m.SessionID, Random: strconv.FormatUint(uint64(m.Nonce), 36), MeasuredFPS: m.MeasuredFPS,
+				Resume: m.Resume, NodeID: m.NodeID, Caps: (*jsonCaps)(m.Caps), Reject: m.Reject}
+			body, _ = json.Marshal(js)
+		}
+	}
+	return append([]byte{typ}, body...)
+}
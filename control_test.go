@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestControlRoundTrip(t *testing.T) {
+	hb := HeartbeatData{FPS: 12.5, ProcessingMS: 40, Timestamp: 1700000000, TargetFPS: 15, ReceivedFPS: 9,
+		Ready: true, SessionID: 0x7123456789abcdef, Seq: 77, Phase: 2}
+	data, _ := hb.MarshalBinary()
+	var hb2 HeartbeatData
+	if err := hb2.UnmarshalBinary(data); err != nil || hb2 != hb {
+		t.Fatalf("heartbeat mismatch: %+v (err %v)", hb2, err)
+	}
+
+	sd := SyncData{SessionID: 42, Nonce: 0xdeadbeef, MeasuredFPS: 20, Resume: true, NodeID: 99,
+		Caps: localCaps(), Reject: "frame size mismatch", PubKey: newKeyExchange().Public()}
+	data, _ = sd.MarshalBinary()
+	var sd2 SyncData
+	if err := sd2.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(sd, sd2) {
+		t.Fatalf("sync mismatch: %+v (err %v)", sd2, err)
+	}
+
+	scd := SyncCompleteData{SessionID: 5, FPS: 25}
+	data, _ = scd.MarshalBinary()
+	var scd2 SyncCompleteData
+	if err := scd2.UnmarshalBinary(data); err != nil || scd2 != scd {
+		t.Fatalf("sync complete mismatch: %+v (err %v)", scd2, err)
+	}
+}
+
+func TestControlSkipsUnknownFields(t *testing.T) {
+	scd := SyncCompleteData{SessionID: 5, FPS: 25}
+	data, _ := scd.MarshalBinary()
+	// Поле из будущей версии в середине сообщения
+	data = append(data[:1], append([]byte{200, 3, 1, 2, 3}, data[1:]...)...)
+	var scd2 SyncCompleteData
+	if err := scd2.UnmarshalBinary(data); err != nil || scd2 != scd {
+		t.Fatalf("unknown field not skipped: %+v (err %v)", scd2, err)
+	}
+}
+
+func TestSyncCompleteWithoutFPSRejected(t *testing.T) {
+	// Нулевая частота не кодируется: получатель видит сообщение без поля FPS
+	data, _ := (&SyncCompleteData{SessionID: 5}).MarshalBinary()
+	var scd SyncCompleteData
+	if err := scd.UnmarshalBinary(data); !errors.Is(err, errSyncCompleteNoFPS) {
+		t.Fatalf("expected errSyncCompleteNoFPS, got %v (%+v)", err, scd)
+	}
+}
+
+func TestControlRejectsMalformed(t *testing.T) {
+	hb := HeartbeatData{SessionID: 1, Seq: 3}
+	data, _ := hb.MarshalBinary()
+	var out HeartbeatData
+	if err := out.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("truncated message must fail")
+	}
+	data[0] = controlVersion + 1
+	if err := out.UnmarshalBinary(data); err == nil {
+		t.Error("unknown encoding version must fail")
+	}
+}
+
+func TestControlIsCompact(t *testing.T) {
+	hb := HeartbeatData{FPS: 10, ProcessingMS: 35, Timestamp: 1700000000, TargetFPS: 10, ReceivedFPS: 10,
+		Ready: true, SessionID: 0x7123456789abcdef, Seq: 1000}
+	data, _ := hb.MarshalBinary()
+	if len(data) > 48 {
+		t.Errorf("heartbeat takes %d bytes", len(data))
+	}
+}
+
+func TestLegacyJSONSync(t *testing.T) {
+	// Синхропакет узла протокола v2 разбирается и позволяет договориться о v2
+	legacy := []byte(`{"sid":42,"rnd":"abc","caps":{"ver":2,"min_ver":2,"feat":7,"w":640,"h":480,"rs":32}}`)
+	var sd SyncData
+	if err := sd.UnmarshalBinary(legacy); err != nil {
+		t.Fatalf("legacy sync not decoded: %v", err)
+	}
+	if sd.SessionID != 42 || sd.Caps == nil || sd.Caps.Version != 2 || sd.Caps.Features != 7 {
+		t.Fatalf("unexpected legacy sync %+v", sd)
+	}
+
+	// Ответ в версии v2 уходит без счетчика и подписи и разбирается как JSON протокола v2
+	resp := SyncData{SessionID: 7, Nonce: 99, Caps: localCaps(), Reject: "frame size mismatch", PubKey: []byte{1}}
+	reply := sealPacket(encodeControl(typeSync, &resp, 2))
+	if reply[0] != typeSync {
+		t.Fatalf("reply type 0x%02x", reply[0])
+	}
+	var old struct {
+		SessionID int64  `json:"sid"`
+		Random    string `json:"rnd"`
+		Caps      *struct {
+			Version    int `json:"ver"`
+			MinVersion int `json:"min_ver"`
+		} `json:"caps"`
+		Reject string `json:"reject"`
+	}
+	if err := json.Unmarshal(reply[1:], &old); err != nil {
+		t.Fatalf("legacy peer cannot parse the reply: %v", err)
+	}
+	if old.SessionID != 7 || old.Random == "" || old.Reject != resp.Reject || old.Caps == nil || old.Caps.MinVersion != minProtoVersion {
+		t.Fatalf("unexpected reply %+v", old)
+	}
+}
+
+func TestControlEncodingFollowsVersion(t *testing.T) {
+	hb := HeartbeatData{FPS: 9.5, ProcessingMS: 40, TargetFPS: 10, ReceivedFPS: 8, Ready: true, SessionID: 3, Seq: 12}
+	scd := SyncCompleteData{SessionID: 4, FPS: 15}
+	for _, ver := range []int{2, verTLVControl, protoVersion} {
+		p := encodeControl(typeHeartbeat, &hb, ver)
+		if isJSONControl(p[1:]) != (ver < verTLVControl) {
+			t.Fatalf("v%d: heartbeat encoded as %q", ver, p)
+		}
+		var hb2 HeartbeatData
+		if err := hb2.UnmarshalBinary(p[1:]); err != nil || hb2 != hb {
+			t.Fatalf("v%d: heartbeat mismatch %+v (err %v)", ver, hb2, err)
+		}
+		p = encodeControl(typeSyncComplete, &scd, ver)
+		var scd2 SyncCompleteData
+		if err := scd2.UnmarshalBinary(p[1:]); err != nil || scd2 != scd {
+			t.Fatalf("v%d: sync complete mismatch %+v (err %v)", ver, scd2, err)
+		}
+	}
+	if p := encodeControl(typeHeartbeat, &hb, 2); !bytes.Contains(p, []byte(`"received_fps":8`)) {
+		t.Fatalf("heartbeat is not in the v2 format: %s", p[1:])
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Шифрование пакетов туннеля (AES-256-GCM).
+//
+// Ключи согласуются при синхронизации: стороны обмениваются открытыми ключами X25519
+// в SyncData, общий секрет вместе с идентификаторами обеих сессий и обоими открытыми
+// ключами проходит через HKDF-SHA256. Если задан psk, он используется как соль HKDF,
+// и без него ключи не совпадут. Для каждого направления свой ключ и свой префикс nonce.
+//
+// Все пакеты, кроме синхропакетов, идут в обертке typeSealed:
+// [typeSealed][ID ключа][счетчик 4][шифротекст + тег 16]. Nonce — префикс направления (8)
+// и счетчик кадров (4). Заголовок обертки входит в AAD.
+// Получатель помнит предыдущий ключ, чтобы пакеты в полете пережили смену ключей при
+// возобновлении сессии.
+//
+// psk служит и секретом пары клиент-сервер. Синхропакеты, которые нельзя зашифровать,
+// с ним подписываются HMAC-SHA256 (поле tagControlMAC), и узел с psk не принимает
+// ни неподписанных синхропакетов, ни открытых пакетов других типов: сервер выполняет
+// CONNECT только от клиента, знающего секрет.
+
+const (
+	sealHeaderLen = 1 + 1 + 4
+	sealOverhead  = sealHeaderLen + 16
+	sealInfo      = "video-go tunnel v1"
+	pairingInfo   = "video-go pairing v1"
+	controlMACLen = 16
+)
+
+var errSealAuth = errors.New("packet authentication failed")
+
+// keyExchange — ключ X25519 одной синхронизации.
+type keyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+func newKeyExchange() *keyExchange {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("x25519 key generation: %v", err))
+	}
+	return &keyExchange{priv: k}
+}
+
+// Public возвращает открытый ключ для SyncData.
+func (kx *keyExchange) Public() []byte {
+	return kx.priv.PublicKey().Bytes()
+}
+
+// sessionKeys — ключи одной сессии. Направление клиент -> сервер и обратное шифруются
+// разными ключами, поэтому одинаковые счетчики двух сторон не дают повтора nonce.
+type sessionKeys struct {
+	id         byte
+	peerPub    []byte
+	send, recv cipher.AEAD
+	sendPrefix [8]byte
+	recvPrefix [8]byte
+	counter    atomic.Uint32
+	replay     replayWindow // Принятые счетчики входящего направления
+}
+
+// Derive вычисляет ключи сессии по открытому ключу узла.
+func (kx *keyExchange) Derive(peerPub []byte, isClient bool, clientSID, serverSID int64, psk string) (*sessionKeys, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %w", err)
+	}
+	secret, err := kx.priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	clientPub, serverPub := kx.Public(), peerPub
+	if !isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	info := make([]byte, 0, len(sealInfo)+16+64)
+	info = append(info, sealInfo...)
+	info = binary.BigEndian.AppendUint64(info, uint64(clientSID))
+	info = binary.BigEndian.AppendUint64(info, uint64(serverSID))
+	info = append(info, clientPub...)
+	info = append(info, serverPub...)
+
+	// c2s ключ (32), s2c ключ (32), c2s префикс (8), s2c префикс (8), ID ключа (1)
+	okm, err := hkdf.Key(sha256.New, secret, []byte(psk), string(info), 32+32+8+8+1)
+	if err != nil {
+		return nil, err
+	}
+	c2s, err := newGCM(okm[0:32])
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newGCM(okm[32:64])
+	if err != nil {
+		return nil, err
+	}
+	k := &sessionKeys{id: okm[80], peerPub: append([]byte(nil), peerPub...)}
+	if isClient {
+		k.send, k.recv = c2s, s2c
+		copy(k.sendPrefix[:], okm[64:72])
+		copy(k.recvPrefix[:], okm[72:80])
+	} else {
+		k.send, k.recv = s2c, c2s
+		copy(k.sendPrefix[:], okm[72:80])
+		copy(k.recvPrefix[:], okm[64:72])
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal оборачивает пакет в typeSealed.
+func (k *sessionKeys) seal(p []byte) []byte {
+	ctr := k.counter.Add(1)
+	out := make([]byte, sealHeaderLen, sealOverhead+len(p))
+	out[0] = typeSealed
+	out[1] = k.id
+	binary.BigEndian.PutUint32(out[2:], ctr)
+	var nonce [12]byte
+	copy(nonce[:8], k.sendPrefix[:])
+	binary.BigEndian.PutUint32(nonce[8:], ctr)
+	return k.send.Seal(out, nonce[:], p, out[:sealHeaderLen])
+}
+
+// open проверяет и расшифровывает пакет typeSealed.
+func (k *sessionKeys) open(p []byte) ([]byte, error) {
+	if len(p) < sealOverhead || p[0] != typeSealed {
+		return nil, errSealAuth
+	}
+	var nonce [12]byte
+	copy(nonce[:8], k.recvPrefix[:])
+	copy(nonce[8:], p[2:sealHeaderLen])
+	plain, err := k.recv.Open(nil, nonce[:], p[sealHeaderLen:], p[:sealHeaderLen])
+	if err != nil {
+		return nil, errSealAuth
+	}
+	return plain, nil
+}
+
+var (
+	cryptoMu      sync.RWMutex
+	curKeys       *sessionKeys
+	prevKeys      *sessionKeys
+	authFailures  int
+	lastAuthNotes time.Time
+)
+
+// sessionPSK возвращает общий секрет из конфига.
+func sessionPSK() string {
+	if currentCfg == nil {
+		return ""
+	}
+	return currentCfg.PSK
+}
+
+// requiredCaps возвращает возможности, без которых соединяться нельзя:
+// с psk узел не работает без шифрования.
+func requiredCaps() uint32 {
+	if sessionPSK() != "" {
+		return capSeal
+	}
+	return 0
+}
+
+// setSessionKeys включает новые ключи; прежние остаются для приема запоздавших пакетов.
+// nil выключает шифрование.
+func setSessionKeys(k *sessionKeys) {
+	cryptoMu.Lock()
+	defer cryptoMu.Unlock()
+	if k == nil {
+		curKeys, prevKeys = nil, nil
+		return
+	}
+	prevKeys, curKeys = curKeys, k
+}
+
+// sessionPeerKey возвращает открытый ключ узла, с которым согласованы текущие ключи.
+func sessionPeerKey() []byte {
+	cryptoMu.RLock()
+	defer cryptoMu.RUnlock()
+	if curKeys == nil {
+		return nil
+	}
+	return curKeys.peerPub
+}
+
+// sealingActive сообщает, шифруются ли пакеты.
+func sealingActive() bool {
+	cryptoMu.RLock()
+	defer cryptoMu.RUnlock()
+	return curKeys != nil
+}
+
+// pairingKey выводит ключ подписи синхропакетов из psk.
+func pairingKey(psk string) []byte {
+	key, err := hkdf.Key(sha256.New, []byte(psk), nil, pairingInfo, 32)
+	if err != nil {
+		panic(fmt.Sprintf("pairing key: %v", err))
+	}
+	return key
+}
+
+func controlMAC(key, p []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(p)
+	return m.Sum(nil)[:controlMACLen]
+}
+
+// signControl добавляет к управляющему сообщению подпись секретом пары.
+func signControl(p []byte, psk string) []byte {
+	mac := controlMAC(pairingKey(psk), p)
+	out := make([]byte, 0, len(p)+2+controlMACLen)
+	out = append(out, p...)
+	out = append(out, tagControlMAC, controlMACLen)
+	return append(out, mac...)
+}
+
+// verifyControl проверяет подпись и возвращает сообщение без нее.
+func verifyControl(p []byte, psk string) ([]byte, bool) {
+	n := len(p) - 2 - controlMACLen
+	if n < 1 || p[n] != tagControlMAC || p[n+1] != controlMACLen {
+		return nil, false
+	}
+	if !hmac.Equal(p[n+2:], controlMAC(pairingKey(psk), p[:n])) {
+		return nil, false
+	}
+	return p[:n], true
+}
+
+// sealPacket шифрует пакет, если ключи согласованы. Синхропакеты идут открыто
+// (в них передаются ключи) и при заданном psk подписываются.
+func sealPacket(p []byte) []byte {
+	if len(p) == 0 {
+		return p
+	}
+	if (p[0] == typeSync || p[0] == typeSyncComplete) && isJSONControl(p[1:]) {
+		// Узел протокола v2 читает синхропакеты JSON как есть, без счетчика и подписи
+		return p
+	}
+	if p[0] == typeSync || p[0] == typeSyncComplete {
+		p = appendControlCounter(p)
+		if psk := sessionPSK(); psk != "" {
+			return signControl(p, psk)
+		}
+		return p
+	}
+	cryptoMu.RLock()
+	k := curKeys
+	cryptoMu.RUnlock()
+	if k == nil {
+		if peerSupports(capCounted) {
+			return wrapCounted(p)
+		}
+		return p
+	}
+	return k.seal(p)
+}
+
+// openPacket снимает обертки typeSealed и typeCounted, проверяет подпись синхропакетов
+// и отвергает повторы (replay.go). Открытые пакеты, кроме синхропакетов, при включенном
+// шифровании или заданном psk отбрасываются, а после согласования capCounted — и без
+// обертки со счетчиком.
+func openPacket(p []byte) ([]byte, bool) {
+	cryptoMu.RLock()
+	cur, prev := curKeys, prevKeys
+	cryptoMu.RUnlock()
+	psk := sessionPSK()
+	if p[0] == typeSync || p[0] == typeSyncComplete {
+		if psk != "" {
+			msg, ok := verifyControl(p, psk)
+			if !ok {
+				recordAuthFailure(fmt.Sprintf("unauthenticated %s packet", packetTypeName(p[0])))
+				return nil, false
+			}
+			p = msg
+		}
+		return p, checkControlReplay(p)
+	}
+	if p[0] != typeSealed {
+		if cur != nil || psk != "" {
+			recordAuthFailure(fmt.Sprintf("unencrypted %s packet", packetTypeName(p[0])))
+			return nil, false
+		}
+		if p[0] == typeCounted {
+			if len(p) <= countedHeaderLen {
+				recordAuthFailure("truncated packet")
+				return nil, false
+			}
+			inner := p[countedHeaderLen:]
+			switch inner[0] {
+			case typeSync, typeSyncComplete, typeSealed, typeCounted:
+				recordAuthFailure(fmt.Sprintf("nested %s packet", packetTypeName(inner[0])))
+				return nil, false
+			}
+			return inner, checkPlainReplay(binary.BigEndian.Uint64(p[1:countedHeaderLen]))
+		}
+		// Узел с capCounted ставит счетчик на каждый пакет: без него это запись старой сессии
+		if peerSupports(capCounted) {
+			return nil, recordReplayCheck(false, false)
+		}
+		return p, true
+	}
+	if len(p) < sealOverhead {
+		recordAuthFailure("truncated packet")
+		return nil, false
+	}
+	for _, k := range []*sessionKeys{cur, prev} {
+		if k == nil || p[1] != k.id {
+			continue
+		}
+		if plain, err := k.open(p); err == nil {
+			// Счетчик проверяется только после аутентификации: подделка не сдвинет окно
+			return plain, recordReplayCheck(k.replay.Check(uint64(binary.BigEndian.Uint32(p[2:sealHeaderLen]))))
+		}
+	}
+	recordAuthFailure(errSealAuth.Error())
+	return nil, false
+}
+
+// recordAuthFailure считает отброшенные пакеты и пишет в лог не чаще раза в 10 секунд.
+func recordAuthFailure(reason string) {
+	cryptoMu.Lock()
+	defer cryptoMu.Unlock()
+	authFailures++
+	if time.Since(lastAuthNotes) < 10*time.Second {
+		return
+	}
+	log.Printf("Crypto: Rejected %d unauthenticated packets (last: %s); check that both sides use the same psk", authFailures, reason)
+	authFailures = 0
+	lastAuthNotes = time.Now()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// pairKeys согласует ключи клиента и сервера так же, как при синхронизации.
+func pairKeys(t *testing.T, clientPSK, serverPSK string) (client, server *sessionKeys) {
+	t.Helper()
+	ckx, skx := newKeyExchange(), newKeyExchange()
+	client, err := ckx.Derive(skx.Public(), true, 1, 2, clientPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = skx.Derive(ckx.Public(), false, 1, 2, serverPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	client, server := pairKeys(t, "secret", "secret")
+	if client.id != server.id {
+		t.Fatal("key IDs differ")
+	}
+	msg := []byte{typeConnect, 0, 1, 7, 1, prioNormal, 'h', 'o', 's', 't'}
+
+	sealed := client.seal(msg)
+	if bytes.Contains(sealed, []byte("host")) {
+		t.Fatal("payload is not encrypted")
+	}
+	got, err := server.open(sealed)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("server open: %v", err)
+	}
+	// Обратное направление шифруется другим ключом
+	if _, err := client.open(sealed); err == nil {
+		t.Fatal("client must not accept its own packets")
+	}
+	if got, err := client.open(server.seal(msg)); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("client open: %v", err)
+	}
+
+	// Одинаковые пакеты дают разный шифротекст (счетчик кадров в nonce)
+	if bytes.Equal(client.seal(msg), client.seal(msg)) {
+		t.Fatal("nonce reused")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := server.open(sealed); err == nil {
+		t.Fatal("tampered packet accepted")
+	}
+}
+
+func TestSealWrongPSK(t *testing.T) {
+	client, server := pairKeys(t, "secret", "other")
+	if _, err := server.open(client.seal([]byte{typeHeartbeat})); err == nil {
+		t.Fatal("packet accepted with a different psk")
+	}
+}
+
+func TestOpenPacketPolicy(t *testing.T) {
+	defer setSessionKeys(nil)
+	oldClient, oldServer := pairKeys(t, "", "")
+	newClient, newServer := pairKeys(t, "", "")
+	setSessionKeys(oldServer)
+	setSessionKeys(newServer)
+
+	hb := []byte{typeHeartbeat, 1, 2, 3}
+	for name, k := range map[string]*sessionKeys{"current": newClient, "previous": oldClient} {
+		if got, ok := openPacket(k.seal(hb)); !ok || !bytes.Equal(got, hb) {
+			t.Errorf("%s key: packet rejected", name)
+		}
+	}
+	if _, ok := openPacket(hb); ok {
+		t.Error("unencrypted packet accepted while keys are set")
+	}
+	if _, ok := openPacket([]byte{typeSync, 1}); !ok {
+		t.Error("sync packets must pass unencrypted")
+	}
+}
+
+func TestPairingPolicy(t *testing.T) {
+	saved := currentCfg
+	currentCfg = &Config{PSK: "pair"}
+	defer func() { currentCfg = saved }()
+
+	sdBytes, _ := (&SyncData{SessionID: 5, Nonce: 1, Caps: localCaps()}).MarshalBinary()
+	sync := append([]byte{typeSync}, sdBytes...)
+
+	signed := sealPacket(sync)
+	got, ok := openPacket(signed)
+	if !ok || !bytes.HasPrefix(got, sync) {
+		t.Fatal("signed sync rejected")
+	}
+	if _, ok := openPacket(sync); ok {
+		t.Error("unsigned sync accepted")
+	}
+	if _, ok := openPacket(signControl(sync, "other")); ok {
+		t.Error("sync signed with another secret accepted")
+	}
+	signed[3] ^= 1
+	if _, ok := openPacket(signed); ok {
+		t.Error("tampered sync accepted")
+	}
+	// Без согласованных ключей открытый CONNECT тоже не принимается
+	if _, ok := openPacket([]byte{typeConnect, 0, 1, 1, 1, prioNormal, 'x'}); ok {
+		t.Error("unencrypted CONNECT accepted")
+	}
+
+	// Получатель без секрета разбирает подписанное сообщение, пропуская подпись
+	var sd SyncData
+	if err := sd.UnmarshalBinary(signControl(sync, "pair")[1:]); err != nil || sd.SessionID != 5 {
+		t.Errorf("signed sync unreadable without psk: %v", err)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS через видеотуннель (флаг клиента -dns).
+//
+// Клиент открывает локальный DNS-сервер (UDP и TCP на одном адресе) и сам разбирает
+// запросы. Для A и AAAA он отправляет серверу только имя пакетом typeDNSQuery, сервер
+// разрешает его системным резолвером и возвращает все адреса имени пакетом
+// typeDNSAnswer, а клиент собирает из них ответ на исходный запрос. Запросы других
+// типов и классов получают NOTIMP без обращения к серверу: пустой NOERROR выглядел бы
+// как окончательное отсутствие записей, а NOTIMP позволяет резолверу спросить другой сервер.
+//
+// Пакеты не подтверждаются: клиент повторяет запрос каждые dnsRetryInterval, пока
+// не пройдет dnsQueryTimeout, после чего отвечает SERVFAIL. Обе стороны хранят ответы
+// в кэше (dnsCacheTTL, для несуществующих имен — dnsNegativeTTL), поэтому запросы A и
+// AAAA одного имени обходятся одним запросом через туннель.
+//
+// Формат пакетов:
+//   DNS_QUERY:  [тип][ID запроса: 2][имя]
+//   DNS_ANSWER: [тип][ID запроса: 2][RCODE][TTL, с: 2][N4][N4 x IPv4][N6][N6 x IPv6]
+
+const (
+	dnsCacheTTL      = time.Minute
+	dnsNegativeTTL   = 10 * time.Second
+	dnsCacheSize     = 512
+	dnsQueryTimeout  = 6 * time.Second
+	dnsRetryInterval = 2 * time.Second
+	dnsResolveTime   = 5 * time.Second
+	dnsMaxAddrs      = 8 // Адресов каждого семейства в ответе
+	dnsMaxName       = 253
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+)
+
+// dnsResult — результат разрешения имени.
+type dnsResult struct {
+	rcode byte
+	ips   []net.IP
+}
+
+// filter возвращает адреса, подходящие типу запроса.
+func (r dnsResult) filter(qtype uint16) []net.IP {
+	var out []net.IP
+	for _, ip := range r.ips {
+		if (qtype == dnsTypeA) == (ip.To4() != nil) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+type dnsCacheEntry struct {
+	res     dnsResult
+	expires time.Time
+}
+
+// dnsCache — кэш результатов по имени.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]dnsCacheEntry)}
+}
+
+// get возвращает результат и оставшееся время его жизни.
+func (c *dnsCache) get(name string) (dnsResult, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return dnsResult{}, 0, false
+	}
+	left := time.Until(e.expires)
+	if left <= 0 {
+		delete(c.entries, name)
+		return dnsResult{}, 0, false
+	}
+	return e.res, left, true
+}
+
+// put запоминает результат на ttl. SERVFAIL не запоминается.
+func (c *dnsCache) put(name string, res dnsResult, ttl time.Duration) {
+	if res.rcode == dnsRcodeServFail || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		clear(c.entries)
+	}
+	c.entries[name] = dnsCacheEntry{res: res, expires: time.Now().Add(ttl)}
+}
+
+// dnsTTLFor возвращает время жизни нового результата в кэше.
+func dnsTTLFor(res dnsResult) time.Duration {
+	if res.rcode == dnsRcodeNoError {
+		return dnsCacheTTL
+	}
+	return dnsNegativeTTL
+}
+
+func dnsQueryPayload(qid uint16, name string) []byte {
+	payload := []byte{typeDNSQuery, byte(qid >> 8), byte(qid)}
+	return append(payload, name...)
+}
+
+func dnsAnswerPayload(qid uint16, res dnsResult, ttl time.Duration) []byte {
+	secs := int(ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	} else if secs > 0xFFFF {
+		secs = 0xFFFF
+	}
+	var v4, v6 []net.IP
+	for _, ip := range res.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if len(v4) < dnsMaxAddrs {
+				v4 = append(v4, ip4)
+			}
+		} else if len(v6) < dnsMaxAddrs {
+			v6 = append(v6, ip.To16())
+		}
+	}
+	payload := []byte{typeDNSAnswer, byte(qid >> 8), byte(qid), res.rcode, byte(secs >> 8), byte(secs), byte(len(v4))}
+	for _, ip := range v4 {
+		payload = append(payload, ip...)
+	}
+	payload = append(payload, byte(len(v6)))
+	for _, ip := range v6 {
+		payload = append(payload, ip...)
+	}
+	return payload
+}
+
+// parseDNSAnswer разбирает DNS_ANSWER.
+func parseDNSAnswer(data []byte) (uint16, dnsResult, time.Duration, error) {
+	if len(data) < 7 {
+		return 0, dnsResult{}, 0, fmt.Errorf("short DNS answer")
+	}
+	qid := binary.BigEndian.Uint16(data[1:3])
+	res := dnsResult{rcode: data[3]}
+	ttl := time.Duration(binary.BigEndian.Uint16(data[4:6])) * time.Second
+	p := 6
+	for _, size := range []int{net.IPv4len, net.IPv6len} {
+		if p >= len(data) {
+			return 0, dnsResult{}, 0, fmt.Errorf("truncated DNS answer")
+		}
+		n := int(data[p])
+		p++
+		if p+n*size > len(data) {
+			return 0, dnsResult{}, 0, fmt.Errorf("truncated DNS answer")
+		}
+		for i := 0; i < n; i++ {
+			res.ips = append(res.ips, net.IP(append([]byte(nil), data[p:p+size]...)))
+			p += size
+		}
+	}
+	return qid, res, ttl, nil
+}
+
+// dnsResolve разрешает имя на сервере. Несуществующее имя дает NXDOMAIN, имя без
+// адресов нужного семейства — пустой NOERROR (фильтрует клиент).
+func dnsResolve(name string) dnsResult {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTime)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dnsResult{rcode: dnsRcodeNXDomain}
+		}
+		log.Printf("Server: DNS lookup for %s failed: %v", name, err)
+		return dnsResult{rcode: dnsRcodeServFail}
+	}
+	res := dnsResult{rcode: dnsRcodeNoError}
+	for _, a := range addrs {
+		res.ips = append(res.ips, a.IP)
+	}
+	return res
+}
+
+// serveDNSQueries отвечает на запросы DNS клиента на сервере.
+func serveDNSQueries(pd *PacketDispatcher, margin int) {
+	cache := newDNSCache()
+	for data := range pd.dnsQueryCh {
+		if len(data) < 4 || len(data)-3 > dnsMaxName {
+			continue
+		}
+		go func(data []byte) {
+			qid := binary.BigEndian.Uint16(data[1:3])
+			name := string(data[3:])
+			res, ttl, ok := cache.get(name)
+			if !ok {
+				res = dnsResolve(name)
+				ttl = dnsTTLFor(res)
+				cache.put(name, res, ttl)
+			}
+			sendControlPacket(dnsAnswerPayload(qid, res, ttl), margin)
+			recordSentPacket(typeDNSAnswer)
+		}(data)
+	}
+}
+
+// dnsCall — запрос имени, ожидающий ответа сервера. Одновременные запросы одного
+// имени ждут один и тот же вызов.
+type dnsCall struct {
+	answer chan dnsCacheEntry
+	done   chan struct{}
+	res    dnsResult
+	ttl    time.Duration
+}
+
+// dnsTunnelClient отправляет запросы DNS через туннель на клиенте.
+type dnsTunnelClient struct {
+	pd     *PacketDispatcher
+	margin int
+	cache  *dnsCache
+
+	mu       sync.Mutex
+	nextQID  uint16
+	byQID    map[uint16]*dnsCall
+	inflight map[string]*dnsCall
+}
+
+func newDNSTunnelClient(pd *PacketDispatcher, margin int) *dnsTunnelClient {
+	return &dnsTunnelClient{
+		pd:       pd,
+		margin:   margin,
+		cache:    newDNSCache(),
+		byQID:    make(map[uint16]*dnsCall),
+		inflight: make(map[string]*dnsCall),
+	}
+}
+
+// run передает ответы сервера ожидающим вызовам.
+func (dc *dnsTunnelClient) run() {
+	for data := range dc.pd.dnsAnswerCh {
+		qid, res, ttl, err := parseDNSAnswer(data)
+		if err != nil {
+			continue
+		}
+		dc.mu.Lock()
+		call, ok := dc.byQID[qid]
+		dc.mu.Unlock()
+		if !ok {
+			continue
+		}
+		// Клиент не хранит ответ дольше, чем его осталось хранить серверу
+		if ttl > dnsTTLFor(res) {
+			ttl = dnsTTLFor(res)
+		}
+		select {
+		case call.answer <- dnsCacheEntry{res: res, expires: time.Now().Add(ttl)}:
+		default:
+		}
+	}
+}
+
+// Resolve возвращает адреса имени и время, на которое их можно кэшировать.
+func (dc *dnsTunnelClient) Resolve(name string) (dnsResult, time.Duration) {
+	if res, ttl, ok := dc.cache.get(name); ok {
+		return res, ttl
+	}
+	if !peerSupports(capDNS) {
+		return dnsResult{rcode: dnsRcodeServFail}, 0
+	}
+
+	dc.mu.Lock()
+	if call, ok := dc.inflight[name]; ok {
+		dc.mu.Unlock()
+		<-call.done
+		return call.res, call.ttl
+	}
+	dc.nextQID++
+	qid := dc.nextQID
+	call := &dnsCall{answer: make(chan dnsCacheEntry, 1), done: make(chan struct{})}
+	dc.byQID[qid] = call
+	dc.inflight[name] = call
+	dc.mu.Unlock()
+
+	payload := dnsQueryPayload(qid, name)
+	retry := time.NewTicker(dnsRetryInterval)
+	defer retry.Stop()
+	deadline := time.NewTimer(dnsQueryTimeout)
+	defer deadline.Stop()
+	call.res = dnsResult{rcode: dnsRcodeServFail}
+	expires := time.Now()
+	sendControlPacket(payload, dc.margin)
+	recordSentPacket(typeDNSQuery)
+Wait:
+	for {
+		select {
+		case e := <-call.answer:
+			call.res, expires = e.res, e.expires
+			break Wait
+		case <-retry.C:
+			sendControlPacket(payload, dc.margin)
+			recordSentPacket(typeDNSQuery)
+		case <-deadline.C:
+			log.Printf("Client: DNS query for %s timed out", name)
+			break Wait
+		}
+	}
+
+	dc.mu.Lock()
+	delete(dc.byQID, qid)
+	delete(dc.inflight, name)
+	dc.mu.Unlock()
+	call.ttl = time.Until(expires)
+	dc.cache.put(name, call.res, call.ttl)
+	close(call.done)
+	return call.res, call.ttl
+}
+
+// dnsQuestion — вопрос из запроса DNS.
+type dnsQuestion struct {
+	name   string // В нижнем регистре, без завершающей точки
+	qtype  uint16
+	qclass uint16
+	end    int // Смещение конца вопроса в сообщении
+}
+
+// parseDNSQuestion разбирает заголовок и единственный вопрос запроса. При ошибке
+// возвращает RCODE для ответа.
+func parseDNSQuestion(msg []byte) (dnsQuestion, byte, error) {
+	if len(msg) < 12 {
+		return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("short DNS message")
+	}
+	if msg[2]&0x80 != 0 {
+		return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("DNS message is a response")
+	}
+	if opcode := (msg[2] >> 3) & 0x0F; opcode != 0 {
+		return dnsQuestion{}, dnsRcodeNotImp, fmt.Errorf("DNS opcode %d not supported", opcode)
+	}
+	if qd := binary.BigEndian.Uint16(msg[4:6]); qd != 1 {
+		return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("DNS query with %d questions", qd)
+	}
+	var labels []string
+	p := 12
+	for {
+		if p >= len(msg) {
+			return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("truncated DNS question")
+		}
+		n := int(msg[p])
+		p++
+		if n == 0 {
+			break
+		}
+		if n > 63 || p+n > len(msg) {
+			// Сжатие имен в вопросе запроса не используется
+			return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("invalid DNS label")
+		}
+		label := strings.ToLower(string(msg[p : p+n]))
+		if strings.ContainsAny(label, ". \x00") {
+			return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("invalid DNS label %q", label)
+		}
+		labels = append(labels, label)
+		p += n
+	}
+	if p+4 > len(msg) {
+		return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("truncated DNS question")
+	}
+	q := dnsQuestion{
+		name:   strings.Join(labels, "."),
+		qtype:  binary.BigEndian.Uint16(msg[p : p+2]),
+		qclass: binary.BigEndian.Uint16(msg[p+2 : p+4]),
+		end:    p + 4,
+	}
+	if len(q.name) > dnsMaxName {
+		return dnsQuestion{}, dnsRcodeFormErr, fmt.Errorf("DNS name too long")
+	}
+	return q, dnsRcodeNoError, nil
+}
+
+// buildDNSResponse собирает ответ на запрос msg. Если q == nil, вопрос в ответ не
+// копируется (запрос не разобран).
+func buildDNSResponse(msg []byte, q *dnsQuestion, rcode byte, ips []net.IP, ttl time.Duration) []byte {
+	resp := make([]byte, 12, 512)
+	copy(resp[0:2], msg[0:2])
+	resp[2] = 0x80 | msg[2]&0x79 // QR, OPCODE и RD из запроса
+	resp[3] = 0x80 | rcode       // RA
+	if q == nil {
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(ips)))
+	resp = append(resp, msg[12:q.end]...)
+	secs := uint32(ttl / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	for _, ip := range ips {
+		rdata := ip.To4()
+		if q.qtype == dnsTypeAAAA {
+			rdata = ip.To16()
+		}
+		// Имя — ссылка на вопрос (смещение 12)
+		resp = append(resp, 0xC0, 0x0C)
+		resp = binary.BigEndian.AppendUint16(resp, q.qtype)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, secs)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+// answer отвечает на запрос DNS приложения. Возвращает nil, если отвечать нечего.
+func (dc *dnsTunnelClient) answer(msg []byte) []byte {
+	q, rcode, err := parseDNSQuestion(msg)
+	if err != nil {
+		if len(msg) < 12 || msg[2]&0x80 != 0 {
+			return nil
+		}
+		return buildDNSResponse(msg, nil, rcode, nil, 0)
+	}
+	if q.qclass != dnsClassIN || (q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA) {
+		return buildDNSResponse(msg, &q, dnsRcodeNotImp, nil, 0)
+	}
+	res, ttl := dc.Resolve(q.name)
+	return buildDNSResponse(msg, &q, res.rcode, res.filter(q.qtype), ttl)
+}
+
+// serveDNSUDP отвечает на запросы DNS по UDP.
+func serveDNSUDP(pc net.PacketConn, dc *dnsTunnelClient) {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Client: DNS listener stopped: %v", err)
+			return
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := dc.answer(msg); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+// serveDNSTCP отвечает на запросы DNS одного TCP-соединения (сообщения с длиной в
+// двух байтах, RFC 1035 4.2.2).
+func serveDNSTCP(c net.Conn, dc *dnsTunnelClient) {
+	lenBuf := make([]byte, 2)
+	for {
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(c, lenBuf); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+		resp := dc.answer(msg)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := c.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// startDNSServer открывает локальный DNS-сервер клиента на UDP и TCP.
+func startDNSServer(addr string, pd *PacketDispatcher, margin int) {
+	dc := newDNSTunnelClient(pd, margin)
+	go dc.run()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("Client: Failed to listen for DNS on udp %s: %v", addr, err)
+	} else {
+		log.Printf("Client: DNS server listening on udp %s", addr)
+		go serveDNSUDP(pc, dc)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Client: Failed to listen for DNS on tcp %s: %v", addr, err)
+	} else {
+		log.Printf("Client: DNS server listening on tcp %s", addr)
+		go acceptLoop(ln, func(c net.Conn) {
+			defer c.Close()
+			serveDNSTCP(c, dc)
+		})
+	}
+}
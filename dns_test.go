@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dnsTestQuery(id uint16, name string, qtype uint16) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0} // RD, один вопрос
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN)
+}
+
+// dnsTestAnswers возвращает RCODE и данные записей ответа.
+func dnsTestAnswers(t *testing.T, resp []byte, query []byte) (byte, [][]byte) {
+	t.Helper()
+	if len(resp) < len(query) || resp[0] != query[0] || resp[1] != query[1] {
+		t.Fatalf("bad response header %x", resp)
+	}
+	if resp[2]&0x80 == 0 || resp[2]&0x01 == 0 || resp[3]&0x80 == 0 {
+		t.Fatalf("QR, RD or RA not set: %x", resp[2:4])
+	}
+	var rdata [][]byte
+	p := len(query)
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:8])); i++ {
+		n := int(binary.BigEndian.Uint16(resp[p+10 : p+12]))
+		rdata = append(rdata, resp[p+12:p+12+n])
+		p += 12 + n
+	}
+	if p != len(resp) {
+		t.Fatalf("trailing bytes in response: %d of %d", p, len(resp))
+	}
+	return resp[3] & 0x0F, rdata
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	q, _, err := parseDNSQuestion(dnsTestQuery(7, "WWW.Example.com", dnsTypeAAAA))
+	if err != nil || q.name != "www.example.com" || q.qtype != dnsTypeAAAA || q.qclass != dnsClassIN {
+		t.Fatalf("got %+v (err %v)", q, err)
+	}
+
+	opcode := dnsTestQuery(1, "example.com", dnsTypeA)
+	opcode[2] |= 2 << 3
+	twoQuestions := dnsTestQuery(1, "example.com", dnsTypeA)
+	twoQuestions[5] = 2
+	response := dnsTestQuery(1, "example.com", dnsTypeA)
+	response[2] |= 0x80
+	pointer := append(dnsTestQuery(1, "a", dnsTypeA)[:12], 0xC0, 0x0C, 0, 1, 0, 1)
+	cases := []struct {
+		name  string
+		msg   []byte
+		rcode byte
+	}{
+		{"short", []byte{1, 2, 3}, dnsRcodeFormErr},
+		{"opcode", opcode, dnsRcodeNotImp},
+		{"two questions", twoQuestions, dnsRcodeFormErr},
+		{"response", response, dnsRcodeFormErr},
+		{"compressed name", pointer, dnsRcodeFormErr},
+		{"truncated", dnsTestQuery(1, "example.com", dnsTypeA)[:20], dnsRcodeFormErr},
+	}
+	for _, c := range cases {
+		if _, rcode, err := parseDNSQuestion(c.msg); err == nil || rcode != c.rcode {
+			t.Errorf("%s: rcode %d (err %v), want %d", c.name, rcode, err, c.rcode)
+		}
+	}
+}
+
+func TestDNSAnswerPayloadRoundTrip(t *testing.T) {
+	res := dnsResult{rcode: dnsRcodeNoError}
+	for i := 0; i < dnsMaxAddrs+2; i++ {
+		res.ips = append(res.ips, net.IPv4(192, 0, 2, byte(i)), net.ParseIP("2001:db8::1"))
+	}
+	payload := dnsAnswerPayload(513, res, 42*time.Second)
+	qid, got, ttl, err := parseDNSAnswer(payload)
+	if err != nil || qid != 513 || ttl != 42*time.Second || got.rcode != dnsRcodeNoError {
+		t.Fatalf("got qid %d ttl %v rcode %d (err %v)", qid, ttl, got.rcode, err)
+	}
+	if len(got.filter(dnsTypeA)) != dnsMaxAddrs || len(got.filter(dnsTypeAAAA)) != dnsMaxAddrs {
+		t.Fatalf("got %d IPv4 and %d IPv6 addresses", len(got.filter(dnsTypeA)), len(got.filter(dnsTypeAAAA)))
+	}
+	if !got.ips[1].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("unexpected address %v", got.ips[1])
+	}
+	for n := 0; n < len(payload); n++ {
+		if _, _, _, err := parseDNSAnswer(payload[:n]); err == nil {
+			t.Fatalf("truncated answer of %d bytes accepted", n)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	c := newDNSCache()
+	c.put("fail.example", dnsResult{rcode: dnsRcodeServFail}, time.Minute)
+	if _, _, ok := c.get("fail.example"); ok {
+		t.Fatal("SERVFAIL cached")
+	}
+	c.put("nx.example", dnsResult{rcode: dnsRcodeNXDomain}, dnsNegativeTTL)
+	if res, ttl, ok := c.get("nx.example"); !ok || res.rcode != dnsRcodeNXDomain || ttl > dnsNegativeTTL {
+		t.Fatalf("negative entry: %+v %v %v", res, ttl, ok)
+	}
+	c.put("short.example", dnsResult{}, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, _, ok := c.get("short.example"); ok {
+		t.Fatal("expired entry returned")
+	}
+}
+
+func TestDNSClientAnswer(t *testing.T) {
+	dc := newDNSTunnelClient(NewPacketDispatcher(10), 10)
+	dc.cache.put("example.com", dnsResult{ips: []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::2")}}, time.Minute)
+	dc.cache.put("nx.example", dnsResult{rcode: dnsRcodeNXDomain}, time.Minute)
+
+	query := dnsTestQuery(100, "Example.COM", dnsTypeA)
+	rcode, rdata := dnsTestAnswers(t, dc.answer(query), query)
+	if rcode != dnsRcodeNoError || len(rdata) != 1 || !net.IP(rdata[0]).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("A: rcode %d, answers %x", rcode, rdata)
+	}
+	query = dnsTestQuery(101, "example.com", dnsTypeAAAA)
+	rcode, rdata = dnsTestAnswers(t, dc.answer(query), query)
+	if rcode != dnsRcodeNoError || len(rdata) != 1 || len(rdata[0]) != net.IPv6len {
+		t.Fatalf("AAAA: rcode %d, answers %x", rcode, rdata)
+	}
+	query = dnsTestQuery(102, "nx.example", dnsTypeA)
+	if rcode, rdata = dnsTestAnswers(t, dc.answer(query), query); rcode != dnsRcodeNXDomain || len(rdata) != 0 {
+		t.Fatalf("NXDOMAIN: rcode %d, answers %x", rcode, rdata)
+	}
+	// Другие типы не идут в туннель и получают NOTIMP, а не пустой ответ
+	for _, qtype := range []uint16{5, 12, 15, 16, 33} { // CNAME, PTR, MX, TXT, SRV
+		query = dnsTestQuery(103, "example.com", qtype)
+		if rcode, rdata = dnsTestAnswers(t, dc.answer(query), query); rcode != dnsRcodeNotImp || len(rdata) != 0 {
+			t.Fatalf("type %d: rcode %d, answers %x", qtype, rcode, rdata)
+		}
+	}
+	query = dnsTestQuery(106, "example.com", dnsTypeA)
+	binary.BigEndian.PutUint16(query[len(query)-2:], 3) // Класс CH
+	if rcode, _ = dnsTestAnswers(t, dc.answer(query), query); rcode != dnsRcodeNotImp {
+		t.Fatalf("class CH: rcode %d", rcode)
+	}
+	// Без поддержки на сервере — SERVFAIL
+	query = dnsTestQuery(104, "other.example", dnsTypeA)
+	if rcode, _ = dnsTestAnswers(t, dc.answer(query), query); rcode != dnsRcodeServFail {
+		t.Fatalf("unsupported peer: rcode %d", rcode)
+	}
+	// Ответы на ответы не отправляются
+	resp := dnsTestQuery(105, "example.com", dnsTypeA)
+	resp[2] |= 0x80
+	if dc.answer(resp) != nil {
+		t.Fatal("answered a DNS response")
+	}
+}
+
+func TestServeDNSTCP(t *testing.T) {
+	dc := newDNSTunnelClient(NewPacketDispatcher(10), 10)
+	dc.cache.put("example.com", dnsResult{ips: []net.IP{net.IPv4(192, 0, 2, 7)}}, time.Minute)
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		serveDNSTCP(server, dc)
+	}()
+	for id := uint16(1); id <= 2; id++ {
+		query := dnsTestQuery(id, "example.com", dnsTypeA)
+		go client.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(client, lenBuf); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(client, resp); err != nil {
+			t.Fatal(err)
+		}
+		if _, rdata := dnsTestAnswers(t, resp, query); len(rdata) != 1 || !net.IP(rdata[0]).Equal(net.IPv4(192, 0, 2, 7)) {
+			t.Fatalf("query %d: answers %x", id, rdata)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ограничения адресов назначения на сервере (exit_policy в конфиге сервера).
+//
+// Сервер проверяет адрес перед каждым соединением CONNECT, для каждой датаграммы
+// UDP ASSOCIATE и для ожидаемого адреса BIND. Имена разрешаются заранее, и проверяется
+// каждый полученный IP: соединение идет только на разрешенный адрес, поэтому имя,
+// указывающее на 127.0.0.1, не открывает доступ к локальным сервисам. Запрещенный
+// адрес получает ответ 0x02 (not allowed).
+//
+// Порядок проверки: правило deny запрещает; правило allow с явными узлами разрешает,
+// в том числе частный адрес; частные, локальные и loopback-адреса запрещены, если не
+// задано allow_private; при непустом allow остальное разрешают только правила allow
+// без узлов (по одним портам).
+
+// ExitRule — правило политики. Пустой список узлов или портов совпадает с любым значением.
+type ExitRule struct {
+	// Точное имя или IP, "*.example.com" (сам домен и поддомены) или подсеть "10.0.0.0/8"
+	Hosts []string `json:"hosts,omitempty"`
+	Ports []int    `json:"ports,omitempty"`
+}
+
+// ExitPolicy — ограничения адресов назначения сервера.
+type ExitPolicy struct {
+	Allow        []ExitRule `json:"allow,omitempty"`
+	Deny         []ExitRule `json:"deny,omitempty"`
+	AllowPrivate bool       `json:"allow_private,omitempty"`
+}
+
+// privateNets — сети, закрытые по умолчанию, кроме тех, что проверяются методами net.IP.
+var privateNets = []*net.IPNet{
+	mustCIDR("100.64.0.0/10"), // Shared address space (CGNAT)
+	mustCIDR("0.0.0.0/8"),
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPrivateIP сообщает, относится ли адрес к локальным или частным сетям.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// exitPolicy возвращает политику из конфига или политику по умолчанию.
+func exitPolicy() *ExitPolicy {
+	if currentCfg == nil || currentCfg.ExitPolicy == nil {
+		return &ExitPolicy{}
+	}
+	return currentCfg.ExitPolicy
+}
+
+func (r *ExitRule) matches(host string, ip net.IP, port int) bool {
+	if len(r.Ports) > 0 && !portListed(r.Ports, port) {
+		return false
+	}
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range r.Hosts {
+		if hostMatches(pattern, host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows проверяет адрес назначения: host — имя из запроса (или IP), ip — адрес,
+// к которому сервер будет подключаться.
+func (p *ExitPolicy) Allows(host string, ip net.IP, port int) bool {
+	host = strings.ToLower(host)
+	for i := range p.Deny {
+		if p.Deny[i].matches(host, ip, port) {
+			return false
+		}
+	}
+	anyPort := false
+	for i := range p.Allow {
+		if !p.Allow[i].matches(host, ip, port) {
+			continue
+		}
+		if len(p.Allow[i].Hosts) > 0 {
+			return true
+		}
+		anyPort = true
+	}
+	if isPrivateIP(ip) && !p.AllowPrivate {
+		return false
+	}
+	return len(p.Allow) == 0 || anyPort
+}
+
+// exitResolve разрешает target ("host:port") и возвращает адреса, разрешенные политикой.
+// Если разрешенных нет, ошибка оборачивает errSocksNotAllowed.
+func exitResolve(ctx context.Context, target string) ([]net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	policy := exitPolicy()
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if policy.Allows(host, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		log.Printf("Server: Exit policy denies %s (%v)", target, ips)
+		return nil, 0, fmt.Errorf("exit policy: %s: %w", target, errSocksNotAllowed)
+	}
+	return allowed, port, nil
+}
+
+// exitDial соединяется с target по TCP, если политика это разрешает.
+func exitDial(target string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, port, err := exitResolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// exitResolveUDP возвращает разрешенный политикой адрес назначения датаграммы.
+func exitResolveUDP(target string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, port, err := exitResolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// exitCheckBind проверяет ожидаемый адрес BIND. Неуказанный адрес (соединение с любого
+// узла) не проверяется: входящее соединение сервер не открывает сам.
+func exitCheckBind(target string) error {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, _, err = exitResolve(ctx, target)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExitPolicyAllows(t *testing.T) {
+	policy := &ExitPolicy{
+		Deny: []ExitRule{
+			{Ports: []int{25}},
+			{Hosts: []string{"*.blocked.example"}},
+		},
+		Allow: []ExitRule{
+			{Hosts: []string{"10.1.0.0/16"}, Ports: []int{22}},
+			{Ports: []int{80, 443}},
+		},
+	}
+	cases := []struct {
+		host string
+		ip   string
+		port int
+		want bool
+	}{
+		{"example.com", "93.184.216.34", 443, true},
+		{"example.com", "93.184.216.34", 8080, false}, // Нет правила allow для порта
+		{"mail.example.com", "93.184.216.34", 25, false},
+		{"www.blocked.example", "93.184.216.35", 443, false},
+		{"blocked.example", "93.184.216.35", 80, false},
+		{"10.1.2.3", "10.1.2.3", 22, true},     // Явное правило открывает частную сеть
+		{"10.1.2.3", "10.1.2.3", 80, false},    // Правило по одному порту — нет
+		{"10.2.0.1", "10.2.0.1", 22, false},    // Вне подсети правила
+		{"localhost", "127.0.0.1", 443, false}, // Имя не обходит проверку адреса
+	}
+	for _, c := range cases {
+		if got := policy.Allows(c.host, net.ParseIP(c.ip), c.port); got != c.want {
+			t.Errorf("%s (%s) port %d: got %v, want %v", c.host, c.ip, c.port, got, c.want)
+		}
+	}
+}
+
+func TestExitPolicyDefaultDeniesPrivate(t *testing.T) {
+	policy := &ExitPolicy{}
+	for _, ip := range []string{"127.0.0.1", "::1", "10.0.0.1", "172.16.5.4", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "fd00::1", "fe80::1", "::ffff:127.0.0.1"} {
+		if policy.Allows(ip, net.ParseIP(ip), 80) {
+			t.Errorf("%s allowed by default policy", ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		if !policy.Allows(ip, net.ParseIP(ip), 80) {
+			t.Errorf("%s denied by default policy", ip)
+		}
+	}
+	policy.AllowPrivate = true
+	if !policy.Allows("127.0.0.1", net.ParseIP("127.0.0.1"), 80) {
+		t.Error("allow_private does not open loopback")
+	}
+}
+
+func TestExitDialDeniesLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	defer func() { currentCfg = nil }()
+	currentCfg = &Config{}
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		_, err := exitDial(net.JoinHostPort(host, port), time.Second)
+		if !errors.Is(err, errSocksNotAllowed) {
+			t.Fatalf("%s: expected not allowed, got %v", host, err)
+		}
+		if socksReplyCode(err) != socks5RespNotAllowed {
+			t.Fatalf("%s: status 0x%02x", host, socksReplyCode(err))
+		}
+	}
+
+	currentCfg = &Config{ExitPolicy: &ExitPolicy{AllowPrivate: true}}
+	c, err := exitDial(ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestExitCheckBind(t *testing.T) {
+	defer func() { currentCfg = nil }()
+	currentCfg = &Config{}
+	if err := exitCheckBind("0.0.0.0:0"); err != nil {
+		t.Fatalf("unspecified BIND address rejected: %v", err)
+	}
+	if err := exitCheckBind("192.168.0.10:21"); !errors.Is(err, errSocksNotAllowed) {
+		t.Fatalf("private BIND peer: got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := exitResolve(ctx, fmt.Sprintf("8.8.8.8:%d", 53)); err != nil {
+		t.Fatalf("public address rejected: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Межкадровая коррекция ошибок (FEC).
+//
+// Пакеты группируются по k кадров данных, после группы отправляется XOR-кадр четности.
+// Получатель, собравший k-1 кадров группы и кадр четности, восстанавливает потерянный
+// кадр локально, не дожидаясь ретрансляции через оба видеоканала.
+//
+// Кадр данных:    [typeFecData][группа 2][индекс 1][пакет...]
+// Кадр четности:  [typeFecParity][группа 2][k 1][длины 2*k][XOR пакетов, дополненных нулями]
+
+const (
+	fecMinGroup = 2
+	fecMaxGroup = 16
+
+	fecDataHeaderLen = 4
+	// Кадр четности длиннее самого длинного пакета группы на заголовок и таблицу длин
+	fecOverhead = 4 + 2*fecMaxGroup
+
+	// fecMaxParity — сколько разных кадров четности одной группы хранит получатель
+	fecMaxParity = 4
+
+	fecFlushTimeout = 500 * time.Millisecond
+	fecGroupTTL     = 10 * time.Second
+)
+
+// fecGroupSize выбирает размер группы по доле потерянных кадров: чем больше потерь,
+// тем чаще кадры четности. При потерях 10% получается группа из 5 кадров (оверхед 20%).
+func fecGroupSize(loss float64) int {
+	if loss <= 0.01 {
+		return fecMaxGroup
+	}
+	n := int(1 / (2 * loss))
+	if n < fecMinGroup {
+		n = fecMinGroup
+	}
+	if n > fecMaxGroup {
+		n = fecMaxGroup
+	}
+	return n
+}
+
+type fecEncoder struct {
+	mu        sync.Mutex
+	group     uint16
+	target    int
+	packets   [][]byte
+	lastAdd   time.Time
+	lossRate  func() float64
+	pendingTx [][]byte
+	// ready будит fecParityPump, когда в группе появляется пакет
+	ready chan struct{}
+}
+
+func newFecEncoder(lossRate func() float64) *fecEncoder {
+	return &fecEncoder{lossRate: lossRate, ready: make(chan struct{}, 1)}
+}
+
+// Wrap оборачивает пакет в кадр данных FEC. Кадр четности завершенной группы
+// откладывается до свободного слота (см. TakeParity).
+func (e *fecEncoder) Wrap(packet []byte) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.packets) == 0 {
+		e.target = fecGroupSize(e.lossRate())
+	}
+	frame := make([]byte, fecDataHeaderLen+len(packet))
+	frame[0] = typeFecData
+	binary.BigEndian.PutUint16(frame[1:3], e.group)
+	frame[3] = byte(len(e.packets))
+	copy(frame[fecDataHeaderLen:], packet)
+
+	e.packets = append(e.packets, append([]byte(nil), packet...))
+	e.lastAdd = time.Now()
+	if len(e.packets) >= e.target {
+		e.closeGroup()
+	}
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+	return frame
+}
+
+// TakeParity возвращает готовый кадр четности. Незавершенная группа закрывается,
+// если новых пакетов не было дольше fecFlushTimeout, чтобы хвост передачи тоже был защищен.
+// Если кадра нет, но группа открыта, возвращает время до ее закрытия.
+func (e *fecEncoder) TakeParity() ([]byte, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.pendingTx) == 0 && len(e.packets) > 0 {
+		if wait := fecFlushTimeout - time.Since(e.lastAdd); wait > 0 {
+			return nil, wait
+		}
+		e.closeGroup()
+	}
+	if len(e.pendingTx) == 0 {
+		return nil, 0
+	}
+	p := e.pendingTx[0]
+	e.pendingTx = e.pendingTx[1:]
+	return p, 0
+}
+
+func (e *fecEncoder) closeGroup() {
+	k := len(e.packets)
+	maxLen := 0
+	for _, p := range e.packets {
+		if len(p) > maxLen {
+			maxLen = len(p)
+		}
+	}
+	hdr := 4 + 2*k
+	parity := make([]byte, hdr+maxLen)
+	parity[0] = typeFecParity
+	binary.BigEndian.PutUint16(parity[1:3], e.group)
+	parity[3] = byte(k)
+	for i, p := range e.packets {
+		binary.BigEndian.PutUint16(parity[4+2*i:], uint16(len(p)))
+		for j, b := range p {
+			parity[hdr+j] ^= b
+		}
+	}
+	e.pendingTx = append(e.pendingTx, parity)
+	e.packets = nil
+	e.group++
+}
+
+type fecGroup struct {
+	packets map[byte][]byte
+	// Кандидаты в кадры четности. Заголовки FEC не аутентифицированы, поэтому
+	// подброшенный кадр не должен вытеснить настоящий (см. Reject).
+	parity  [][]byte
+	done    bool
+	created time.Time
+}
+
+type fecDecoder struct {
+	mu     sync.Mutex
+	groups map[uint16]*fecGroup
+
+	recovered int
+}
+
+func newFecDecoder() *fecDecoder {
+	return &fecDecoder{groups: make(map[uint16]*fecGroup)}
+}
+
+// Unwrap разбирает кадр FEC. Возвращает пакеты кадра данных и отдельно пакет,
+// восстановленный по четности, если группа сложилась.
+func (d *fecDecoder) Unwrap(frame []byte) (packets [][]byte, rec []byte) {
+	if len(frame) < 4 {
+		return nil, nil
+	}
+	group := binary.BigEndian.Uint16(frame[1:3])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire()
+
+	g, ok := d.groups[group]
+	if !ok {
+		g = &fecGroup{packets: make(map[byte][]byte), created: time.Now()}
+		d.groups[group] = g
+	}
+
+	switch frame[0] {
+	case typeFecData:
+		packet := frame[fecDataHeaderLen:]
+		if _, seen := g.packets[frame[3]]; !seen {
+			g.packets[frame[3]] = append([]byte(nil), packet...)
+		}
+		packets = append(packets, packet)
+	case typeFecParity:
+		g.addParity(frame)
+	}
+	if rec = g.tryRecover(); rec != nil {
+		d.recovered++
+	}
+	return packets, rec
+}
+
+// Reject сообщает, что восстановленный пакет группы не прошел проверку (openPacket).
+// Кадр четности, из которого он получен, отбрасывается, и восстановление повторяется
+// по следующему кандидату.
+func (d *fecDecoder) Reject(group uint16) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g, ok := d.groups[group]
+	if !ok || len(g.parity) == 0 {
+		return nil
+	}
+	d.recovered--
+	g.parity = g.parity[1:]
+	g.done = false
+	rec := g.tryRecover()
+	if rec != nil {
+		d.recovered++
+	}
+	return rec
+}
+
+// Recovered возвращает число восстановленных пакетов с момента последнего вызова.
+func (d *fecDecoder) Recovered() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.recovered
+	d.recovered = 0
+	return n
+}
+
+func (g *fecGroup) addParity(frame []byte) {
+	if g.done || len(g.parity) >= fecMaxParity {
+		return
+	}
+	for _, p := range g.parity {
+		if bytes.Equal(p, frame) {
+			return
+		}
+	}
+	g.parity = append(g.parity, append([]byte(nil), frame...))
+}
+
+// tryRecover восстанавливает пакет по первому подходящему кандидату четности.
+func (g *fecGroup) tryRecover() []byte {
+	for !g.done && len(g.parity) > 0 {
+		parity := g.parity[0]
+		k := int(parity[3])
+		hdr := 4 + 2*k
+		if k == 0 || len(parity) < hdr || len(g.packets) >= k {
+			// Кадр испорчен или не нужен: группа уже собрана
+			g.parity = g.parity[1:]
+			continue
+		}
+		if len(g.packets) != k-1 {
+			return nil
+		}
+		missing := -1
+		for i := 0; i < k; i++ {
+			if _, ok := g.packets[byte(i)]; !ok {
+				missing = i
+				break
+			}
+		}
+		if missing < 0 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(parity[4+2*missing:]))
+		if hdr+n > len(parity) {
+			g.parity = g.parity[1:]
+			continue
+		}
+		g.done = true
+		rec := make([]byte, n)
+		copy(rec, parity[hdr:hdr+n])
+		for _, p := range g.packets {
+			for j := 0; j < n && j < len(p); j++ {
+				rec[j] ^= p[j]
+			}
+		}
+		return rec
+	}
+	return nil
+}
+
+func (d *fecDecoder) expire() {
+	now := time.Now()
+	for id, g := range d.groups {
+		if now.Sub(g.created) > fecGroupTTL {
+			delete(d.groups, id)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFecGroupSize(t *testing.T) {
+	cases := []struct {
+		loss float64
+		want int
+	}{
+		{0, fecMaxGroup},
+		{0.05, 10},
+		{0.1, 5},
+		{0.3, fecMinGroup},
+	}
+	for _, c := range cases {
+		if got := fecGroupSize(c.loss); got != c.want {
+			t.Errorf("fecGroupSize(%.2f) = %d, want %d", c.loss, got, c.want)
+		}
+	}
+}
+
+func TestFecRecoverMissingPacket(t *testing.T) {
+	enc := newFecEncoder(func() float64 { return 0.1 }) // группа из 5 кадров
+	var packets, frames [][]byte
+	for i := 0; i < 5; i++ {
+		p := []byte(fmt.Sprintf("packet %d %s", i, bytes.Repeat([]byte{'x'}, i*7)))
+		packets = append(packets, p)
+		frames = append(frames, enc.Wrap(p))
+	}
+	parity, _ := enc.TakeParity()
+	if parity == nil || parity[0] != typeFecParity {
+		t.Fatal("Expected parity frame after a full group")
+	}
+
+	dec := newFecDecoder()
+	lost := 2
+	for i, f := range frames {
+		if i == lost {
+			continue
+		}
+		out, rec := dec.Unwrap(f)
+		if len(out) != 1 || !bytes.Equal(out[0], packets[i]) || rec != nil {
+			t.Fatalf("Data frame %d unwrapped incorrectly: %q", i, out)
+		}
+	}
+	out, rec := dec.Unwrap(parity)
+	if len(out) != 0 || !bytes.Equal(rec, packets[lost]) {
+		t.Fatalf("Expected recovered packet %q, got %q", packets[lost], rec)
+	}
+	if dec.Recovered() != 1 {
+		t.Error("Recovered counter was not updated")
+	}
+	// Повторный кадр четности не должен восстанавливать пакет еще раз
+	if out, rec := dec.Unwrap(parity); len(out) != 0 || rec != nil {
+		t.Errorf("Duplicate parity produced packets: %q %q", out, rec)
+	}
+}
+
+func TestFecFlushWait(t *testing.T) {
+	enc := newFecEncoder(func() float64 { return 0 })
+	if p, wait := enc.TakeParity(); p != nil || wait != 0 {
+		t.Fatalf("Empty encoder returned %q, wait %v", p, wait)
+	}
+	enc.Wrap([]byte("tail"))
+	select {
+	case <-enc.ready:
+	default:
+		t.Fatal("Wrap did not signal the parity pump")
+	}
+	if p, wait := enc.TakeParity(); p != nil || wait <= 0 || wait > fecFlushTimeout {
+		t.Fatalf("Open group: got %q, wait %v", p, wait)
+	}
+	enc.lastAdd = time.Now().Add(-fecFlushTimeout)
+	if p, _ := enc.TakeParity(); p == nil {
+		t.Fatal("Idle group was not flushed")
+	}
+}
+
+// Подброшенный кадр четности не должен мешать восстановлению по настоящему.
+func TestFecDispatchRejectsForgedParity(t *testing.T) {
+	defer setSessionKeys(nil)
+	client, server := pairKeys(t, "", "")
+	setSessionKeys(server)
+
+	enc := newFecEncoder(func() float64 { return 0.25 }) // группа из 2 кадров
+	hb := []byte{typeHeartbeat, 1, 2, 3}
+	first := enc.Wrap(client.seal([]byte{typeHeartbeat, 9}))
+	lost := client.seal(hb)
+	enc.Wrap(lost)
+	parity, _ := enc.TakeParity()
+
+	forged := append([]byte(nil), parity...)
+	for i := 4 + 2*2; i < len(forged); i++ {
+		forged[i] ^= 0x5A
+	}
+
+	pd := NewPacketDispatcher(10)
+	pd.DispatchFrame(forged)
+	pd.DispatchFrame(parity)
+	pd.DispatchFrame(first)
+	<-pd.heartbeatCh // Пакет из кадра данных
+	select {
+	case got := <-pd.heartbeatCh:
+		if !bytes.Equal(got, hb) {
+			t.Fatalf("Recovered %x, want %x", got, hb)
+		}
+	default:
+		t.Fatal("Packet was not recovered from the genuine parity frame")
+	}
+	if n := pd.fec.Recovered(); n != 1 {
+		t.Errorf("Recovered counter %d, want 1", n)
+	}
+}
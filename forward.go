@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Статическая переадресация портов (как ssh -L).
+//
+// Правило "-forward 127.0.0.1:5432=db.internal:5432" открывает на клиенте порт 5432:
+// каждое принятое соединение сразу отправляется в туннель к db.internal:5432, без
+// рукопожатия SOCKS. Флаг можно указать несколько раз. Если адрес слушателя задан
+// только портом ("5432=db.internal:5432"), порт открывается на 127.0.0.1, чтобы
+// переадресация не стала доступна из сети случайно.
+
+// ForwardRule — одно правило переадресации: адрес слушателя и адрес назначения.
+type ForwardRule struct {
+	Listen string
+	Target string
+}
+
+func (r ForwardRule) String() string {
+	return r.Listen + "=" + r.Target
+}
+
+// parseForwardRule разбирает правило вида "[адрес:]порт=узел:порт".
+func parseForwardRule(s string) (ForwardRule, error) {
+	listen, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return ForwardRule{}, fmt.Errorf("forward rule %q: expected local=remote", s)
+	}
+	listen = strings.TrimSpace(listen)
+	target = strings.TrimSpace(target)
+	if !strings.Contains(listen, ":") {
+		listen = net.JoinHostPort("127.0.0.1", listen)
+	}
+	if _, err := splitForwardAddr(listen); err != nil {
+		return ForwardRule{}, fmt.Errorf("forward rule %q: local address: %v", s, err)
+	}
+	host, err := splitForwardAddr(target)
+	if err != nil {
+		return ForwardRule{}, fmt.Errorf("forward rule %q: remote address: %v", s, err)
+	}
+	if host == "" {
+		return ForwardRule{}, fmt.Errorf("forward rule %q: remote host is empty", s)
+	}
+	return ForwardRule{Listen: listen, Target: target}, nil
+}
+
+// splitForwardAddr проверяет адрес "узел:порт" и возвращает узел.
+func splitForwardAddr(addr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, nil
+}
+
+// forwardFlags — значение повторяемого флага -forward.
+type forwardFlags []ForwardRule
+
+func (f *forwardFlags) String() string {
+	parts := make([]string, len(*f))
+	for i, r := range *f {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *forwardFlags) Set(s string) error {
+	r, err := parseForwardRule(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// serveForward передает принятое соединение в туннель к адресу назначения правила.
+func serveForward(c net.Conn, rule ForwardRule, pd *PacketDispatcher, video *ScreenVideoConn, margin int, open remoteOpener) {
+	prio := priorityForTarget(rule.Target)
+	connID, epoch, ch, _, err := open(socks5CmdConnect, rule.Target, prio)
+	if err != nil {
+		log.Printf("Client: Forward %s from %s failed: %v", rule, c.RemoteAddr(), err)
+		return
+	}
+	defer pd.Unregister(connID, epoch)
+
+	log.Printf("Client: Forwarded tunnel established to %s (ID: %d)", rule.Target, connID)
+	runTunnelWithPrefix(c, video, margin, connID, epoch, prio, ch)
+}
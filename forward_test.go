@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	cases := []struct {
+		in   string
+		want ForwardRule
+	}{
+		{"5432=db.internal:5432", ForwardRule{"127.0.0.1:5432", "db.internal:5432"}},
+		{"0.0.0.0:3389=10.0.0.5:3389", ForwardRule{"0.0.0.0:3389", "10.0.0.5:3389"}},
+		{":8080=[::1]:80", ForwardRule{":8080", "[::1]:80"}},
+	}
+	for _, c := range cases {
+		got, err := parseForwardRule(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("%q: got %+v (err %v), want %+v", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{
+		"5432",
+		"5432=db.internal",
+		"5432=:5432",
+		"70000=db:5432",
+		"5432=db:0",
+		"abc=db:5432",
+	} {
+		if _, err := parseForwardRule(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestForwardFlagRepeatable(t *testing.T) {
+	var forwards forwardFlags
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&forwards, "forward", "")
+	if err := fs.Parse([]string{"-forward", "5432=db:5432", "-forward", "127.0.0.1:2222=host:22"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(forwards) != 2 || forwards[1].Target != "host:22" {
+		t.Fatalf("unexpected rules: %v", forwards.String())
+	}
+}
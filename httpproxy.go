@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP-прокси клиента (флаг -http). Метод CONNECT открывает поток туннеля к указанному
+// узлу, как CONNECT SOCKS5. Обычные запросы с абсолютным URI (GET http://host/...)
+// переписываются в обычную форму с "Connection: close" и отправляются в отдельный
+// поток: одно соединение клиента — один запрос, ответ сервера передается как есть.
+//
+// Если -http совпадает с -local, оба протокола работают на одном порту: SOCKS
+// узнается по первому байту (версия 4 или 5), остальное считается HTTP.
+//
+// Пользователи socks_users действуют и здесь: без них прокси открыт, с ними нужен
+// заголовок Proxy-Authorization (Basic) и проверяются те же ограничения.
+
+// bufferedConn — соединение, часть данных которого уже прочитана в буфер.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite нужен туннелю для закрытия одного направления.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// sniffSocks определяет протокол по первому байту. Возвращает соединение, из которого
+// этот байт можно прочитать снова, и признак SOCKS.
+func sniffSocks(c net.Conn) (net.Conn, bool, error) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	first, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, false, err
+	}
+	return &bufferedConn{Conn: c, r: br}, first[0] == socks4Ver || first[0] == socks5Ver, nil
+}
+
+// httpProxyTarget возвращает адрес "host:port" из запроса к прокси.
+func httpProxyTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", fmt.Errorf("CONNECT target must be host:port: %q", req.Host)
+		}
+		return req.Host, nil
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", fmt.Errorf("proxy request needs an absolute http:// URI, got %q", req.RequestURI)
+	}
+	if req.URL.Port() != "" {
+		return req.URL.Host, nil
+	}
+	return net.JoinHostPort(req.URL.Hostname(), "80"), nil
+}
+
+// httpProxyAuth проверяет Proxy-Authorization. Без пользователей доступ открыт (nil, true).
+func httpProxyAuth(req *http.Request, users []SocksUser) (*SocksUser, bool) {
+	if len(users) == 0 {
+		return nil, true
+	}
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	name, password, ok := auth.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	user := findSocksUser(users, []byte(name), []byte(password))
+	return user, user != nil
+}
+
+// originFormRequest переписывает заголовок запроса к прокси в запрос к серверу.
+// Тело не трогаем: оно идет следом из соединения клиента.
+func originFormRequest(req *http.Request) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	h := req.Header.Clone()
+	// Заголовки одного участка соединения, в том числе перечисленные в Connection
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Proxy-Authorization", "Keep-Alive", "Te", "Trailer", "Upgrade"} {
+		h.Del(name)
+	}
+	if len(req.TransferEncoding) > 0 {
+		// ReadRequest убирает Transfer-Encoding из заголовков, а тело идет в исходной кодировке
+		h.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	h.Set("Connection", "close")
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func writeHTTPError(c net.Conn, code int, msg string, extra ...string) {
+	log.Printf("HTTP: Sending %d response: %s", code, msg)
+	body := msg + "\n"
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n", code, http.StatusText(code), len(body))
+	for _, h := range extra {
+		fmt.Fprintf(c, "%s\r\n", h)
+	}
+	fmt.Fprintf(c, "\r\n%s", body)
+}
+
+// serveHTTPProxy обслуживает один запрос HTTP-прокси.
+func serveHTTPProxy(c net.Conn, pd *PacketDispatcher, video *ScreenVideoConn, margin int, open remoteOpener) {
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("HTTP: Cannot read request from %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	target, err := httpProxyTarget(req)
+	if err != nil {
+		writeHTTPError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	user, ok := httpProxyAuth(req, socksUsers())
+	if !ok {
+		writeHTTPError(c, http.StatusProxyAuthRequired, "proxy authentication required", `Proxy-Authenticate: Basic realm="video-go"`)
+		return
+	}
+	if user != nil && !user.Allows(target) {
+		writeHTTPError(c, http.StatusForbidden, fmt.Sprintf("user %q: %s: %v", user.Username, target, errSocksNotAllowed))
+		return
+	}
+	log.Printf("HTTP: %s %s from %s", req.Method, target, c.RemoteAddr())
+
+	prio := priorityForTarget(target)
+	connID, epoch, ch, _, err := open(socks5CmdConnect, target, prio)
+	if err != nil {
+		writeHTTPError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer pd.Unregister(connID, epoch)
+
+	var data net.Conn
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return
+		}
+		data = &bufferedConn{Conn: c, r: br}
+	} else {
+		data = &bufferedConn{Conn: c, r: io.MultiReader(bytes.NewReader(originFormRequest(req)), br)}
+	}
+	log.Printf("Client: HTTP tunnel established to %s (ID: %d)", target, connID)
+	runTunnelWithPrefix(data, video, margin, connID, epoch, prio, ch)
+}
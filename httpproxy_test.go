@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func readProxyRequest(t *testing.T, raw string) *http.Request {
+	t.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestHTTPProxyTarget(t *testing.T) {
+	cases := []struct {
+		raw, want string
+	}{
+		{"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443"},
+		{"GET http://example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:80"},
+		{"GET http://[::1]:8080/ HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n", "[::1]:8080"},
+	}
+	for _, c := range cases {
+		got, err := httpProxyTarget(readProxyRequest(t, c.raw))
+		if err != nil || got != c.want {
+			t.Errorf("%q: got %q (err %v), want %q", c.raw, got, err, c.want)
+		}
+	}
+	for _, raw := range []string{
+		"GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		if _, err := httpProxyTarget(readProxyRequest(t, raw)); err == nil {
+			t.Errorf("%q accepted", raw)
+		}
+	}
+}
+
+func TestOriginFormRequest(t *testing.T) {
+	req := readProxyRequest(t, "POST http://example.com/upload?x=1 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"+
+		"Connection: X-Hop\r\n"+
+		"X-Hop: 1\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"User-Agent: test\r\n\r\n")
+	got, err := http.ReadRequest(bufio.NewReader(strings.NewReader(string(originFormRequest(req)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RequestURI != "/upload?x=1" || got.Host != "example.com" {
+		t.Errorf("unexpected request line: %s %s (host %s)", got.Method, got.RequestURI, got.Host)
+	}
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "X-Hop"} {
+		if got.Header.Get(h) != "" {
+			t.Errorf("hop-by-hop header %s forwarded", h)
+		}
+	}
+	if got.Header.Get("Connection") != "close" || got.Header.Get("User-Agent") != "test" {
+		t.Errorf("unexpected headers: %v", got.Header)
+	}
+	if len(got.TransferEncoding) != 1 || got.TransferEncoding[0] != "chunked" {
+		t.Errorf("Transfer-Encoding lost: %v", got.TransferEncoding)
+	}
+}
+
+func TestHTTPProxyAuth(t *testing.T) {
+	users := []SocksUser{{Username: "alice", Password: "secret"}}
+	req := readProxyRequest(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if u, ok := httpProxyAuth(req, nil); !ok || u != nil {
+		t.Error("proxy without users must be open")
+	}
+	if _, ok := httpProxyAuth(req, users); ok {
+		t.Error("request without credentials accepted")
+	}
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wrong")))
+	if _, ok := httpProxyAuth(req, users); ok {
+		t.Error("wrong password accepted")
+	}
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	if u, ok := httpProxyAuth(req, users); !ok || u.Username != "alice" {
+		t.Error("valid credentials rejected")
+	}
+}
+
+func TestSniffSocks(t *testing.T) {
+	for _, c := range []struct {
+		first string
+		socks bool
+	}{{"\x05\x01\x00", true}, {"\x04\x01\x00\x50", true}, {"GET http://x/ HTTP/1.1\r\n", false}} {
+		server, client := net.Pipe()
+		go client.Write([]byte(c.first))
+		bc, isSocks, err := sniffSocks(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isSocks != c.socks {
+			t.Errorf("%q: isSocks = %v", c.first, isSocks)
+		}
+		got := make([]byte, len(c.first))
+		if _, err := io.ReadFull(bc, got); err != nil || string(got) != c.first {
+			t.Errorf("%q: replayed %q (err %v)", c.first, got, err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
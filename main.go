@@ -29,6 +29,29 @@ type Config struct {
 	DebugY            int    `json:"debug_y"`
 	HeartbeatInterval int    `json:"heartbeat_interval"`
 	BlockSize         int    `json:"block_size"`
+	FEC               bool   `json:"fec"`
+	Compress          bool   `json:"compress"`
+	PSK               string `json:"psk,omitempty"`        // Общий секрет для шифрования; без него ключи согласуются только по X25519
+	StreamGrace       int    `json:"stream_grace"`         // Секунды, которые поток переживает без связи
+	SessionID         int64  `json:"session_id,omitempty"` // Идентификатор сессии клиента для возобновления
+
+	// Профили калибровки по NodeID удаленной стороны
+	NodeID      int64                          `json:"node_id,omitempty"`
+	Profiles    map[string]*CalibrationProfile `json:"profiles,omitempty"`
+	Recalibrate bool                           `json:"-"`
+
+	// Порты назначения по классам приоритета: "interactive", "bulk" (остальное — normal)
+	PriorityPorts map[string][]int `json:"priority_ports,omitempty"`
+
+	// Пользователи SOCKS5-слушателя клиента; пустой список — вход без пароля
+	SocksUsers []SocksUser `json:"socks_users,omitempty"`
+
+	// Ограничения адресов назначения на сервере; без них закрыты только частные сети
+	ExitPolicy *ExitPolicy `json:"exit_policy,omitempty"`
+
+	// Адреса сервера, которые клиент может слушать для обратной переадресации; пустой
+	// список — обратная переадресация выключена
+	ReverseAllow []ExitRule `json:"reverse_allow,omitempty"`
 }
 
 func loadConfig(filename string) (*Config, error) {
@@ -45,6 +68,7 @@ func loadConfig(filename string) (*Config, error) {
 		DebugY:            200,
 		HeartbeatInterval: 30,
 		BlockSize:         6,
+		StreamGrace:       300,
 	}
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, err
@@ -70,6 +94,12 @@ func main() {
 	procSetProcessDPIAware.Call()
 	mode := flag.String("mode", "", "Mode: server or client")
 	localAddr := flag.String("local", ":1080", "Local SOCKS5 listen address (for client mode)")
+	httpAddr := flag.String("http", "", "Local HTTP proxy listen address (for client mode); same as -local to share the SOCKS5 port")
+	dnsAddr := flag.String("dns", "", "Local DNS server address resolving A/AAAA through the tunnel, UDP and TCP (for client mode)")
+	var forwards forwardFlags
+	flag.Var(&forwards, "forward", "Static port forward local_port=host:port or local_addr:port=host:port (for client mode, repeatable)")
+	var reverses forwardFlags
+	flag.Var(&reverses, "reverse", "Reverse port forward server_port=host:port or server_addr:port=host:port: the server listens, the client connects (for client mode, repeatable)")
 	captureX := flag.Int("capture-x", -1, "X coordinate for screen capture")
 	captureY := flag.Int("capture-y", -1, "Y coordinate for screen capture")
 	margin := flag.Int("margin", -1, "Margin from edges for video generation/decoding")
@@ -83,6 +113,11 @@ func main() {
 	debugX := flag.Int("debug-x", -1, "X position for debug UI window")
 	debugY := flag.Int("debug-y", -1, "Y position for debug UI window")
 	blockSizeFlag := flag.Int("block-size", -1, "Size of data blocks in pixels")
+	useFEC := flag.Bool("fec", false, "Send XOR parity frames for cross-frame error correction")
+	useCompress := flag.Bool("compress", false, "Compress stream data with DEFLATE when the peer supports it")
+	pskFlag := flag.String("psk", "", "Pre-shared key mixed into the session encryption keys; peers without encryption are refused")
+	recalibrate := flag.Bool("recalibrate", false, "Ignore cached calibration profiles and run the full 20-second sync")
+	streamGrace := flag.Int("stream-grace", -1, "Seconds a stream survives without traffic from the peer")
 
 	flag.Parse()
 
@@ -112,9 +147,13 @@ func main() {
 	finalDebugX := *debugX
 	finalDebugY := *debugY
 	finalBlockSize := *blockSizeFlag
+	finalFEC := *useFEC
+	finalCompress := *useCompress
 
 	isMJPEGSet := false
 	isNativeSet := false
+	isFECSet := false
+	isCompressSet := false
 	flag.Visit(func(f *flag.Flag) {
 		if f.Name == "vcam-mjpeg" {
 			isMJPEGSet = true
@@ -122,6 +161,12 @@ func main() {
 		if f.Name == "vcam-native" {
 			isNativeSet = true
 		}
+		if f.Name == "fec" {
+			isFECSet = true
+		}
+		if f.Name == "compress" {
+			isCompressSet = true
+		}
 	})
 
 	// Если в флагах пусто, пробуем из конфига
@@ -194,11 +239,44 @@ func main() {
 		}
 	}
 	SetBlockSize(finalBlockSize)
+	if !isFECSet && loadedCfg != nil {
+		finalFEC = loadedCfg.FEC
+	}
+	if !isCompressSet && loadedCfg != nil {
+		finalCompress = loadedCfg.Compress
+	}
+	finalPSK := *pskFlag
+	if finalPSK == "" && loadedCfg != nil {
+		finalPSK = loadedCfg.PSK
+	}
 
 	finalHB := 30
 	if loadedCfg != nil && loadedCfg.HeartbeatInterval > 0 {
 		finalHB = loadedCfg.HeartbeatInterval
 	}
+	finalStreamGrace := *streamGrace
+	if finalStreamGrace <= 0 {
+		if loadedCfg != nil && loadedCfg.StreamGrace > 0 {
+			finalStreamGrace = loadedCfg.StreamGrace
+		} else {
+			finalStreamGrace = 300
+		}
+	}
+	var sessionID, nodeID int64
+	var profiles map[string]*CalibrationProfile
+	var priorityPorts map[string][]int
+	var socksUsers []SocksUser
+	var exitPolicy *ExitPolicy
+	var reverseAllow []ExitRule
+	if loadedCfg != nil {
+		sessionID = loadedCfg.SessionID
+		nodeID = loadedCfg.NodeID
+		profiles = loadedCfg.Profiles
+		priorityPorts = loadedCfg.PriorityPorts
+		socksUsers = loadedCfg.SocksUsers
+		exitPolicy = loadedCfg.ExitPolicy
+		reverseAllow = loadedCfg.ReverseAllow
+	}
 
 	CurrentMode = *mode
 
@@ -236,6 +314,18 @@ func main() {
 		DebugY:            finalDebugY,
 		HeartbeatInterval: finalHB,
 		BlockSize:         finalBlockSize,
+		FEC:               finalFEC,
+		Compress:          finalCompress,
+		PSK:               finalPSK,
+		StreamGrace:       finalStreamGrace,
+		SessionID:         sessionID,
+		NodeID:            nodeID,
+		Profiles:          profiles,
+		Recalibrate:       *recalibrate,
+		PriorityPorts:     priorityPorts,
+		SocksUsers:        socksUsers,
+		ExitPolicy:        exitPolicy,
+		ReverseAllow:      reverseAllow,
 	}
 
 	// Сохраняем конфиг, если он изменился или не существовал
@@ -243,7 +333,8 @@ func main() {
 		loadedCfg.Margin != finalMargin || loadedCfg.UseMJPEG != finalUseMJPEG || loadedCfg.UseNative != finalUseNative ||
 		loadedCfg.VCamName != finalVCamName || loadedCfg.DebugURL != finalDebugURL ||
 		loadedCfg.VCamPort != finalVCamPort || loadedCfg.DebugX != finalDebugX || loadedCfg.DebugY != finalDebugY ||
-		loadedCfg.HeartbeatInterval != finalHB || loadedCfg.BlockSize != finalBlockSize {
+		loadedCfg.HeartbeatInterval != finalHB || loadedCfg.BlockSize != finalBlockSize || loadedCfg.FEC != finalFEC ||
+		loadedCfg.Compress != finalCompress || loadedCfg.PSK != finalPSK || loadedCfg.StreamGrace != finalStreamGrace {
 		err := saveConfig(cfgFile, currentCfg)
 		if err != nil {
 			fmt.Printf("Warning: failed to save config: %v\n", err)
@@ -398,7 +489,7 @@ func main() {
 		RunScreenSocksServer(finalX, finalY, finalMargin)
 	case "client":
 		fmt.Println("Starting Client mode (SOCKS5 via Screen/VCam)...")
-		RunScreenSocksClient(*localAddr, finalX, finalY, finalMargin)
+		RunScreenSocksClient(*localAddr, *httpAddr, *dnsAddr, forwards, reverses, finalX, finalY, finalMargin)
 	default:
 		fmt.Println("Please specify mode: -mode=server or -mode=client")
 		os.Exit(1)
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Классы приоритета потоков. Меньшее значение — выше приоритет.
+const (
+	prioInteractive = 0
+	prioNormal      = 1
+	prioBulk        = 2
+	numPriorities   = 3
+)
+
+var priorityNames = [numPriorities]string{"interactive", "normal", "bulk"}
+
+// defaultPriorityPorts используется, если в конфиге нет priority_ports.
+var defaultPriorityPorts = map[string][]int{
+	"interactive": {22, 23, 3389, 5900},
+	"bulk":        {20, 21, 873},
+}
+
+// priorityForTarget выбирает класс потока по порту назначения ("host:port").
+func priorityForTarget(target string) byte {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return prioNormal
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return prioNormal
+	}
+	rules := defaultPriorityPorts
+	if currentCfg != nil && currentCfg.PriorityPorts != nil {
+		rules = currentCfg.PriorityPorts
+	}
+	for class, name := range priorityNames {
+		for _, p := range rules[name] {
+			if p == port {
+				return byte(class)
+			}
+		}
+	}
+	return prioNormal
+}
+
+func priorityName(p byte) string {
+	if int(p) < numPriorities {
+		return priorityNames[p]
+	}
+	return "unknown"
+}
+
+// Внутренние классы планировщика кадров, в CONNECT не передаются. prioControl —
+// управляющие пакеты (CONNECT, CONNACK, DISCONNECT, NACK, heartbeat, DNS): они получают
+// слот раньше любого потока. prioIdle — кадры, нужные только при свободном канале
+// (четность FEC, очистка кадра).
+const (
+	prioControl byte = 0xF0
+	prioIdle    byte = 0xF1
+)
+
+// Очереди планировщика: управляющие пакеты, классы потоков, свободные слоты.
+const schedClasses = numPriorities + 2
+
+// schedClass возвращает очередь планировщика для класса prio.
+func schedClass(prio byte) int {
+	switch {
+	case prio == prioControl:
+		return 0
+	case prio == prioIdle:
+		return schedClasses - 1
+	case int(prio) < numPriorities:
+		return int(prio) + 1
+	}
+	return prioNormal + 1
+}
+
+// starvationLimit — сколько слотов подряд более важные классы могут забрать
+// у ожидающего потока низшего класса, прежде чем он получит слот вне очереди.
+const starvationLimit = 8
+
+// frameScheduler раздает слоты видеоканала (один кадр на интервал 1/FPS) между
+// всеми отправителями кадров: первым получает слот ожидающий отправитель высшего
+// класса, внутри класса — по очереди. Мимо планировщика идут только синхропакеты
+// калибровки, которые замеряют предельный FPS канала.
+type frameScheduler struct {
+	mu        sync.Mutex
+	waiting   [schedClasses][]chan struct{}
+	skipped   [schedClasses]int
+	wake      chan struct{}
+	startOnce sync.Once
+}
+
+var frameSched = &frameScheduler{wake: make(chan struct{}, 1)}
+
+// Acquire ждет слот для кадра класса prio (класс потока, prioControl или prioIdle).
+// Возвращает false, если stop закрылся раньше.
+func (s *frameScheduler) Acquire(prio byte, stop <-chan struct{}) bool {
+	class := schedClass(prio)
+	s.startOnce.Do(func() { go s.run() })
+	ch := make(chan struct{})
+	s.mu.Lock()
+	s.waiting[class] = append(s.waiting[class], ch)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-ch:
+		return true
+	case <-stop:
+		s.mu.Lock()
+		q := s.waiting[class]
+		for i, c := range q {
+			if c == ch {
+				s.waiting[class] = append(q[:i:i], q[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		return false
+	}
+}
+
+func (s *frameScheduler) run() {
+	var lastGrant time.Time
+	for {
+		if !s.hasWaiters() {
+			<-s.wake
+			continue
+		}
+		// Получателя выбираем после паузы: за это время мог появиться более важный поток
+		interval := time.Second / time.Duration(rateCtl.FPS())
+		if wait := interval - time.Since(lastGrant); wait > 0 {
+			time.Sleep(wait)
+		}
+		if ch := s.next(); ch != nil {
+			lastGrant = time.Now()
+			close(ch)
+		}
+	}
+}
+
+func (s *frameScheduler) hasWaiters() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := 0; p < schedClasses; p++ {
+		if len(s.waiting[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// next снимает с очереди следующего получателя слота.
+func (s *frameScheduler) next() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pick := -1
+	// Низший класс, слишком долго пропускавший слоты, идет вне очереди
+	for p := schedClasses - 1; p > 0; p-- {
+		if len(s.waiting[p]) > 0 && s.skipped[p] >= starvationLimit {
+			pick = p
+			break
+		}
+	}
+	if pick < 0 {
+		for p := 0; p < schedClasses; p++ {
+			if len(s.waiting[p]) > 0 {
+				pick = p
+				break
+			}
+		}
+	}
+	if pick < 0 {
+		return nil
+	}
+	for p := 0; p < schedClasses; p++ {
+		if p == pick {
+			s.skipped[p] = 0
+		} else if len(s.waiting[p]) > 0 {
+			s.skipped[p]++
+		}
+	}
+	ch := s.waiting[pick][0]
+	s.waiting[pick] = s.waiting[pick][1:]
+	return ch
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestPriorityForTarget(t *testing.T) {
+	tests := map[string]byte{
+		"example.com:22":   prioInteractive,
+		"10.0.0.5:3389":    prioInteractive,
+		"[::1]:873":        prioBulk,
+		"example.com:443":  prioNormal,
+		"bad-address":      prioNormal,
+		"example.com:http": prioNormal,
+	}
+	for target, want := range tests {
+		if got := priorityForTarget(target); got != want {
+			t.Errorf("%s: expected %s, got %s", target, priorityName(want), priorityName(got))
+		}
+	}
+}
+
+func TestFrameSchedulerOrder(t *testing.T) {
+	s := &frameScheduler{wake: make(chan struct{}, 1)}
+	bulk := make(chan struct{})
+	normal := make(chan struct{})
+	interactive := make(chan struct{})
+	s.waiting[schedClass(prioBulk)] = append(s.waiting[schedClass(prioBulk)], bulk)
+	s.waiting[schedClass(prioNormal)] = append(s.waiting[schedClass(prioNormal)], normal)
+	s.waiting[schedClass(prioInteractive)] = append(s.waiting[schedClass(prioInteractive)], interactive)
+
+	for i, want := range []chan struct{}{interactive, normal, bulk} {
+		if got := s.next(); got != want {
+			t.Fatalf("grant %d went to the wrong class", i)
+		}
+	}
+	if s.next() != nil {
+		t.Fatal("expected empty scheduler")
+	}
+}
+
+func TestFrameSchedulerControlFirst(t *testing.T) {
+	s := &frameScheduler{wake: make(chan struct{}, 1)}
+	idle := make(chan struct{})
+	interactive := make(chan struct{})
+	control := make(chan struct{})
+	s.waiting[schedClass(prioIdle)] = append(s.waiting[schedClass(prioIdle)], idle)
+	s.waiting[schedClass(prioInteractive)] = append(s.waiting[schedClass(prioInteractive)], interactive)
+	s.waiting[schedClass(prioControl)] = append(s.waiting[schedClass(prioControl)], control)
+
+	for i, want := range []chan struct{}{control, interactive, idle} {
+		if got := s.next(); got != want {
+			t.Fatalf("grant %d went to the wrong class", i)
+		}
+	}
+}
+
+func TestFrameSchedulerNoStarvation(t *testing.T) {
+	s := &frameScheduler{wake: make(chan struct{}, 1)}
+	bulk := make(chan struct{})
+	s.waiting[schedClass(prioBulk)] = append(s.waiting[schedClass(prioBulk)], bulk)
+
+	for i := 0; i <= starvationLimit; i++ {
+		s.waiting[schedClass(prioInteractive)] = append(s.waiting[schedClass(prioInteractive)], make(chan struct{}))
+		if got := s.next(); got == bulk {
+			if i < starvationLimit {
+				t.Fatalf("bulk granted too early (after %d interactive grants)", i)
+			}
+			return
+		}
+	}
+	t.Fatal("bulk stream starved")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fullCalibrationWindow = 10 * time.Second
+	// С кэшированным профилем достаточно короткого замера, подтверждающего, что канал не хуже
+	profileVerifyWindow = 2 * time.Second
+	profileVerifyRatio  = 0.7
+	profileRefreshEvery = time.Minute
+)
+
+// CalibrationProfile — результат калибровки канала с конкретным узлом.
+// Хранится в конфиге по NodeID удаленной стороны.
+type CalibrationProfile struct {
+	SendFPS   int    `json:"send_fps"` // Скорость отправки к узлу (по его замеру нашего потока)
+	RecvFPS   int    `json:"recv_fps"` // Наш замер потока от узла
+	BlockSize int    `json:"block_size"`
+	Margin    int    `json:"margin"`
+	Updated   string `json:"updated"`
+}
+
+var (
+	profileMu          sync.Mutex
+	lastProfileRefresh time.Time
+)
+
+// localNodeID возвращает постоянный идентификатор узла, создавая его при первом запуске.
+func localNodeID() int64 {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if currentCfg == nil {
+		return 0
+	}
+	if currentCfg.NodeID == 0 {
+		currentCfg.NodeID = rand.Int63()
+		saveConfig(cfgFile, currentCfg)
+	}
+	return currentCfg.NodeID
+}
+
+// loadProfile возвращает копию профиля узла или nil, если его нет, калибровка
+// принудительная или профиль снят с другим отступом.
+func loadProfile(peer int64, margin int) *CalibrationProfile {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if peer == 0 || currentCfg == nil || currentCfg.Recalibrate {
+		return nil
+	}
+	p, ok := currentCfg.Profiles[strconv.FormatInt(peer, 10)]
+	if !ok || p == nil || p.Margin != margin || p.RecvFPS <= 0 {
+		return nil
+	}
+	cp := *p
+	return &cp
+}
+
+// saveProfile сохраняет профиль узла. Карта заменяется целиком, потому что конфиг
+// сохраняется и из других горутин.
+func saveProfile(peer int64, p CalibrationProfile) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if peer == 0 || currentCfg == nil {
+		return
+	}
+	p.Updated = time.Now().Format(time.RFC3339)
+	profiles := make(map[string]*CalibrationProfile, len(currentCfg.Profiles)+1)
+	for k, v := range currentCfg.Profiles {
+		profiles[k] = v
+	}
+	profiles[strconv.FormatInt(peer, 10)] = &p
+	currentCfg.Profiles = profiles
+	if err := saveConfig(cfgFile, currentCfg); err != nil {
+		log.Printf("Calibration: Failed to save profile: %v", err)
+	}
+}
+
+// refreshProfile записывает в профиль скорость и размер блока, к которым сошелся
+// контроллер, не чаще раза в минуту.
+func refreshProfile(peer int64, margin int) {
+	profileMu.Lock()
+	due := time.Since(lastProfileRefresh) >= profileRefreshEvery
+	if due {
+		lastProfileRefresh = time.Now()
+	}
+	profileMu.Unlock()
+	if !due {
+		return
+	}
+	p := loadProfile(peer, margin)
+	if p == nil {
+		return
+	}
+	fps, bs := rateCtl.FPS(), GetBlockSize()
+	if p.SendFPS == fps && p.BlockSize == bs {
+		return
+	}
+	p.SendFPS, p.BlockSize = fps, bs
+	saveProfile(peer, *p)
+}
+
+// calibrator считает синхропакеты удаленной стороны. С кэшированным профилем после
+// profileVerifyWindow проверяет, что канал не хуже сохраненного, и завершает замер;
+// иначе (или если проверка не прошла) меряет полные fullCalibrationWindow.
+type calibrator struct {
+	start    time.Time
+	count    int
+	profile  *CalibrationProfile
+	verified bool
+}
+
+func newCalibrator(p *CalibrationProfile) *calibrator {
+	return &calibrator{start: time.Now(), profile: p}
+}
+
+// Add учитывает синхропакет. Возвращает итоговый FPS (0 — замер продолжается)
+// и признак того, что значение взято из подтвержденного профиля.
+func (c *calibrator) Add() (int, bool) {
+	c.count++
+	elapsed := time.Since(c.start)
+	if c.profile != nil && !c.verified && elapsed >= profileVerifyWindow {
+		c.verified = true
+		measured := float64(c.count) / elapsed.Seconds()
+		if measured >= profileVerifyRatio*float64(c.profile.RecvFPS) {
+			// Канал мог стать быстрее, чем при прошлом замере: берем большее значение
+			return min(max(c.profile.RecvFPS, int(measured)), 30), true
+		}
+		log.Printf("Calibration: Cached profile not confirmed (%.1f FPS measured, %d cached), running full calibration",
+			measured, c.profile.RecvFPS)
+	}
+	if elapsed < fullCalibrationWindow {
+		return 0, false
+	}
+	fps := int(float64(c.count) / elapsed.Seconds())
+	if fps < 1 {
+		fps = 1
+	}
+	if fps > 30 {
+		fps = 30
+	}
+	return fps, false
+}
+
+// Elapsed возвращает длительность замера.
+func (c *calibrator) Elapsed() time.Duration {
+	return time.Since(c.start)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalibratorConfirmsProfile(t *testing.T) {
+	c := newCalibrator(&CalibrationProfile{RecvFPS: 10})
+	c.start = time.Now().Add(-profileVerifyWindow - 100*time.Millisecond)
+	c.count = 20
+	fps, cached := c.Add()
+	if fps != 10 || !cached {
+		t.Fatalf("expected cached 10 FPS, got %d (cached=%v)", fps, cached)
+	}
+}
+
+func TestCalibratorPrefersFasterMeasurement(t *testing.T) {
+	c := newCalibrator(&CalibrationProfile{RecvFPS: 10})
+	c.start = time.Now().Add(-profileVerifyWindow)
+	c.count = int(20*profileVerifyWindow.Seconds()) - 1
+	fps, cached := c.Add()
+	if fps < 19 || fps > 20 || !cached {
+		t.Fatalf("expected the measured ~20 FPS, got %d (cached=%v)", fps, cached)
+	}
+}
+
+func TestCalibratorFallsBackToFull(t *testing.T) {
+	c := newCalibrator(&CalibrationProfile{RecvFPS: 20})
+	c.start = time.Now().Add(-profileVerifyWindow - 100*time.Millisecond)
+	c.count = 5
+	if fps, _ := c.Add(); fps != 0 {
+		t.Fatalf("unconfirmed profile must continue calibration, got %d FPS", fps)
+	}
+
+	// Полный замер: 55 пакетов за 10 секунд
+	c.start = time.Now().Add(-fullCalibrationWindow)
+	c.count = 54
+	fps, cached := c.Add()
+	if fps != 5 || cached {
+		t.Fatalf("expected measured 5 FPS, got %d (cached=%v)", fps, cached)
+	}
+}
+
+func TestCalibratorWithoutProfile(t *testing.T) {
+	c := newCalibrator(nil)
+	c.start = time.Now().Add(-5 * time.Second)
+	if fps, _ := c.Add(); fps != 0 {
+		t.Fatalf("calibration without profile must last %v, got %d FPS early", fullCalibrationWindow, fps)
+	}
+}
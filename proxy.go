@@ -1,16 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"image"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,42 +26,44 @@ const (
 	typeSync         = 0x05
 	typeSyncComplete = 0x06
 	typeNack         = 0x07
+	typeFecData      = 0x08
+	typeFecParity    = 0x09
+	typeSealed       = 0x0A
+	typeDatagram     = 0x0B
+	typeBindAccept   = 0x0C
+	typeDNSQuery     = 0x0D
+	typeDNSAnswer    = 0x0E
+	typeCounted      = 0x0F
 )
 
 type HeartbeatData struct {
-	FPS          float32 `json:"fps"`
-	ProcessingMS int     `json:"ms"`
-	Timestamp    int64   `json:"ts"`
-	TargetFPS    int     `json:"target_fps"`   // Скорость, с которой я отправляю
-	ReceivedFPS  int     `json:"received_fps"` // Скорость, которую я успешно принимаю от тебя
-	Ready        bool    `json:"ready"`        // Готовность к передаче данных
-	SessionID    int64   `json:"sid"`          // Идентификатор сессии
-	Seq          uint32  `json:"seq"`          // Порядковый номер
-	Phase        int     `json:"phase"`        // 0: Normal, 1: Client -> Server test, 2: Server -> Client test
+	FPS          float32
+	ProcessingMS int
+	Timestamp    int64
+	TargetFPS    int    // Скорость, с которой я отправляю
+	ReceivedFPS  int    // Скорость, которую я успешно принимаю от тебя
+	Ready        bool   // Готовность к передаче данных
+	SessionID    int64  // Идентификатор сессии
+	Seq          uint32 // Порядковый номер
+	Phase        int    // 0: Normal, 1: Client -> Server test, 2: Server -> Client test
 }
 
 type SyncData struct {
-	SessionID   int64  `json:"sid"`
-	Random      string `json:"rnd"`
-	MeasuredFPS int    `json:"fps,omitempty"`
+	SessionID   int64
+	Nonce       uint32 // Случайное значение: кадры синхронизации не должны совпадать
+	MeasuredFPS int
+	Resume      bool          // Клиент: прошу продолжить сессию; сервер: сессия продолжена
+	NodeID      int64         // Постоянный идентификатор узла для профилей калибровки
+	Caps        *Capabilities // Версия протокола и возможности узла
+	Reject      string        // Причина отказа в синхронизации
+	PubKey      []byte        // Открытый ключ X25519 для шифрования сессии
 }
 
 type SyncCompleteData struct {
-	SessionID int64 `json:"sid"`
-	FPS       int   `json:"fps"`
-}
-
-func generateRandomString(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
+	SessionID int64
+	FPS       int
 }
 
-var fpsLevels = []int{1, 5, 10, 20, 25}
-
 var (
 	perfMu         sync.Mutex
 	perfFrames     int
@@ -128,20 +132,135 @@ func getTrafficStats() (sentKBs, recvKBs float64) {
 	return lastSentKBs, lastRecvKBs
 }
 
+var (
+	fecTx       = newFecEncoder(rateCtl.LossRate)
+	fecPumpOnce sync.Once
+)
+
+// fecActive сообщает, включена ли отправка кадров четности.
+func fecActive() bool {
+	return currentCfg != nil && currentCfg.FEC && peerSupports(capFEC)
+}
+
+// frameOverhead возвращает число байт кадра, занятых обертками поверх пакета туннеля.
+func frameOverhead() int {
+	n := 0
+	if fecActive() {
+		n += fecOverhead
+	}
+	if sealingActive() {
+		n += sealOverhead
+	} else if peerSupports(capCounted) {
+		n += countedHeaderLen
+	}
+	return n
+}
+
+// frameSink, если задан, получает готовые кадры вместо видеоканала. Тесты соединяют
+// через него два диспетчера в одном процессе.
+var frameSink atomic.Pointer[func(frame []byte, margin int)]
+
 func sendEncodedPacket(payload []byte, margin int, bSize int) {
 	if bSize < 1 {
 		bSize = GetBlockSize()
 	}
+	payload = sealPacket(toWire(payload, sessionVersion()))
+	// Синхропакеты не оборачиваем: они идут потоком и служат для замера FPS
+	if fecActive() && len(payload) > 0 && payload[0] != typeSync && payload[0] != typeSyncComplete {
+		fecPumpOnce.Do(func() {
+			go fecParityPump()
+		})
+		payload = fecTx.Wrap(payload)
+	}
 	recordTrafficSent(len(payload))
+	if sink := frameSink.Load(); sink != nil {
+		(*sink)(payload, margin)
+		return
+	}
 	writeToVCam(Encode(payload, margin, bSize), margin)
 }
 
+// sendControlPacket отправляет управляющий пакет в слот класса prioControl: кадр
+// занимает место в общем расписании и не затирает кадры потоков.
+func sendControlPacket(payload []byte, margin int) {
+	frameSched.Acquire(prioControl, nil)
+	sendEncodedPacket(payload, margin, GetBlockSize())
+}
+
+// fecParityPump отправляет кадры четности в слоты класса prioIdle, то есть когда
+// видеоканал не нужен потокам и управляющим пакетам. Пока групп нет, ждет сигнала от fecTx.
+func fecParityPump() {
+	for {
+		held, wait := fecTx.TakeParity()
+		if held == nil {
+			if wait > 0 {
+				select {
+				case <-fecTx.ready:
+				case <-time.After(wait):
+				}
+			} else {
+				<-fecTx.ready
+			}
+			continue
+		}
+
+		frameSched.Acquire(prioIdle, nil)
+		vcamMu.Lock()
+		margin := vcamGlobalMargin
+		vcamMu.Unlock()
+		recordTrafficSent(len(held))
+		if sink := frameSink.Load(); sink != nil {
+			(*sink)(held, margin)
+		} else {
+			writeToVCam(Encode(held, margin, GetBlockSize()), margin)
+		}
+		recordSentPacket(typeFecParity)
+	}
+}
+
 func recordSentPacket(t byte) {
 	sentMu.Lock()
 	defer sentMu.Unlock()
 	sentStats[t]++
 }
 
+// packetTypeName возвращает короткое имя типа пакета для логов.
+func packetTypeName(t byte) string {
+	switch t {
+	case typeConnect:
+		return "CONNECT"
+	case typeConnAck:
+		return "ACK"
+	case typeData:
+		return "DATA"
+	case typeHeartbeat:
+		return "HB"
+	case typeSync:
+		return "SYNC"
+	case typeSyncComplete:
+		return "SYNC_DONE"
+	case typeDisconnect:
+		return "DISCONNECT"
+	case typeNack:
+		return "NACK"
+	case typeFecParity:
+		return "PARITY"
+	case typeDatagram:
+		return "DGRAM"
+	case typeBindAccept:
+		return "BIND_ACCEPT"
+	case typeDNSQuery:
+		return "DNS_QUERY"
+	case typeDNSAnswer:
+		return "DNS_ANSWER"
+	case typeSealed:
+		return "SEALED"
+	case typeCounted:
+		return "COUNTED"
+	}
+	return "unknown"
+}
+
 func getSentStatsAndReset() string {
 	sentMu.Lock()
 	defer sentMu.Unlock()
@@ -150,25 +269,7 @@ func getSentStatsAndReset() string {
 	}
 	res := ""
 	for t, count := range sentStats {
-		typeName := "unknown"
-		switch t {
-		case typeConnect:
-			typeName = "CONNECT"
-		case typeConnAck:
-			typeName = "ACK"
-		case typeData:
-			typeName = "DATA"
-		case typeHeartbeat:
-			typeName = "HB"
-		case typeSync:
-			typeName = "SYNC"
-		case typeSyncComplete:
-			typeName = "SYNC_DONE"
-		case typeDisconnect:
-			typeName = "DISCONNECT"
-		case typeNack:
-			typeName = "NACK"
-		}
+		typeName := packetTypeName(t)
 		res += fmt.Sprintf("%s:%d ", typeName, count)
 		sentStats[t] = 0
 	}
@@ -177,50 +278,329 @@ func getSentStatsAndReset() string {
 
 type tunnelPacket struct {
 	seq     byte
+	flags   byte
 	payload []byte
 	sent    time.Time
+	retries int
+}
+
+// connEntry — входящая очередь соединения. Канал не закрывается: при Unregister
+// закрывается done, что завершает ожидающие отправки DISCONNECT.
+type connEntry struct {
+	ch    chan []byte
+	done  chan struct{}
+	epoch byte
+}
+
+// disconnect подставляет потоку DISCONNECT, как если бы его прислала удаленная сторона.
+func (e *connEntry) disconnect(id uint16) {
+	go func() {
+		select {
+		case e.ch <- []byte{typeDisconnect, byte(id >> 8), byte(id), e.epoch}:
+		case <-e.done:
+		}
+	}()
+}
+
+// kill подставляет потоку DISCONNECT, не дожидаясь места в очереди: если она полна,
+// из нее вытесняется самый старый пакет — поток все равно закрывается.
+func (e *connEntry) kill(id uint16) {
+	msg := []byte{typeDisconnect, byte(id >> 8), byte(id), e.epoch}
+	for {
+		select {
+		case e.ch <- msg:
+			return
+		default:
+		}
+		select {
+		case <-e.ch:
+		default:
+		}
+	}
+}
+
+// Заголовок пакетов соединения (CONNECT, CONNACK, DATA, DISCONNECT, NACK):
+// [тип][connID 2][эпоха]. Эпоха меняется при каждом новом использовании connID,
+// поэтому запоздавшие пакеты прежнего соединения с тем же ID отбрасываются.
+const connHeaderLen = 4
+
+// connIDQuarantine — сколько закрытый connID не выдается повторно
+const connIDQuarantine = 2 * time.Minute
+
+// serverIDMin — первый connID, который выдает сервер. Диапазоны сторон не пересекаются,
+// поэтому соединения, открытые сервером (reverse.go), не путаются с клиентскими.
+const serverIDMin = 0x8000
+
+// connectPayload собирает CONNECT: [заголовок][команда SOCKS5][приоритет][адрес].
+func connectPayload(connID uint16, epoch, cmd, prio byte, target string) []byte {
+	payload := make([]byte, connHeaderLen+2+len(target))
+	payload[0] = typeConnect
+	payload[1] = byte(connID >> 8)
+	payload[2] = byte(connID)
+	payload[3] = epoch
+	payload[4] = cmd
+	payload[5] = prio
+	copy(payload[6:], target)
+	return payload
+}
+
+// connAckPayload собирает ответ на CONNECT (typeConnAck или typeBindAccept):
+// [заголовок][код ответа SOCKS5][ATYP][адрес][порт]. Без адреса передается 0.0.0.0:0.
+func connAckPayload(typ byte, connID uint16, epoch, status byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	atyp := byte(socks5AtypIPv4)
+	bound := []byte{0, 0, 0, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		bound = ip4
+	} else if ip != nil {
+		atyp, bound = socks5AtypIPv6, ip
+	}
+	payload := make([]byte, connHeaderLen+2, connHeaderLen+2+len(bound)+2)
+	payload[0] = typ
+	payload[1] = byte(connID >> 8)
+	payload[2] = byte(connID)
+	payload[3] = epoch
+	payload[4] = status
+	payload[5] = atyp
+	payload = append(payload, bound...)
+	return binary.BigEndian.AppendUint16(payload, uint16(port))
+}
+
+// parseConnAck возвращает код ответа и адрес из typeConnAck или typeBindAccept.
+func parseConnAck(data []byte) (byte, net.Addr) {
+	if len(data) < connHeaderLen+1 {
+		return socks5RespFailure, nil
+	}
+	status := data[4]
+	var ip net.IP
+	var port uint16
+	if len(data) >= 12 && data[5] == socks5AtypIPv4 {
+		ip = net.IP(data[6:10])
+		port = binary.BigEndian.Uint16(data[10:12])
+	} else if len(data) >= 24 && data[5] == socks5AtypIPv6 {
+		ip = net.IP(data[6:22])
+		port = binary.BigEndian.Uint16(data[22:24])
+	}
+	if ip == nil {
+		return status, nil
+	}
+	return status, &net.TCPAddr{IP: ip, Port: int(port)}
 }
 
 type PacketDispatcher struct {
 	mu           sync.RWMutex
-	connChannels map[uint16]chan []byte
-	closedIDs    map[uint16]time.Time
+	connChannels map[uint16]*connEntry
+	closedIDs    map[uint16]time.Time // Недавно закрытые ID: карантин для аллокатора
+	epochs       map[uint16]byte      // Последняя выданная эпоха для ID
 	heartbeatCh  chan []byte
 	connectCh    chan []byte
 	syncCh       chan []byte
 	syncCompCh   chan []byte
+	dnsQueryCh   chan []byte
+	dnsAnswerCh  chan []byte
+	fec          *fecDecoder
 	margin       int
+	serverIDs    bool // ID выдаются из диапазона сервера (serverIDMin и выше)
+	overflows    atomic.Int64
 }
 
 func NewPacketDispatcher(margin int) *PacketDispatcher {
 	return &PacketDispatcher{
-		connChannels: make(map[uint16]chan []byte),
+		connChannels: make(map[uint16]*connEntry),
 		closedIDs:    make(map[uint16]time.Time),
+		epochs:       make(map[uint16]byte),
 		heartbeatCh:  make(chan []byte, 256),
 		connectCh:    make(chan []byte, 256),
 		syncCh:       make(chan []byte, 256),
 		syncCompCh:   make(chan []byte, 256),
+		dnsQueryCh:   make(chan []byte, 256),
+		dnsAnswerCh:  make(chan []byte, 256),
+		fec:          newFecDecoder(),
 		margin:       margin,
 	}
 }
 
-func (pd *PacketDispatcher) Register(id uint16) chan []byte {
+// Overflows возвращает число пакетов, не поместившихся в очередь потока, с момента
+// последнего вызова. Ненулевое значение означает, что удаленная сторона нарушает окно.
+func (pd *PacketDispatcher) Overflows() int {
+	return int(pd.overflows.Swap(0))
+}
+
+// role возвращает сторону туннеля для журнала.
+func (pd *PacketDispatcher) role() string {
+	if pd.serverIDs {
+		return "Server"
+	}
+	return "Client"
+}
+
+// Register регистрирует соединение, открытое удаленной стороной, с ее эпохой.
+func (pd *PacketDispatcher) Register(id uint16, epoch byte) chan []byte {
 	pd.mu.Lock()
 	defer pd.mu.Unlock()
-	ch := make(chan []byte, 1024)
-	pd.connChannels[id] = ch
+	return pd.register(id, epoch)
+}
+
+func (pd *PacketDispatcher) register(id uint16, epoch byte) chan []byte {
+	e := &connEntry{ch: make(chan []byte, 1024), done: make(chan struct{}), epoch: epoch}
+	pd.connChannels[id] = e
+	pd.epochs[id] = epoch
 	delete(pd.closedIDs, id)
-	return ch
+	return e.ch
+}
+
+// Allocate выбирает connID, не занятый живым соединением и не закрытый за последние
+// connIDQuarantine, регистрирует его со следующей эпохой и возвращает ID, эпоху и канал.
+// Клиент выдает ID от 1 до serverIDMin-1, сервер (обратные соединения) — от serverIDMin.
+func (pd *PacketDispatcher) Allocate() (uint16, byte, chan []byte, error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	first, count := 1, serverIDMin-1
+	if pd.serverIDs {
+		first, count = serverIDMin, 65536-serverIDMin
+	}
+	start := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		id := uint16(first + (start+i)%count)
+		if _, live := pd.connChannels[id]; live {
+			continue
+		}
+		if _, quarantined := pd.closedIDs[id]; quarantined {
+			continue
+		}
+		epoch, used := pd.epochs[id]
+		if used {
+			epoch++
+		} else {
+			// Случайная начальная эпоха: после перезапуска процесса ID не совпадет
+			// с осиротевшим соединением на другой стороне
+			epoch = byte(rand.Intn(256))
+		}
+		return id, epoch, pd.register(id, epoch), nil
+	}
+	return 0, 0, nil, fmt.Errorf("no free connection IDs")
+}
+
+// Unregister снимает регистрацию, если ID все еще принадлежит соединению этой эпохи.
+func (pd *PacketDispatcher) Unregister(id uint16, epoch byte) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if e, ok := pd.connChannels[id]; ok && e.epoch == epoch {
+		close(e.done)
+		delete(pd.connChannels, id)
+		pd.closedIDs[id] = time.Now()
+	}
 }
 
-func (pd *PacketDispatcher) Unregister(id uint16) {
+// expireClosedIDs снимает карантин с ID, закрытых дольше connIDQuarantine. Их эпохи
+// тоже забываются: пакеты прежних соединений к этому времени уже не придут, а карта
+// эпох не растет со всеми когда-либо выданными ID.
+func (pd *PacketDispatcher) expireClosedIDs(now time.Time) {
 	pd.mu.Lock()
 	defer pd.mu.Unlock()
-	if ch, ok := pd.connChannels[id]; ok {
-		close(ch)
+	for id, t := range pd.closedIDs {
+		if now.Sub(t) > connIDQuarantine {
+			delete(pd.closedIDs, id)
+			if _, live := pd.connChannels[id]; !live {
+				delete(pd.epochs, id)
+			}
+		}
+	}
+}
+
+// Lookup возвращает эпоху живого соединения с данным ID.
+func (pd *PacketDispatcher) Lookup(id uint16) (byte, bool) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	e, ok := pd.connChannels[id]
+	if !ok {
+		return 0, false
+	}
+	return e.epoch, true
+}
+
+// epochOf возвращает эпоху живого соединения с данным ID или 0. По ней fromWire
+// относит пакеты узлов без эпох к текущему соединению.
+func (pd *PacketDispatcher) epochOf(id uint16) byte {
+	epoch, _ := pd.Lookup(id)
+	return epoch
+}
+
+// Evict завершает соединение с данным ID и сразу освобождает ID для новой эпохи.
+func (pd *PacketDispatcher) Evict(id uint16) {
+	pd.mu.Lock()
+	e, ok := pd.connChannels[id]
+	pd.mu.Unlock()
+	if ok {
+		pd.evict(id, e)
+	}
+}
+
+// evict снимает регистрацию e, если ID все еще принадлежит ей, и закрывает поток.
+func (pd *PacketDispatcher) evict(id uint16, e *connEntry) {
+	pd.mu.Lock()
+	ok := pd.connChannels[id] == e
+	if ok {
+		close(e.done)
 		delete(pd.connChannels, id)
 		pd.closedIDs[id] = time.Now()
 	}
+	pd.mu.Unlock()
+	if ok {
+		e.kill(id)
+	}
+}
+
+// CloseAll завершает все зарегистрированные потоки, подставляя им DISCONNECT
+// (удаленная сторона потеряла их состояние). Возвращает число потоков.
+func (pd *PacketDispatcher) CloseAll() int {
+	pd.mu.RLock()
+	entries := make(map[uint16]*connEntry, len(pd.connChannels))
+	for id, e := range pd.connChannels {
+		entries[id] = e
+	}
+	pd.mu.RUnlock()
+	for id, e := range entries {
+		e.disconnect(id)
+	}
+	return len(entries)
+}
+
+// DispatchFrame снимает обертки FEC и шифрования (если они есть) и передает пакеты в Dispatch.
+func (pd *PacketDispatcher) DispatchFrame(frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+	packets := [][]byte{frame}
+	var rec []byte
+	if frame[0] == typeFecData || frame[0] == typeFecParity {
+		packets, rec = pd.fec.Unwrap(frame)
+	}
+	ver := sessionVersion()
+	for _, p := range packets {
+		if len(p) == 0 {
+			continue
+		}
+		if p, ok := openPacket(p); ok {
+			pd.Dispatch(fromWire(p, ver, pd.epochOf))
+		}
+	}
+	// Заголовки FEC не защищены: восстановленный пакет принимается, только если
+	// проходит ту же проверку, иначе пробуем другой кадр четности группы
+	for len(rec) > 0 {
+		if p, ok := openPacket(rec); ok {
+			pd.Dispatch(fromWire(p, ver, pd.epochOf))
+			return
+		}
+		rec = pd.fec.Reject(binary.BigEndian.Uint16(frame[1:3]))
+	}
 }
 
 func (pd *PacketDispatcher) Dispatch(data []byte) {
@@ -248,25 +628,43 @@ func (pd *PacketDispatcher) Dispatch(data []byte) {
 		case pd.syncCompCh <- data:
 		default:
 		}
-	case typeData, typeConnAck, typeDisconnect, typeNack:
-		if len(data) >= 3 {
+	case typeDNSQuery:
+		select {
+		case pd.dnsQueryCh <- data:
+		default:
+		}
+	case typeDNSAnswer:
+		select {
+		case pd.dnsAnswerCh <- data:
+		default:
+		}
+	case typeData, typeConnAck, typeDisconnect, typeNack, typeDatagram, typeBindAccept:
+		if len(data) >= connHeaderLen {
 			id := uint16(data[1])<<8 | uint16(data[2])
 			pd.mu.RLock()
-			ch, ok := pd.connChannels[id]
+			e, ok := pd.connChannels[id]
 			_, closed := pd.closedIDs[id]
 			pd.mu.RUnlock()
-			if ok {
+			if ok && e.epoch != data[3] {
+				// Запоздавший пакет прежнего соединения с тем же ID
+				return
+			}
+			if ok && data[0] == typeDatagram {
+				// Датаграммы не подтверждаются: при переполненной очереди их можно потерять
 				select {
-				case ch <- data:
+				case e.ch <- data:
 				default:
-					if data[0] == typeData || data[0] == typeNack {
-						log.Printf("Dispatcher: DROPPING %s packet for connID %d (buffer full)", func() string {
-							if data[0] == typeData {
-								return "DATA"
-							}
-							return "NACK"
-						}(), id)
-					}
+				}
+			} else if ok {
+				// Объем данных в полете ограничен окном получателя, и очередь вмещает больше
+				// окна, поэтому переполнить ее может только удаленная сторона, нарушившая
+				// окно. Ждать нельзя: диспетчер общий для всех потоков и управляющих пакетов.
+				// Лишний пакет отбрасывается, сам поток не трогаем
+				select {
+				case e.ch <- data:
+				default:
+					pd.overflows.Add(1)
+					log.Printf("Dispatcher: queue of connID %d is full, peer exceeded the receive window, dropping %s", id, packetTypeName(data[0]))
 				}
 			} else {
 				if closed {
@@ -295,14 +693,7 @@ func (pd *PacketDispatcher) Run(video *ScreenVideoConn, margin int) {
 	go func() {
 		for {
 			time.Sleep(10 * time.Second)
-			pd.mu.Lock()
-			now := time.Now()
-			for id, t := range pd.closedIDs {
-				if now.Sub(t) > 30*time.Second {
-					delete(pd.closedIDs, id)
-				}
-			}
-			pd.mu.Unlock()
+			pd.expireClosedIDs(time.Now())
 		}
 	}()
 	frameSize := captureWidth * captureHeight * 4
@@ -328,7 +719,7 @@ func (pd *PacketDispatcher) Run(video *ScreenVideoConn, margin int) {
 				recordTrafficRecv(len(data))
 				recordRecvFrame()
 				UpdateCaptureStatus(true)
-				pd.Dispatch(data)
+				pd.DispatchFrame(data)
 			} else {
 				UpdateCaptureStatus(false)
 			}
@@ -465,6 +856,22 @@ func (s *ScreenVideoConn) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// AdaptToRemoteFPS подстраивает частоту захвата под скорость отправки удаленной стороны.
+func (s *ScreenVideoConn) AdaptToRemoteFPS(fps int) (time.Duration, bool) {
+	if fps <= 0 {
+		return s.ReadDelay, false
+	}
+	newDelay := time.Second / time.Duration(fps)
+	if newDelay < 10*time.Millisecond {
+		newDelay = 10 * time.Millisecond
+	}
+	if s.ReadDelay == newDelay {
+		return newDelay, false
+	}
+	s.ReadDelay = newDelay
+	return newDelay, true
+}
+
 func (s *ScreenVideoConn) Close() error {
 	return nil
 }
@@ -507,20 +914,65 @@ func vcamIdleHandler() {
 	}
 }
 
+// Заголовок пакета DATA: [typeData][connID 2][эпоха][seq][ack][wnd][flags], далее полезная нагрузка.
+// seq == 0 означает пакет только с подтверждением. wnd — сколько пакетов сверх ack
+// получатель готов принять (credit-based flow control).
+const (
+	dataHeaderLen = 8
+
+	// flagFin — отправитель закрыл свое направление (half-close). FIN занимает номер
+	// последовательности и доставляется по порядку после всех данных.
+	flagFin = 0x01
+	// flagWndProbe — запрос актуального окна, когда удаленная сторона объявила нулевое окно.
+	flagWndProbe = 0x02
+	// flagDeflate — полезная нагрузка является частью сжатого потока (compress.go).
+	flagDeflate = 0x04
+
+	// maxInFlight — предел неподтвержденных пакетов независимо от окна получателя
+	maxInFlight = 20
+	// finMaxRetries — сколько раз повторяем FIN, когда оба направления уже закрыты
+	finMaxRetries = 5
+	// recvWindow — емкость буфера получателя в пакетах (вне порядка + ожидающие записи в сокет).
+	// Должна быть меньше половины пространства номеров (128).
+	recvWindow = 64
+)
+
+// streamGrace — сколько поток переживает без единого пакета от удаленной стороны
+// (зависание звонка, потеря окна захвата) прежде чем будет закрыт.
+func streamGrace() time.Duration {
+	if currentCfg != nil && currentCfg.StreamGrace > 0 {
+		return time.Duration(currentCfg.StreamGrace) * time.Second
+	}
+	return 300 * time.Second
+}
+
 // runTunnelWithPrefix читает данные из dataConn, упаковывает их в видеокадры с префиксом типа и пишет в VCam.
-// Также получает пакеты из incoming канала и пишет в dataConn.
-func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, margin int, connID uint16, initialFPS int, incoming chan []byte) {
+// Также получает пакеты из incoming канала и пишет в dataConn (отдельной горутиной,
+// чтобы медленный потребитель не блокировал прием и только закрывал окно).
+// Скорость отправки и размер блока задает общий rateCtl.
+//
+// Направления закрываются независимо: EOF от dataConn превращается в FIN, а FIN удаленной
+// стороны — в CloseWrite. Туннель полностью закрывается, когда оба направления завершены
+// и все наши пакеты подтверждены. DISCONNECT остается аварийным закрытием обоих направлений.
+func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, margin int, connID uint16, epoch byte, prio byte, incoming chan []byte) {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(3)
 	var closeOnce sync.Once
 	sendDisconnect := func() {
 		closeOnce.Do(func() {
-			payload := []byte{typeDisconnect, byte(connID >> 8), byte(connID)}
-			sendEncodedPacket(payload, margin, GetBlockSize())
+			payload := []byte{typeDisconnect, byte(connID >> 8), byte(connID), epoch}
+			sendControlPacket(payload, margin)
 			recordSentPacket(typeDisconnect)
 		})
 	}
 
+	// stop закрывается первой завершившейся горутиной, чтобы вторая не зависла
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopTunnel := func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+
 	var bytesSent, bytesReceived int64
 
 	type reliableState struct {
@@ -529,15 +981,32 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 		lastAckSent     byte
 		unacked         []*tunnelPacket
 		nextExpectedSeq byte
-		recvBuf         map[byte][]byte
+		recvBuf         map[byte][]byte    // [flags][payload] пакетов, пришедших не по порядку
+		deliverQ        [][]byte           // [flags][payload] пакетов, ожидающих записи в dataConn
 		nackQueue       []byte             // Sequences requested by remote
 		lastNackTime    map[byte]time.Time // When we last sent NACK for a seq
+		remoteFin       bool               // Удаленная сторона закрыла свое направление
+		ackPending      bool               // Пришел повтор: наш ACK мог потеряться, шлем его снова
+		peerWnd         int                // Окно, объявленное удаленной стороной
+		lastWndSent     int
+		lastWndSentAt   time.Time
 	}
 	rs := &reliableState{
 		nextExpectedSeq: 1,
 		recvBuf:         make(map[byte][]byte),
 		lastNackTime:    make(map[byte]time.Time),
+		peerWnd:         maxInFlight,
+		lastWndSent:     recvWindow,
+	}
+	// window возвращает свободное место в буфере получателя. Вызывается под rs.mu.
+	window := func() int {
+		w := recvWindow - len(rs.recvBuf) - len(rs.deliverQ)
+		if w < 0 {
+			w = 0
+		}
+		return w
 	}
+	deliverSignal := make(chan struct{}, 1)
 
 	var lastSentSeq byte = 0
 	var lastRetransmit time.Time
@@ -548,35 +1017,11 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 		mySID = video.SessionID
 	}
 
-	// Настройка скорости
-	fpsIdx := 0
-	if initialFPS > 0 {
-		for i, f := range fpsLevels {
-			if f <= initialFPS {
-				fpsIdx = i
-			} else {
-				break
-			}
-		}
-	} else {
-		fpsIdx = 1
-	}
-
-	lastFPSIncrease := time.Now()
 	lastHeartbeat := time.Now()
-	lastBlockSizeChange := time.Now()
-	retransmitCount := 0
 
 	var activityMu sync.Mutex
 	lastActivity := time.Now()
 
-	type speedState struct {
-		mu                sync.Mutex
-		lastRemoteFPS     int
-		remoteReceivedFPS int
-	}
-	ss := &speedState{}
-
 	// Data -> Video (Sender)
 	go func() {
 		defer func() {
@@ -586,24 +1031,40 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 			log.Printf("Tunnel: Exit Data->Video goroutine (ID: %d)", connID)
 			sendDisconnect()
 			dataConn.Close()
+			stopTunnel()
 			wg.Done()
 		}()
+		localEOF := false
+		finPending := false
+		var comp *streamCompressor
+		if compressActive() {
+			comp = newStreamCompressor()
+		}
+		var bigBuf []byte
 		for {
-			fps := fpsLevels[fpsIdx]
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			fps := rateCtl.FPS()
 			bSize := GetBlockSize()
 			sendInterval := time.Second / time.Duration(fps)
 			loopStart := time.Now()
 
-			ss.mu.Lock()
-			remRecv := ss.remoteReceivedFPS
-			ss.mu.Unlock()
+			remRecv := rateCtl.RemoteFPS()
 
 			hbInterval := 30 * time.Second
 			if currentCfg != nil && currentCfg.HeartbeatInterval > 0 {
 				hbInterval = time.Duration(currentCfg.HeartbeatInterval) * time.Second
 			}
 
+			// Контроллеру скорости нужна частая обратная связь при разгоне и при расхождении FPS
 			needHB := time.Since(lastHeartbeat) > hbInterval
+			if !needHB && time.Since(lastHeartbeat) > rcUpdateInterval && rateCtl.Probing() {
+				needHB = true
+			}
 			if !needHB && (remRecv < fps && remRecv > 0) && time.Since(lastHeartbeat) > 5*time.Second {
 				needHB = true
 			}
@@ -621,36 +1082,19 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 					SessionID:    mySID,
 					Seq:          myHBSeq,
 				}
-				hbBytes, _ := json.Marshal(hb)
-				payload := append([]byte{typeHeartbeat}, hbBytes...)
-				sendEncodedPacket(payload, margin, bSize)
+				sendControlPacket(encodeControl(typeHeartbeat, &hb, sessionVersion()), margin)
 				recordSentPacket(typeHeartbeat)
 				lastHeartbeat = time.Now()
-
-				if remRecv >= fps && fpsIdx < len(fpsLevels)-1 && time.Since(lastFPSIncrease) > 5*time.Second {
-					fpsIdx++
-					lastFPSIncrease = time.Now()
-					log.Printf("Tunnel: Ramping up to %d FPS (remote confirmed %d FPS)", fpsLevels[fpsIdx], remRecv)
-				} else if remRecv < fps-2 && remRecv > 0 && fpsIdx > 0 && time.Since(lastFPSIncrease) > 5*time.Second {
-					fpsIdx--
-					lastFPSIncrease = time.Now()
-					log.Printf("Tunnel: Ramping down to %d FPS (remote confirmed only %d FPS)", fpsLevels[fpsIdx], remRecv)
-				}
-
-				// Адаптивный размер блока
-				if time.Since(lastBlockSizeChange) > 10*time.Second {
-					if retransmitCount > 10 {
-						TryIncreaseBlockSize()
-					} else if retransmitCount == 0 && remRecv >= fps {
-						TryDecreaseBlockSize()
-					}
-					retransmitCount = 0
-					lastBlockSizeChange = time.Now()
-				}
 			}
 
 			rs.mu.Lock()
 			myAck := rs.lastRevSeq
+			myWnd := window()
+			needAck := myAck != rs.lastAckSent || rs.ackPending
+			// Окно открылось, пока отправитель был ограничен им, — сообщаем сразу
+			if rs.lastWndSent < maxInFlight && myWnd > rs.lastWndSent {
+				needAck = true
+			}
 			var packetToResend *tunnelPacket
 
 			// Приоритет NACK
@@ -670,12 +1114,21 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 			if packetToResend == nil && len(rs.unacked) > 0 && time.Since(lastRetransmit) > 1*time.Second {
 				packetToResend = rs.unacked[0]
 				lastRetransmit = time.Now()
-				retransmitCount++
 			}
-			windowFull := len(rs.unacked) >= 20
+			if packetToResend != nil {
+				packetToResend.retries++
+				rateCtl.OnRetransmit()
+			}
+			inFlightLimit := maxInFlight
+			if rs.peerWnd < inFlightLimit {
+				inFlightLimit = rs.peerWnd
+			}
+			windowFull := len(rs.unacked) >= inFlightLimit
+			// Нулевое окно и нечего ретранслировать: раз в секунду запрашиваем актуальное окно
+			probeWnd := rs.peerWnd == 0 && len(rs.unacked) == 0 && time.Since(rs.lastWndSentAt) > time.Second
 			rs.mu.Unlock()
 
-			maxData := GetMaxPayloadSize(margin, bSize) - 5
+			maxData := GetMaxPayloadSize(margin, bSize) - dataHeaderLen - frameOverhead()
 			if maxData < 10 {
 				maxData = 10
 			}
@@ -684,48 +1137,108 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 			if maxData > len(buf) {
 				maxData = len(buf)
 			}
-			n := 0
+			var chunk []byte
+			var chunkFlags byte
 			var err error
 
-			if !windowFull {
-				if tc, ok := dataConn.(interface{ SetReadDeadline(time.Time) error }); ok {
-					tc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			// В кадре помещается один пакет, поэтому при ретрансляции новые данные не читаем
+			if !windowFull && packetToResend == nil {
+				readLimit := maxData
+				if comp != nil {
+					readLimit = comp.ReadLimit(maxData)
+				}
+				rbuf := buf
+				if readLimit > len(rbuf) {
+					if len(bigBuf) < readLimit {
+						bigBuf = make([]byte, readLimit)
+					}
+					rbuf = bigBuf
 				}
-				n, err = dataConn.Read(buf[:maxData])
+				if !localEOF && readLimit > 0 {
+					if tc, ok := dataConn.(interface{ SetReadDeadline(time.Time) error }); ok {
+						tc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+					}
+					var n int
+					n, err = dataConn.Read(rbuf[:readLimit])
+					if err == io.EOF {
+						log.Printf("Tunnel: Local side finished sending, sending FIN (ID: %d)", connID)
+						localEOF = true
+						finPending = true
+						err = nil
+					}
+					if n > 0 {
+						bytesSent += int64(n)
+						chunk = rbuf[:n]
+						if comp != nil {
+							chunk = comp.Add(chunk)
+						}
+					}
+					if localEOF && comp != nil {
+						comp.Finish()
+					}
+				}
+				// Сжатые данные отправляются раньше FIN и раньше несжатых
+				if chunk == nil && comp != nil && comp.Pending() > 0 {
+					chunk, chunkFlags = comp.Take(maxData), flagDeflate
+				}
+			}
+
+			var newPacket *tunnelPacket
+			if packetToResend == nil && !windowFull && (len(chunk) > 0 || finPending) {
+				lastSentSeq++
+				if lastSentSeq == 0 {
+					lastSentSeq = 1
+				}
+				newPacket = &tunnelPacket{seq: lastSentSeq}
+				if len(chunk) > 0 {
+					newPacket.payload = append([]byte(nil), chunk...)
+					newPacket.flags = chunkFlags
+				} else {
+					newPacket.flags = flagFin
+					finPending = false
+				}
+				rs.mu.Lock()
+				rs.unacked = append(rs.unacked, newPacket)
+				rs.mu.Unlock()
+				rateCtl.OnSent()
 			}
+			putBuffer(buf)
 
-			if (err == nil && n > 0) || packetToResend != nil || myAck != rs.lastAckSent {
-				payload := make([]byte, 5)
+			if newPacket != nil || packetToResend != nil || needAck || probeWnd {
+				// Слот видеоканала выдается по классу приоритета потока
+				if !frameSched.Acquire(prio, stop) {
+					return
+				}
+				// Пока ждали слот, могли прийти новые данные: подтверждаем актуальное состояние.
+				// Время отправки отсчитываем от выдачи слота, чтобы ожидание в очереди
+				// приоритетов не попадало в замеры RTT
+				rs.mu.Lock()
+				myAck = rs.lastRevSeq
+				myWnd = window()
+				if newPacket != nil {
+					newPacket.sent = time.Now()
+				}
+				rs.mu.Unlock()
+
+				payload := make([]byte, dataHeaderLen)
 				payload[0] = typeData
 				payload[1] = byte(connID >> 8)
 				payload[2] = byte(connID)
+				payload[3] = epoch
+				payload[5] = myAck
+				payload[6] = byte(myWnd)
 
-				if packetToResend != nil {
-					payload[3] = packetToResend.seq
-					payload[4] = myAck
-					payload = append(payload, packetToResend.payload...)
-				} else if n > 0 {
-					lastSentSeq++
-					if lastSentSeq == 0 {
-						lastSentSeq = 1
-					}
-					payload[3] = lastSentSeq
-					payload[4] = myAck
-					payload = append(payload, buf[:n]...)
-
-					p := &tunnelPacket{
-						seq:     lastSentSeq,
-						payload: append([]byte(nil), buf[:n]...),
-						sent:    time.Now(),
-					}
-					rs.mu.Lock()
-					rs.unacked = append(rs.unacked, p)
-					rs.mu.Unlock()
-					bytesSent += int64(n)
-				} else {
-					// ACK only
-					payload[3] = 0
-					payload[4] = myAck
+				p := packetToResend
+				if p == nil {
+					p = newPacket
+				}
+				if p != nil {
+					payload[4] = p.seq
+					payload[7] = p.flags
+					payload = append(payload, p.payload...)
+				} else if probeWnd {
+					// ACK only (seq = 0) с запросом окна
+					payload[7] = flagWndProbe
 				}
 
 				sendEncodedPacket(payload, margin, bSize)
@@ -733,30 +1246,46 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 
 				rs.mu.Lock()
 				rs.lastAckSent = myAck
+				rs.ackPending = false
+				rs.lastWndSent = myWnd
+				rs.lastWndSentAt = time.Now()
 				rs.mu.Unlock()
 			}
-			putBuffer(buf)
 
 			if err != nil {
 				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
-					if err != io.EOF {
-						log.Printf("Tunnel: dataConn read error (ID: %d): %v", connID, err)
-					}
+					log.Printf("Tunnel: dataConn read error (ID: %d): %v", connID, err)
 					return
 				}
 			}
 
+			rs.mu.Lock()
+			finished := localEOF && !finPending && len(rs.unacked) == 0 && rs.remoteFin
+			// Не подтвержден только наш FIN: удаленная сторона могла уже выйти, а ее ACK
+			// и DISCONNECT потеряться. Не ждем, пока поток закроется по тайм-ауту
+			finLost := localEOF && !finPending && rs.remoteFin && len(rs.unacked) == 1 &&
+				rs.unacked[0].flags&flagFin != 0 && rs.unacked[0].retries >= finMaxRetries
+			rs.mu.Unlock()
+			if finished {
+				log.Printf("Tunnel: Both directions finished (ID: %d)", connID)
+				return
+			}
+			if finLost {
+				log.Printf("Tunnel: FIN not acknowledged after %d retries, closing (ID: %d)", finMaxRetries, connID)
+				return
+			}
+
 			elapsed := time.Since(loopStart)
 			if elapsed < sendInterval {
 				time.Sleep(sendInterval - elapsed)
 			}
 
 			activityMu.Lock()
-			inactive := time.Since(lastActivity) > 60*time.Second
+			inactive := time.Since(lastActivity) > streamGrace()
 			activityMu.Unlock()
 
 			if inactive {
-				log.Printf("Tunnel: Inactive for 60s, closing (ID: %d)", connID)
+				log.Printf("Tunnel: Inactive for %v, closing (ID: %d)", streamGrace(), connID)
 				return
 			}
 		}
@@ -771,11 +1300,30 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 			log.Printf("Tunnel: Exit Video->Data goroutine (ID: %d)", connID)
 			sendDisconnect()
 			dataConn.Close()
+			stopTunnel()
 			wg.Done()
 		}()
-		var remoteSID int64
-		var lastRemoteHBSeq uint32
-		for data := range incoming {
+
+		// deliver ставит пакет, пришедший по порядку, в очередь записи. Вызывается под rs.mu.
+		deliver := func(seg []byte) {
+			rs.deliverQ = append(rs.deliverQ, seg)
+			select {
+			case deliverSignal <- struct{}{}:
+			default:
+			}
+		}
+
+		for {
+			var data []byte
+			select {
+			case <-stop:
+				return
+			case d, ok := <-incoming:
+				if !ok {
+					return
+				}
+				data = d
+			}
 			if len(data) < 1 {
 				continue
 			}
@@ -783,18 +1331,34 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 			case typeDisconnect:
 				log.Printf("Tunnel: Received DISCONNECT (ID: %d)", connID)
 				closeOnce.Do(func() {})
-				dataConn.Close()
+				// Дописываем в сокет уже принятые данные, прежде чем закрыть его
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					rs.mu.Lock()
+					queued := len(rs.deliverQ)
+					rs.mu.Unlock()
+					if queued == 0 || time.Now().After(deadline) {
+						break
+					}
+					select {
+					case <-stop:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
 				return
 			case typeData:
-				if len(data) < 5 {
+				if len(data) < dataHeaderLen {
 					continue
 				}
 				id := uint16(data[1])<<8 | uint16(data[2])
 				if id != connID {
 					continue
 				}
-				seq := data[3]
-				ack := data[4]
+				seq := data[4]
+				ack := data[5]
+				wnd := int(data[6])
+				flags := data[7]
 
 				// Любой пакет (Data, Ack) обновляет активность
 				activityMu.Lock()
@@ -806,42 +1370,41 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 				newUnacked := rs.unacked[:0]
 				for _, p := range rs.unacked {
 					if (ack - p.seq) < 128 {
-						// Acknowledged
+						// Acknowledged. RTT измеряем только по пакетам без повторов (алгоритм Карна)
+						if p.retries == 0 && !p.sent.IsZero() {
+							rateCtl.OnRTT(time.Since(p.sent))
+						}
 					} else {
 						newUnacked = append(newUnacked, p)
 					}
 				}
 				rs.unacked = newUnacked
+				rs.peerWnd = wnd
+				if flags&flagWndProbe != 0 {
+					rs.ackPending = true
+				}
 				rs.mu.Unlock()
 
 				// Handle Data
 				if seq != 0 {
+					var nack []byte
 					rs.mu.Lock()
 					expected := rs.nextExpectedSeq
-					if (seq - expected) < 128 {
+					if (seq-expected) >= recvWindow && (seq-expected) < 128 {
+						// За пределами окна: отправитель не должен был это слать, сообщаем окно заново
+						rs.ackPending = true
+					} else if (seq - expected) < 128 {
 						if seq == expected {
 							// In order
-							n, err := dataConn.Write(data[5:])
-							if err != nil {
-								log.Printf("Tunnel: dataConn write error (ID: %d): %v", connID, err)
-								rs.mu.Unlock()
-								return
-							}
-							bytesReceived += int64(n)
+							deliver(append([]byte(nil), data[dataHeaderLen-1:]...))
 							expected++
 							if expected == 0 {
 								expected = 1
 							}
 
 							for {
-								if nextData, ok := rs.recvBuf[expected]; ok {
-									n, err := dataConn.Write(nextData)
-									if err != nil {
-										log.Printf("Tunnel: dataConn write error (ID: %d): %v", connID, err)
-										rs.mu.Unlock()
-										return
-									}
-									bytesReceived += int64(n)
+								if nextSeg, ok := rs.recvBuf[expected]; ok {
+									deliver(nextSeg)
 									delete(rs.recvBuf, expected)
 									expected++
 									if expected == 0 {
@@ -856,23 +1419,28 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 						} else {
 							// Out of order
 							if _, ok := rs.recvBuf[seq]; !ok {
-								rs.recvBuf[seq] = append([]byte(nil), data[5:]...)
+								rs.recvBuf[seq] = append([]byte(nil), data[dataHeaderLen-1:]...)
 								log.Printf("Tunnel: Out of order (ID: %d): got %d, expected %d. Buffered.", connID, seq, expected)
 
-								// Send NACK for the expected packet
+								// Send NACK for the expected packet (после снятия блокировки: слот может не быть свободен)
 								if time.Since(rs.lastNackTime[expected]) > 500*time.Millisecond {
-									nackPayload := []byte{typeNack, byte(connID >> 8), byte(connID), expected}
-									sendEncodedPacket(nackPayload, margin, GetBlockSize())
-									recordSentPacket(typeNack)
+									nack = []byte{typeNack, byte(connID >> 8), byte(connID), epoch, expected}
 									rs.lastNackTime[expected] = time.Now()
 								}
 							}
 						}
+					} else {
+						// Уже доставленный пакет: отправитель не получил наш ACK
+						rs.ackPending = true
 					}
 					rs.mu.Unlock()
+					if nack != nil {
+						sendControlPacket(nack, margin)
+						recordSentPacket(typeNack)
+					}
 				}
 			case typeNack:
-				if len(data) < 4 {
+				if len(data) < connHeaderLen+1 {
 					continue
 				}
 				id := uint16(data[1])<<8 | uint16(data[2])
@@ -884,7 +1452,7 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 				lastActivity = time.Now()
 				activityMu.Unlock()
 
-				missingSeq := data[3]
+				missingSeq := data[4]
 				rs.mu.Lock()
 				// Проверяем, нет ли уже такого seq в очереди NACK
 				alreadyInQueue := false
@@ -898,38 +1466,103 @@ func runTunnelWithPrefix(dataConn io.ReadWriteCloser, video *ScreenVideoConn, ma
 					rs.nackQueue = append(rs.nackQueue, missingSeq)
 				}
 				rs.mu.Unlock()
-			case typeHeartbeat:
-				var hb HeartbeatData
-				if err := json.Unmarshal(data[1:], &hb); err == nil {
-					if remoteSID != 0 && hb.SessionID != remoteSID {
-						log.Printf("Tunnel: Remote session ID changed (%d -> %d), closing tunnel", remoteSID, hb.SessionID)
-						return
-					}
+			}
+		}
+	}()
+
+	// Queue -> Data (Writer): запись в сокет вне rs.mu, окно открывается по мере записи
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("PANIC in Queue->Data (ID: %d): %v", connID, r)
+			}
+			log.Printf("Tunnel: Exit Queue->Data goroutine (ID: %d)", connID)
+			wg.Done()
+		}()
+		var inflater *streamInflater
+		defer func() {
+			if inflater != nil {
+				dataConn.Close()
+				n, _ := inflater.Finish()
+				bytesReceived += n
+			}
+		}()
+		failWrite := func() {
+			sendDisconnect()
+			dataConn.Close()
+			stopTunnel()
+		}
+		for {
+			rs.mu.Lock()
+			var seg []byte
+			if len(rs.deliverQ) > 0 {
+				seg = rs.deliverQ[0]
+			}
+			rs.mu.Unlock()
 
-					activityMu.Lock()
-					lastActivity = time.Now()
-					activityMu.Unlock()
+			if seg == nil {
+				select {
+				case <-stop:
+					return
+				case <-deliverSignal:
+				}
+				continue
+			}
 
-					if hb.Seq != 0 && hb.Seq <= lastRemoteHBSeq && hb.SessionID == remoteSID {
-						continue
+			// Сжатый поток закончился (FIN или переход на несжатые пакеты): дописываем его остаток
+			if inflater != nil && seg[0]&flagDeflate == 0 {
+				n, err := inflater.Finish()
+				inflater = nil
+				bytesReceived += n
+				if err != nil {
+					log.Printf("Tunnel: Decompression error (ID: %d): %v", connID, err)
+					failWrite()
+					return
+				}
+			}
+
+			if seg[0]&flagFin != 0 {
+				log.Printf("Tunnel: Remote side finished sending, closing write half (ID: %d)", connID)
+				if cw, ok := dataConn.(interface{ CloseWrite() error }); ok {
+					if err := cw.CloseWrite(); err != nil {
+						log.Printf("Tunnel: CloseWrite error (ID: %d): %v", connID, err)
 					}
-					remoteSID = hb.SessionID
-					lastRemoteHBSeq = hb.Seq
-					ss.mu.Lock()
-					ss.lastRemoteFPS = hb.TargetFPS
-					ss.remoteReceivedFPS = hb.ReceivedFPS
-					ss.mu.Unlock()
+				}
+			} else if seg[0]&flagDeflate != 0 {
+				if inflater == nil {
+					inflater = startInflater(dataConn)
+				}
+				if err := inflater.Write(seg[1:]); err != nil {
+					log.Printf("Tunnel: Decompression error (ID: %d): %v", connID, err)
+					failWrite()
+					return
+				}
+			} else {
+				n, err := dataConn.Write(seg[1:])
+				bytesReceived += int64(n)
+				if err != nil {
+					log.Printf("Tunnel: dataConn write error (ID: %d): %v", connID, err)
+					failWrite()
+					return
 				}
 			}
+
+			rs.mu.Lock()
+			rs.deliverQ = rs.deliverQ[1:]
+			if seg[0]&flagFin != 0 {
+				rs.remoteFin = true
+			}
+			rs.mu.Unlock()
 		}
 	}()
 
 	wg.Wait()
 	log.Printf("Tunnel: Closed. Sent: %d bytes, Received: %d bytes", bytesSent, bytesReceived)
-	// Очищаем VCam, чтобы не висел старый кадр
+	// Очищаем VCam, чтобы не висел старый кадр. Пустые кадры идут в свободные слоты
+	// и не вытесняют кадры других потоков
 	for i := 0; i < 3; i++ {
+		frameSched.Acquire(prioIdle, nil)
 		sendEncodedPacket(nil, margin, GetBlockSize())
-		time.Sleep(50 * time.Millisecond)
 	}
 }
 
@@ -946,6 +1579,9 @@ func UpdateActiveCaptureArea(hwnd syscall.Handle, x, y int) {
 // RunScreenSocksServer работает через захват экрана и VCam с динамическим выбором цели
 func RunScreenSocksServer(x, y, margin int) {
 	log.Printf("Server: Watching screen at (%d, %d) with margin %d", x, y, margin)
+	if sessionPSK() == "" {
+		log.Printf("Server: No psk configured, any client able to show frames to this screen can open connections")
+	}
 	video := &ScreenVideoConn{X: x, Y: y, Margin: margin, ReadDelay: 100 * time.Millisecond, SessionID: rand.Int63()}
 
 	activeVideoMu.Lock()
@@ -953,120 +1589,201 @@ func RunScreenSocksServer(x, y, margin int) {
 	activeVideoMu.Unlock()
 
 	pd := NewPacketDispatcher(margin)
+	pd.serverIDs = true
 	go pd.Run(video, margin)
+	go serveDNSQueries(pd, margin)
 
-	var lastHeartbeatRecv time.Time
 	var lastLog time.Time
 	var lastHBSeq uint32
 	var remoteSID int64
-	var syncPhase int // 0: Idle, 1: CalibratingClient, 2: SendingToClient, 3: Done
-	var syncStartTime time.Time
-	var syncCount int
+	sess := newSessionMachine("Server")
+	var calibStep int // При калибровке: 1 — замер клиента, 2 — отправка своих синхропакетов
+	var calib *calibrator
+	var remoteNode int64
+	var profileUsed bool
 	var stopServerSync chan struct{}
+	var clientFPS int // Замер клиент -> сервер из фазы 1, отдается клиенту при возобновлении
+	var lastResumeReply time.Time
+	var lastReject time.Time
+	var serverKX *keyExchange
+
+	// updateKeys согласует ключи шифрования с открытым ключом клиента из синхропакета.
+	// Клиент присылает новый ключ при каждой синхронизации, в том числе при возобновлении.
+	updateKeys := func(sd *SyncData, agreed Capabilities) {
+		if agreed.Features&capSeal == 0 {
+			setSessionKeys(nil)
+			return
+		}
+		if serverKX == nil || len(sd.PubKey) == 0 || bytes.Equal(sd.PubKey, sessionPeerKey()) {
+			return
+		}
+		k, err := serverKX.Derive(sd.PubKey, false, sd.SessionID, video.SessionID, sessionPSK())
+		if err != nil {
+			log.Printf("Server: Key exchange with SID=%d failed: %v", sd.SessionID, err)
+			return
+		}
+		setSessionKeys(k)
+		log.Printf("Server: Session keys established with SID=%d", sd.SessionID)
+	}
 
 	var pendingMu sync.Mutex
-	pendingConns := make(map[uint16]bool)
+	pendingConns := make(map[uint16]byte) // connID -> эпоха соединения, ожидающего Dial
+	replies := make(map[uint16][]byte)    // connID -> последний ответ (CONNACK или BIND_ACCEPT) для повторов CONNECT
+
+	stateTicker := time.NewTicker(5 * time.Second)
+	defer stateTicker.Stop()
 
 	for {
 		select {
 		case data := <-pd.syncCh:
 			var sd SyncData
-			if err := json.Unmarshal(data[1:], &sd); err == nil {
+			if err := sd.UnmarshalBinary(data[1:]); err == nil {
+				agreed, err := negotiateCaps(localCaps(), sd.Caps)
+				if err != nil {
+					// Несовместимый клиент: объясняем причину, но не чаще раза в секунду.
+					// Отказ кодируется так же, как запрос, иначе узел v2 его не прочитает
+					if time.Since(lastReject) > time.Second {
+						log.Printf("Server: Rejecting sync from SID=%d: %v", sd.SessionID, err)
+						replyVer := protoVersion
+						if isJSONControl(data[1:]) {
+							replyVer = verTLVControl - 1
+						}
+						resp := SyncData{SessionID: video.SessionID, Caps: localCaps(), Reject: err.Error()}
+						sendEncodedPacket(encodeControl(typeSync, &resp, replyVer), margin, GetBlockSize())
+						recordSentPacket(typeSync)
+						lastReject = time.Now()
+					}
+					continue
+				}
+				if sess.Calibrated() && sd.SessionID == remoteSID {
+					if sd.Resume && agreed.Features&capResume != 0 {
+						// Клиент переподключается к той же сессии: калибровка уже есть, потоки сохраняем
+						updateKeys(&sd, agreed)
+						if time.Since(lastResumeReply) > 100*time.Millisecond {
+							if time.Since(lastResumeReply) > 5*time.Second {
+								log.Printf("Server: Resuming session SID=%d, keeping streams", sd.SessionID)
+							}
+							resp := SyncData{SessionID: video.SessionID, MeasuredFPS: clientFPS, Resume: true, NodeID: localNodeID(), Caps: localCaps(), PubKey: serverKX.Public()}
+							sendEncodedPacket(encodeControl(typeSync, &resp, agreed.Version), margin, GetBlockSize())
+							recordSentPacket(typeSync)
+							lastResumeReply = time.Now()
+						}
+						sess.Set(stateEstablished, "session resumed")
+						continue
+					}
+					n := pd.CloseAll()
+					log.Printf("Server: Client restarted session SID=%d without resume, closed %d streams, restarting sync", sd.SessionID, n)
+					sess.Set(stateIdle, "client restarted without resume")
+				}
 				if remoteSID != 0 && sd.SessionID != remoteSID {
-					log.Printf("Server: Remote session ID changed (%d -> %d), restarting sync", remoteSID, sd.SessionID)
+					n := pd.CloseAll()
+					log.Printf("Server: Remote session ID changed (%d -> %d), closed %d orphaned streams, restarting sync", remoteSID, sd.SessionID, n)
 					remoteSID = sd.SessionID
-					syncPhase = 0
+					sess.Set(stateIdle, "remote session changed")
 					if stopServerSync != nil {
 						close(stopServerSync)
 						stopServerSync = nil
 					}
 				}
 
-				if syncPhase == 0 {
-					log.Printf("Server: New sync session detected (SID=%d). Phase 1: Calibrating client for 10s...", sd.SessionID)
+				if sess.State() == stateIdle {
 					remoteSID = sd.SessionID
-					syncPhase = 1
+					remoteNode = sd.NodeID
+					setSessionCaps(agreed)
+					resetPlainReplay(sd.SessionID)
+					log.Printf("Server: Negotiated protocol v%d, features 0x%x", agreed.Version, agreed.Features)
+					serverKX = newKeyExchange()
+					setSessionKeys(nil)
+					var profile *CalibrationProfile
+					if agreed.Features&capProfiles != 0 {
+						profile = loadProfile(remoteNode, margin)
+					}
+					if profile != nil {
+						log.Printf("Server: New sync session detected (SID=%d). Phase 1: Verifying cached profile (client FPS %d) for %v...", sd.SessionID, profile.RecvFPS, profileVerifyWindow)
+					} else {
+						log.Printf("Server: New sync session detected (SID=%d). Phase 1: Calibrating client for 10s...", sd.SessionID)
+					}
+					sess.Set(stateCalibrating, fmt.Sprintf("sync from SID=%d", sd.SessionID))
+					calibStep = 1
 					video.ReadDelay = 0 // Max speed for calibration
-					syncStartTime = time.Now()
-					syncCount = 0
+					calib = newCalibrator(profile)
 				}
 
-				if syncPhase == 1 {
-					syncCount++
-					if time.Since(syncStartTime) >= 10*time.Second {
-						dur := time.Since(syncStartTime).Seconds()
-						calculatedFPS := int(float64(syncCount) / dur)
-						if calculatedFPS < 1 {
-							calculatedFPS = 1
-						}
-						if calculatedFPS > 30 {
-							calculatedFPS = 30
-						}
-						log.Printf("Server: Phase 1 done. Client FPS=%d (dur=%.2fs). Transitioning to Phase 2...", calculatedFPS, dur)
+				updateKeys(&sd, agreed)
 
-						syncPhase = 2
+				if sess.State() == stateCalibrating && calibStep == 1 {
+					if calculatedFPS, fromProfile := calib.Add(); calculatedFPS > 0 {
+						log.Printf("Server: Phase 1 done. Client FPS=%d (dur=%.2fs, cached=%v). Transitioning to Phase 2...", calculatedFPS, calib.Elapsed().Seconds(), fromProfile)
+						clientFPS = calculatedFPS
+						profileUsed = fromProfile
+
+						calibStep = 2
 						stopServerSync = make(chan struct{})
 						// Начинаем отправлять свои синхропакеты
-						go func(sid int64, fps int, stop chan struct{}) {
+						go func(sid int64, fps int, pub []byte, ver int, stop chan struct{}) {
 							log.Printf("Server: Phase 2: Sending SYNC to client...")
 							for {
 								select {
 								case <-stop:
 									return
 								default:
-									resp := SyncData{SessionID: video.SessionID, Random: generateRandomString(32), MeasuredFPS: fps}
-									respBytes, _ := json.Marshal(resp)
-									sendEncodedPacket(append([]byte{typeSync}, respBytes...), margin, GetBlockSize())
+									resp := SyncData{SessionID: video.SessionID, Nonce: rand.Uint32(), MeasuredFPS: fps, NodeID: localNodeID(), Caps: localCaps(), PubKey: pub}
+									sendEncodedPacket(encodeControl(typeSync, &resp, ver), margin, GetBlockSize())
 									recordSentPacket(typeSync)
 									time.Sleep(10 * time.Millisecond) // Max rate 100 FPS
 								}
 							}
-						}(video.SessionID, calculatedFPS, stopServerSync)
+						}(video.SessionID, calculatedFPS, serverKX.Public(), agreed.Version, stopServerSync)
 					}
 				}
 			}
 
 		case data := <-pd.syncCompCh:
 			var scd SyncCompleteData
-			if err := json.Unmarshal(data[1:], &scd); err == nil {
-				if scd.SessionID == remoteSID && syncPhase == 2 {
+			if err := scd.UnmarshalBinary(data[1:]); err == nil {
+				if scd.SessionID == remoteSID && sess.State() == stateCalibrating && calibStep == 2 {
 					log.Printf("Server: Received SYNC_COMPLETE. Final FPS: %d", scd.FPS)
 					if stopServerSync != nil {
 						close(stopServerSync)
 						stopServerSync = nil
 					}
-					video.ReadDelay = time.Second / time.Duration(scd.FPS)
-					syncPhase = 3
+					video.ReadDelay = time.Second / time.Duration(max(scd.FPS, 1))
+					if profileUsed {
+						if p := loadProfile(remoteNode, margin); p != nil && p.BlockSize > 0 {
+							SetBlockSize(p.BlockSize)
+						}
+					}
+					rateCtl.Reset(scd.FPS)
+					saveProfile(remoteNode, CalibrationProfile{SendFPS: scd.FPS, RecvFPS: clientFPS, BlockSize: GetBlockSize(), Margin: margin})
+					sess.Set(stateEstablished, "sync complete")
 				}
+			} else {
+				log.Printf("Server: Dropping SYNC_COMPLETE: %v", err)
 			}
 
 		case data := <-pd.heartbeatCh:
-			if syncPhase != 3 {
+			if !sess.Calibrated() {
 				continue
 			}
 			var hb HeartbeatData
-			if err := json.Unmarshal(data[1:], &hb); err == nil {
+			if err := hb.UnmarshalBinary(data[1:]); err == nil {
 				if hb.Seq != 0 && hb.Seq <= lastHBSeq && hb.SessionID == remoteSID && hb.Phase == 0 {
 					continue
 				}
 				lastHBSeq = hb.Seq
 
 				if time.Since(lastLog) > 5*time.Second {
-					log.Printf("Server: Quality: SID=%d, Phase=%d, RemoteFPS=%.1f, RemoteTarget=%d, Sent:[%s], RecvFPS=%d",
-						hb.SessionID, hb.Phase, hb.FPS, hb.TargetFPS, getSentStatsAndReset(), getRecvFPS())
+					replays, dups := getReplayStatsAndReset()
+					log.Printf("Server: Quality: SID=%d, Phase=%d, RemoteFPS=%.1f, RemoteTarget=%d, Sent:[%s], RecvFPS=%d, FECRecovered=%d, Compression=%.2f, Replays=%d, Dups=%d, Overflows=%d",
+						hb.SessionID, hb.Phase, hb.FPS, hb.TargetFPS, getSentStatsAndReset(), getRecvFPS(), pd.fec.Recovered(), getCompressionRatio(), replays, dups, pd.Overflows())
 					lastLog = time.Now()
+					refreshProfile(remoteNode, margin)
 				}
-				lastHeartbeatRecv = time.Now()
+				sess.Heartbeat()
+				rateCtl.OnRemoteFPS(hb.ReceivedFPS)
 
-				if hb.TargetFPS > 0 {
-					newDelay := time.Second / time.Duration(hb.TargetFPS)
-					if newDelay < 10*time.Millisecond {
-						newDelay = 10 * time.Millisecond
-					}
-					if video.ReadDelay != newDelay {
-						log.Printf("Server: Adapting capture delay to %v (Target FPS: %d)", newDelay, hb.TargetFPS)
-						video.ReadDelay = newDelay
-					}
+				if newDelay, changed := video.AdaptToRemoteFPS(hb.TargetFPS); changed {
+					log.Printf("Server: Adapting capture delay to %v (Target FPS: %d)", newDelay, hb.TargetFPS)
 				}
 
 				fps, ms := getPerfMetrics()
@@ -1074,139 +1791,253 @@ func RunScreenSocksServer(x, y, margin int) {
 					FPS:          fps,
 					ProcessingMS: ms,
 					Timestamp:    time.Now().Unix(),
-					TargetFPS:    int(time.Second / video.ReadDelay),
+					TargetFPS:    rateCtl.FPS(),
 					ReceivedFPS:  getRecvFPS(),
 					Ready:        true,
 					SessionID:    video.SessionID,
 					Seq:          hb.Seq,
 					Phase:        0,
 				}
-				hbBytes, _ := json.Marshal(resp)
-				sendEncodedPacket(append([]byte{typeHeartbeat}, hbBytes...), margin, GetBlockSize())
+				sendControlPacket(encodeControl(typeHeartbeat, &resp, sessionVersion()), margin)
 				recordSentPacket(typeHeartbeat)
 			}
 
 		case data := <-pd.connectCh:
-			if syncPhase != 3 {
+			if !sess.Calibrated() {
 				continue
 			}
 			go func(data []byte) {
-				if len(data) < 4 { // Тип(1) + ID(2) + Seq(1) + Адрес
+				if len(data) < connHeaderLen+2 { // Заголовок(4) + Команда(1) + Приоритет(1) + Адрес
 					return
 				}
 				connID := uint16(data[1])<<8 | uint16(data[2])
-				seq := data[3]
-				targetAddr := string(data[4:])
+				epoch := data[3]
+				cmd := data[4] // Команда SOCKS5; клиенты без UDP и BIND всегда шлют 1 (CONNECT)
+				prio := data[5]
+				targetAddr := string(data[6:])
 				targetAddr = strings.TrimRight(targetAddr, "\x00")
+				if connID >= serverIDMin {
+					// ID из диапазона сервера: такой CONNECT закрыл бы поток обратной переадресации
+					log.Printf("Server: Ignoring CONNECT with server-range ID %d", connID)
+					return
+				}
 
-				// Проверка на дубликаты CONNECT
-				pd.mu.RLock()
-				_, alreadyActive := pd.connChannels[connID]
-				pd.mu.RUnlock()
+				// Проверка на дубликаты CONNECT: повтор той же эпохи подтверждаем еще раз,
+				// другая эпоха — новое соединение клиента, прежнее с этим ID устарело
+				activeEpoch, alreadyActive := pd.Lookup(connID)
+				if alreadyActive && activeEpoch != epoch {
+					log.Printf("Server: CONNECT for ID %d with new epoch %d (active %d), closing stale stream", connID, epoch, activeEpoch)
+					pd.Evict(connID)
+					alreadyActive = false
+				}
 
 				pendingMu.Lock()
-				alreadyPending := pendingConns[connID]
+				pendingEpoch, alreadyPending := pendingConns[connID]
+				if alreadyPending && pendingEpoch != epoch {
+					// Dial прежней эпохи еще идет; новая подождет повтора CONNECT
+					pendingMu.Unlock()
+					return
+				}
 				if !alreadyPending && !alreadyActive {
-					pendingConns[connID] = true
+					pendingConns[connID] = epoch
 				}
 				pendingMu.Unlock()
 
 				if alreadyActive || alreadyPending {
+					pendingMu.Lock()
+					reply, ok := replies[connID]
+					pendingMu.Unlock()
+					if ok && reply[3] == epoch {
+						sendControlPacket(reply, margin)
+						recordSentPacket(reply[0])
+						return
+					}
 					// Просто подтверждаем еще раз, если это повтор
 					// Для повтора отправляем пустой адрес, так как клиент уже должен иметь его или он ему не важен
-					payload := make([]byte, 4+1+4+2)
+					payload := make([]byte, connHeaderLen+1+1+4+2)
 					payload[0] = typeConnAck
 					payload[1] = byte(connID >> 8)
 					payload[2] = byte(connID)
-					payload[3] = socks5RespSuccess
-					payload[4] = socks5AtypIPv4
+					payload[3] = epoch
+					payload[4] = socks5RespSuccess
+					payload[5] = socks5AtypIPv4
 					// остальное нули
-					sendEncodedPacket(payload, margin, GetBlockSize())
+					sendControlPacket(payload, margin)
 					recordSentPacket(typeConnAck)
 					return
 				}
 
-				log.Printf("Server: Decoded CONNECT to %s (ID: %d, seq: %d)", targetAddr, connID, seq)
-
-				targetConn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+				log.Printf("Server: Decoded CONNECT to %s (ID: %d, epoch: %d, command: %d, priority: %s)", targetAddr, connID, epoch, cmd, priorityName(prio))
+
+				var targetConn net.Conn
+				var relay *net.UDPConn
+				var bindLn net.Listener
+				var bindPeer net.IP
+				var reverseLn net.Listener
+				var localAddr net.Addr
+				var err error
+				if cmd == socks5CmdUDPAssociate {
+					// Ассоциация UDP: соединяться не с кем, открываем сокет для датаграмм
+					if relay, err = net.ListenUDP("udp", nil); err == nil {
+						localAddr = relay.LocalAddr()
+					}
+				} else if cmd == socks5CmdBind {
+					// BIND: слушаем порт, адрес сообщаем клиенту, соединение примет runBind
+					if err = exitCheckBind(targetAddr); err == nil {
+						if bindLn, bindPeer, err = bindListen(targetAddr); err == nil {
+							localAddr = bindLn.Addr()
+						}
+					}
+				} else if cmd == cmdReverseListen {
+					// Обратная переадресация: слушаем порт, пока клиент держит поток
+					if reverseLn, err = reverseListen(targetAddr); err == nil {
+						localAddr = reverseLn.Addr()
+					}
+				} else if targetConn, err = exitDial(targetAddr, 10*time.Second); err == nil {
+					localAddr = targetConn.LocalAddr()
+				}
 
 				pendingMu.Lock()
 				delete(pendingConns, connID)
 				pendingMu.Unlock()
 
 				status := byte(socks5RespSuccess)
-				var boundAddr []byte
-				atyp := byte(socks5AtypIPv4)
-				port := uint16(0)
 
 				if err != nil {
 					log.Printf("Server: dial failed to %s: %v", targetAddr, err)
-					status = socks5RespFailure
-					errStr := err.Error()
-					if strings.Contains(errStr, "refused") {
-						status = socks5RespConnRefused
-					} else if strings.Contains(errStr, "unreachable") {
-						status = socks5RespHostUnreach
-					} else if strings.Contains(errStr, "timeout") {
-						status = socks5RespTTLExpired
-					}
-				} else {
-					if tcpAddr, ok := targetConn.LocalAddr().(*net.TCPAddr); ok {
-						if ip4 := tcpAddr.IP.To4(); ip4 != nil {
-							atyp = socks5AtypIPv4
-							boundAddr = ip4
-						} else {
-							atyp = socks5AtypIPv6
-							boundAddr = tcpAddr.IP
-						}
-						port = uint16(tcpAddr.Port)
-					}
+					status = socksReplyCode(err)
 				}
 
-				if boundAddr == nil {
-					boundAddr = make([]byte, 4)
+				payload := connAckPayload(typeConnAck, connID, epoch, status, localAddr)
+				if err == nil {
+					pendingMu.Lock()
+					replies[connID] = payload
+					pendingMu.Unlock()
 				}
-
-				payload := make([]byte, 4+1+len(boundAddr)+2)
-				payload[0] = typeConnAck
-				payload[1] = byte(connID >> 8)
-				payload[2] = byte(connID)
-				payload[3] = status
-				payload[4] = atyp
-				copy(payload[5:], boundAddr)
-				binary.BigEndian.PutUint16(payload[5+len(boundAddr):], port)
-				sendEncodedPacket(payload, margin, GetBlockSize())
+				sendControlPacket(payload, margin)
 				recordSentPacket(typeConnAck)
 
 				if err == nil {
-					ch := pd.Register(connID)
+					ch := pd.Register(connID, epoch)
 					go func() {
-						runTunnelWithPrefix(targetConn, video, margin, connID, 0, ch)
-						pd.Unregister(connID)
-						targetConn.Close()
+						switch {
+						case relay != nil:
+							runUDPRelay(relay, margin, connID, epoch, ch)
+						case reverseLn != nil:
+							runReverseListener(reverseLn, targetAddr, pd, video, margin, connID, epoch, ch)
+						case bindLn != nil:
+							runBind(bindLn, bindPeer, video, margin, connID, epoch, prio, ch, func(reply []byte) {
+								pendingMu.Lock()
+								replies[connID] = reply
+								pendingMu.Unlock()
+							})
+						default:
+							runTunnelWithPrefix(targetConn, video, margin, connID, epoch, prio, ch)
+							targetConn.Close()
+						}
+						pd.Unregister(connID, epoch)
+						pendingMu.Lock()
+						if reply, ok := replies[connID]; ok && reply[3] == epoch {
+							delete(replies, connID)
+						}
+						pendingMu.Unlock()
 					}()
 				}
 			}(data)
 
-		case <-time.After(5 * time.Second):
-			hbTimeout := 60 * time.Second
+		case <-stateTicker.C:
+			hbInterval := 30 * time.Second
 			if currentCfg != nil && currentCfg.HeartbeatInterval > 0 {
-				hbTimeout = time.Duration(currentCfg.HeartbeatInterval) * 2 * time.Second
+				hbInterval = time.Duration(currentCfg.HeartbeatInterval) * time.Second
 			}
-			if !lastHeartbeatRecv.IsZero() && time.Since(lastHeartbeatRecv) > hbTimeout {
-				if video.ReadDelay < 100*time.Millisecond {
-					video.ReadDelay = 100 * time.Millisecond
-					log.Printf("Server: No heartbeats received for %v, slowing down capture...", hbTimeout)
-					lastHeartbeatRecv = time.Time{}
-				}
+			// Клиент пропал: замедляем захват до его повторной синхронизации
+			if sess.Check(hbInterval) == stateLost && video.ReadDelay < 100*time.Millisecond {
+				video.ReadDelay = 100 * time.Millisecond
+				log.Printf("Server: Client lost, slowing down capture until it re-syncs")
 			}
 		}
 	}
 }
 
+// openStream открывает соединение на удаленной стороне: отправляет CONNECT с командой
+// и ждет CONNACK. При успехе соединение остается зарегистрированным, снять его должен
+// вызывающий. Клиент открывает так соединения на сервере, сервер — обратные на клиенте.
+func openStream(pd *PacketDispatcher, margin int, cmd byte, targetAddr string, prio byte) (uint16, byte, chan []byte, net.Addr, error) {
+	role := pd.role()
+	connID, epoch, ch, err := pd.Allocate()
+	if err != nil {
+		log.Printf("%s: Cannot open connection to %s: %v", role, targetAddr, err)
+		return 0, 0, nil, nil, err
+	}
+	log.Printf("%s: New connection to %s (ID: %d, epoch: %d, command: %d, priority: %s)", role, targetAddr, connID, epoch, cmd, priorityName(prio))
+
+	payload := connectPayload(connID, epoch, cmd, prio, targetAddr)
+
+	sendControlPacket(payload, margin)
+	recordSentPacket(typeConnect)
+
+	success := false
+	var remoteBoundAddr net.Addr
+	var lastStatus byte = socks5RespFailure
+	timer := time.After(3 * time.Second)
+	overallTimer := time.After(15 * time.Second)
+WaitAck:
+	for {
+		select {
+		case data := <-ch:
+			if data[0] == typeConnAck && len(data) >= connHeaderLen+1 {
+				lastStatus, remoteBoundAddr = parseConnAck(data)
+				success = (lastStatus == socks5RespSuccess)
+				break WaitAck
+			}
+		case <-timer:
+			// Повторная отправка CONNECT если нет ответа 3 секунды
+			sendControlPacket(payload, margin)
+			recordSentPacket(typeConnect)
+			timer = time.After(5 * time.Second)
+		case <-overallTimer:
+			break WaitAck
+		}
+	}
+
+	if !success {
+		log.Printf("%s: Failed to establish tunnel to %s (ID: %d), status: 0x%02x", role, targetAddr, connID, lastStatus)
+		pd.Unregister(connID, epoch)
+		if lastStatus != socks5RespSuccess {
+			return 0, 0, nil, nil, socksReplyError(lastStatus)
+		}
+		return 0, 0, nil, nil, fmt.Errorf("no CONNACK for %s: %w", targetAddr, os.ErrDeadlineExceeded)
+	}
+	return connID, epoch, ch, remoteBoundAddr, nil
+}
+
+// acceptLoop принимает соединения слушателя и обслуживает каждое в своей горутине.
+func acceptLoop(ln net.Listener, handle func(net.Conn)) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("Client: Accept failed: %v", err)
+			return
+		}
+		go handle(c)
+	}
+}
+
 // RunScreenSocksClient работает через захват экрана и VCam
-func RunScreenSocksClient(localListenAddr string, x, y, margin int) {
-	video := &ScreenVideoConn{X: x, Y: y, Margin: margin, ReadDelay: 500 * time.Millisecond, SessionID: rand.Int63()}
+func RunScreenSocksClient(localListenAddr, httpListenAddr, dnsListenAddr string, forwards, reverses []ForwardRule, x, y, margin int) {
+	// Идентификатор сессии сохраняется в конфиге, чтобы после перезапуска сервер узнал клиента.
+	// Возобновление при этом не запрашивается: потоков прежнего процесса больше нет, и сервер,
+	// получив синхронизацию без resume, закрывает их и калибрует канал заново
+	sid := rand.Int63()
+	resume := false
+	if currentCfg != nil && currentCfg.SessionID != 0 {
+		sid = currentCfg.SessionID
+		log.Printf("Client: Reusing session ID %d from config", sid)
+	} else if currentCfg != nil {
+		currentCfg.SessionID = sid
+		saveConfig(cfgFile, currentCfg)
+	}
+	video := &ScreenVideoConn{X: x, Y: y, Margin: margin, ReadDelay: 500 * time.Millisecond, SessionID: sid}
 
 	activeVideoMu.Lock()
 	activeVideoConn = video
@@ -1215,236 +2046,333 @@ func RunScreenSocksClient(localListenAddr string, x, y, margin int) {
 	pd := NewPacketDispatcher(margin)
 	go pd.Run(video, margin)
 
+	openRemote := func(cmd byte, targetAddr string, prio byte) (uint16, byte, chan []byte, net.Addr, error) {
+		return openStream(pd, margin, cmd, targetAddr, prio)
+	}
+
+	handleConn := func(c net.Conn) {
+		defer c.Close()
+		req, err := HandleSocksRequest(c)
+		if err != nil {
+			log.Printf("Client: SOCKS5 handshake failed: %v", err)
+			return
+		}
+		switch req.Cmd {
+		case socks5CmdUDPAssociate:
+			serveUDPAssociate(c, req, pd, margin, openRemote)
+			return
+		case socks5CmdBind:
+			serveBind(c, req, pd, video, margin, openRemote)
+			return
+		}
+		targetAddr := req.Target
+
+		prio := priorityForTarget(targetAddr)
+		connID, epoch, ch, remoteBoundAddr, err := openRemote(socks5CmdConnect, targetAddr, prio)
+		if err != nil {
+			_ = req.Reply(c, err, nil)
+			return
+		}
+		defer pd.Unregister(connID, epoch)
+
+		_ = req.Reply(c, nil, remoteBoundAddr)
+		log.Printf("Client: Tunnel established to %s (ID: %d)", targetAddr, connID)
+
+		runTunnelWithPrefix(c, video, margin, connID, epoch, prio, ch)
+	}
+
+	handleHTTP := func(c net.Conn) {
+		defer c.Close()
+		serveHTTPProxy(c, pd, video, margin, openRemote)
+	}
+
+	// Общий порт SOCKS и HTTP: протокол определяется по первому байту
+	handleShared := func(c net.Conn) {
+		bc, isSocks, err := sniffSocks(c)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if isSocks {
+			handleConn(bc)
+		} else {
+			handleHTTP(bc)
+		}
+	}
+
 	var hbSeq uint32
+	var ln net.Listener
+	sess := newSessionMachine("Client")
 
 	for {
-		log.Printf("Client: Starting synchronization...")
+		log.Printf("Client: Starting synchronization (resume=%v)...", resume)
+		sess.Set(stateIdle, "starting synchronization")
 		var serverSID int64
-		var syncStartTime time.Time
-		var syncCount int
-		var clientSyncPhase int // 0: Initiating, 1: CalibratingServer, 2: Done
+		var serverNode int64
+		var calib *calibrator
+		var rejected bool
+		var serverMeasuredFPS int
 		var stopInitiating chan struct{} = make(chan struct{})
+		kx := newKeyExchange() // Новый ключ на каждую синхронизацию
+
+		// Ответы прошлой синхронизации не должны приниматься за новые
+	Drain:
+		for {
+			select {
+			case <-pd.syncCh:
+			default:
+				break Drain
+			}
+		}
 
-		// Phase 0: Отправляем свои синхропакеты на максимально доступной скорости
-		go func(sid int64, stop chan struct{}) {
-			for {
+		// Phase 0: Отправляем свои синхропакеты на максимально доступной скорости. Версия
+		// сервера еще неизвестна, поэтому без psk каждый второй идет в JSON: сервер протокола
+		// v2 не читает TLV (с psk он все равно не подойдет — у него нет шифрования)
+		go func(sid int64, resume bool, pub []byte, stop chan struct{}) {
+			for i := 0; ; i++ {
 				select {
 				case <-stop:
 					return
 				default:
-					syncPayload, _ := json.Marshal(SyncData{SessionID: sid, Random: generateRandomString(32)})
-					sendEncodedPacket(append([]byte{typeSync}, syncPayload...), margin, GetBlockSize())
+					ver := protoVersion
+					if i%2 == 1 && sessionPSK() == "" {
+						ver = verTLVControl - 1
+					}
+					sd := SyncData{SessionID: sid, Nonce: rand.Uint32(), Resume: resume, NodeID: localNodeID(), Caps: localCaps(), PubKey: pub}
+					sendEncodedPacket(encodeControl(typeSync, &sd, ver), margin, GetBlockSize())
 					recordSentPacket(typeSync)
 					time.Sleep(10 * time.Millisecond)
 				}
 			}
-		}(video.SessionID, stopInitiating)
+		}(video.SessionID, resume, kx.Public(), stopInitiating)
 
 	WaitSync:
 		for {
 			select {
 			case data := <-pd.syncCh:
 				var sd SyncData
-				if err := json.Unmarshal(data[1:], &sd); err == nil {
-					if clientSyncPhase == 0 {
-						log.Printf("Client: Server SYNC detected (SID=%d). Phase 1: Calibrating server for 10s...", sd.SessionID)
+				if err := sd.UnmarshalBinary(data[1:]); err == nil {
+					if sess.State() == stateIdle {
+						agreed, err := negotiateCaps(localCaps(), sd.Caps)
+						if err == nil && sd.Reject != "" {
+							err = fmt.Errorf("server refused: %s", sd.Reject)
+						}
+						if err != nil {
+							log.Printf("Client: Incompatible server (SID=%d): %v", sd.SessionID, err)
+							close(stopInitiating)
+							rejected = true
+							break WaitSync
+						}
+						if agreed.Features&capSeal != 0 {
+							k, err := kx.Derive(sd.PubKey, true, video.SessionID, sd.SessionID, sessionPSK())
+							if err != nil {
+								log.Printf("Client: Key exchange with server SID=%d failed: %v", sd.SessionID, err)
+								continue
+							}
+							setSessionKeys(k)
+							log.Printf("Client: Session keys established with server SID=%d", sd.SessionID)
+						} else {
+							setSessionKeys(nil)
+						}
+						setSessionCaps(agreed)
+						resetPlainReplay(sd.SessionID)
+						log.Printf("Client: Negotiated protocol v%d, features 0x%x", agreed.Version, agreed.Features)
+					}
+					if sess.State() == stateIdle && sd.Resume {
+						log.Printf("Client: Server resumed session (SID=%d), keeping streams", sd.SessionID)
+						close(stopInitiating)
+						serverSID = sd.SessionID
+						serverNode = sd.NodeID
+						if sd.MeasuredFPS > 0 {
+							rateCtl.Reset(sd.MeasuredFPS)
+						}
+						sess.Set(stateEstablished, "session resumed")
+						break WaitSync
+					}
+					if sess.State() == stateIdle {
+						serverNode = sd.NodeID
+						var profile *CalibrationProfile
+						if peerSupports(capProfiles) {
+							profile = loadProfile(serverNode, margin)
+						}
+						if profile != nil {
+							log.Printf("Client: Server SYNC detected (SID=%d). Phase 1: Verifying cached profile (server FPS %d) for %v...", sd.SessionID, profile.RecvFPS, profileVerifyWindow)
+						} else {
+							log.Printf("Client: Server SYNC detected (SID=%d). Phase 1: Calibrating server for 10s...", sd.SessionID)
+						}
+						calib = newCalibrator(profile)
 						// Останавливаем свою отправку
 						close(stopInitiating)
+						// Сервер начал новую сессию: его сторона наших потоков больше не существует
+						if n := pd.CloseAll(); n > 0 {
+							log.Printf("Client: Server started a new session, closed %d orphaned streams", n)
+						}
 						serverSID = sd.SessionID
-						clientSyncPhase = 1
+						sess.Set(stateCalibrating, fmt.Sprintf("sync from server SID=%d", sd.SessionID))
 						video.ReadDelay = 0 // Max speed for calibration
-						syncStartTime = time.Now()
-						syncCount = 0
 					}
-					if clientSyncPhase == 1 && sd.SessionID == serverSID {
-						syncCount++
-						if time.Since(syncStartTime) >= 10*time.Second {
-							dur := time.Since(syncStartTime).Seconds()
-							calculatedFPS := int(float64(syncCount) / dur)
-							if calculatedFPS < 1 {
-								calculatedFPS = 1
-							}
-							if calculatedFPS > 30 {
-								calculatedFPS = 30
-							}
-							log.Printf("Client: Phase 1 done. Server FPS=%d (dur=%.2fs). Sending SYNC_COMPLETE...", calculatedFPS, dur)
+					if sess.State() == stateCalibrating && sd.SessionID == serverSID && !sd.Resume {
+						if sd.MeasuredFPS > 0 {
+							serverMeasuredFPS = sd.MeasuredFPS
+						}
+						if calculatedFPS, fromProfile := calib.Add(); calculatedFPS > 0 {
+							log.Printf("Client: Phase 1 done. Server FPS=%d (dur=%.2fs, cached=%v). Sending SYNC_COMPLETE...", calculatedFPS, calib.Elapsed().Seconds(), fromProfile)
 
 							// Phase 2: Отправляем SYNC_COMPLETE
 							scd := SyncCompleteData{SessionID: video.SessionID, FPS: calculatedFPS}
-							scdBytes, _ := json.Marshal(scd)
+							scdPacket := encodeControl(typeSyncComplete, &scd, sessionVersion())
 							for i := 0; i < 5; i++ { // Отправляем несколько раз для надежности
-								sendEncodedPacket(append([]byte{typeSyncComplete}, scdBytes...), margin, GetBlockSize())
+								sendEncodedPacket(scdPacket, margin, GetBlockSize())
 								recordSentPacket(typeSyncComplete)
 								time.Sleep(50 * time.Millisecond)
 							}
 
-							video.ReadDelay = time.Second / time.Duration(calculatedFPS)
-							clientSyncPhase = 2
+							video.ReadDelay = time.Second / time.Duration(max(calculatedFPS, 1))
+							if fromProfile {
+								if p := loadProfile(serverNode, margin); p != nil && p.BlockSize > 0 {
+									SetBlockSize(p.BlockSize)
+								}
+							}
+							// Свою скорость отправки берем из замера сервера (клиент -> сервер)
+							if serverMeasuredFPS == 0 {
+								serverMeasuredFPS = calculatedFPS
+							}
+							rateCtl.Reset(serverMeasuredFPS)
+							saveProfile(serverNode, CalibrationProfile{SendFPS: serverMeasuredFPS, RecvFPS: calculatedFPS, BlockSize: GetBlockSize(), Margin: margin})
+							sess.Set(stateEstablished, "sync complete")
 							break WaitSync
 						}
 					}
 				}
 			case <-time.After(60 * time.Second):
 				log.Printf("Client: Sync timeout, retrying...")
-				if clientSyncPhase == 0 {
+				if sess.State() == stateIdle {
 					close(stopInitiating)
 				}
 				break WaitSync
 			}
 		}
 
-		if clientSyncPhase != 2 {
+		if sess.State() != stateEstablished {
+			if rejected {
+				// Сервер не изменится сам по себе: не засыпаем канал синхропакетами
+				time.Sleep(30 * time.Second)
+			}
 			continue
 		}
+		// Следующая синхронизация в этом процессе — возобновление той же сессии
+		resume = true
 
-		bestFPS := int(time.Second / video.ReadDelay)
-
-		ln, err := net.Listen("tcp", localListenAddr)
-		if err != nil {
-			log.Printf("Client: Failed to listen on %s: %v", localListenAddr, err)
-			return
-		}
-		log.Printf("Client: SOCKS5 server listening on %s", localListenAddr)
-
-		stopSession := make(chan struct{})
-		go func() {
-			hbInterval := 30 * time.Second
-			if currentCfg != nil && currentCfg.HeartbeatInterval > 0 {
-				hbInterval = time.Duration(currentCfg.HeartbeatInterval) * time.Second
+		if ln == nil {
+			var err error
+			ln, err = net.Listen("tcp", localListenAddr)
+			if err != nil {
+				log.Printf("Client: Failed to listen on %s: %v", localListenAddr, err)
+				return
 			}
-			ticker := time.NewTicker(hbInterval)
-			defer ticker.Stop()
-			lastClientLog := time.Now()
-			var lastRemoteHBSeq uint32
-
-			for {
-				select {
-				case <-stopSession:
-					return
-				case data := <-pd.heartbeatCh:
-					var hb HeartbeatData
-					if err := json.Unmarshal(data[1:], &hb); err == nil {
-						if hb.Seq != 0 && hb.Seq <= lastRemoteHBSeq {
-							continue
-						}
-						lastRemoteHBSeq = hb.Seq
-
-						// Периодический лог качества на клиенте
-						if time.Since(lastClientLog) > 5*time.Second {
-							log.Printf("Client: Quality: SID=%d, RemoteFPS=%.1f, RemoteTarget=%d, Sent:[%s], RecvFPS=%d",
-								hb.SessionID, hb.FPS, hb.TargetFPS, getSentStatsAndReset(), getRecvFPS())
-							lastClientLog = time.Now()
-						}
-					}
-				case <-ticker.C:
-					fpsMetrics, ms := getPerfMetrics()
-					hbSeq++
-					hb := HeartbeatData{
-						FPS:          fpsMetrics,
-						ProcessingMS: ms,
-						Timestamp:    time.Now().Unix(),
-						TargetFPS:    bestFPS,
-						ReceivedFPS:  getRecvFPS(),
-						Ready:        true,
-						SessionID:    video.SessionID,
-						Seq:          hbSeq,
-					}
-					hbBytes, _ := json.Marshal(hb)
-					sendEncodedPacket(append([]byte{typeHeartbeat}, hbBytes...), margin, GetBlockSize())
-					recordSentPacket(typeHeartbeat)
-				}
+			handler := handleConn
+			if httpListenAddr == localListenAddr {
+				handler = handleShared
+				log.Printf("Client: SOCKS5 and HTTP proxy listening on %s", localListenAddr)
+			} else {
+				log.Printf("Client: SOCKS5 server listening on %s", localListenAddr)
 			}
-		}()
+			// Слушатели переживают повторные синхронизации
+			go acceptLoop(ln, handler)
 
-		for {
-			localConn, err := ln.Accept()
-			if err != nil {
-				break
+			if httpListenAddr != "" && httpListenAddr != localListenAddr {
+				httpLn, err := net.Listen("tcp", httpListenAddr)
+				if err != nil {
+					log.Printf("Client: Failed to listen on %s: %v", httpListenAddr, err)
+				} else {
+					log.Printf("Client: HTTP proxy listening on %s", httpListenAddr)
+					go acceptLoop(httpLn, handleHTTP)
+				}
 			}
 
-			go func(c net.Conn) {
-				defer c.Close()
-				targetAddr, err := HandleSocksHandshake(c)
+			for _, rule := range forwards {
+				fwdLn, err := net.Listen("tcp", rule.Listen)
 				if err != nil {
-					log.Printf("Client: SOCKS5 handshake failed: %v", err)
-					return
+					log.Printf("Client: Failed to listen on %s: %v", rule.Listen, err)
+					continue
 				}
+				log.Printf("Client: Forwarding %s to %s", rule.Listen, rule.Target)
+				go acceptLoop(fwdLn, func(c net.Conn) {
+					defer c.Close()
+					serveForward(c, rule, pd, video, margin, openRemote)
+				})
+			}
 
-				connID := uint16(rand.Intn(65535) + 1)
-				log.Printf("Client: New connection to %s (ID: %d)", targetAddr, connID)
+			go serveReverseConnects(pd, video, margin, reverses)
+			for _, rule := range reverses {
+				go maintainReverse(rule, pd, margin)
+			}
 
-				payload := make([]byte, 4+len(targetAddr))
-				payload[0] = typeConnect
-				payload[1] = byte(connID >> 8)
-				payload[2] = byte(connID)
-				payload[3] = 1 // Initial seq for connect
-				copy(payload[4:], targetAddr)
+			if dnsListenAddr != "" {
+				startDNSServer(dnsListenAddr, pd, margin)
+			}
+		}
 
-				ch := pd.Register(connID)
-				defer pd.Unregister(connID)
+		hbInterval := 30 * time.Second
+		if currentCfg != nil && currentCfg.HeartbeatInterval > 0 {
+			hbInterval = time.Duration(currentCfg.HeartbeatInterval) * time.Second
+		}
+		ticker := time.NewTicker(hbInterval)
+		stateTicker := time.NewTicker(5 * time.Second)
+		lastClientLog := time.Now()
+		var lastRemoteHBSeq uint32
 
-				sendEncodedPacket(payload, margin, GetBlockSize())
-				recordSentPacket(typeConnect)
+	Session:
+		for {
+			select {
+			case data := <-pd.heartbeatCh:
+				var hb HeartbeatData
+				if err := hb.UnmarshalBinary(data[1:]); err == nil {
+					sess.Heartbeat()
+					if hb.Seq != 0 && hb.Seq <= lastRemoteHBSeq {
+						continue
+					}
+					lastRemoteHBSeq = hb.Seq
+					rateCtl.OnRemoteFPS(hb.ReceivedFPS)
 
-				success := false
-				var remoteBoundAddr net.Addr
-				var lastStatus byte = socks5RespFailure
-				timer := time.After(3 * time.Second)
-				overallTimer := time.After(15 * time.Second)
-			WaitAck:
-				for {
-					select {
-					case data := <-ch:
-						if data[0] == typeConnAck && len(data) >= 4 {
-							lastStatus = data[3]
-							success = (lastStatus == socks5RespSuccess)
-							if success && len(data) >= 7 {
-								atyp := data[4]
-								var ip net.IP
-								var port uint16
-								if atyp == socks5AtypIPv4 && len(data) >= 11 {
-									ip = net.IP(data[5:9])
-									port = binary.BigEndian.Uint16(data[9:11])
-								} else if atyp == socks5AtypIPv6 && len(data) >= 23 {
-									ip = net.IP(data[5:21])
-									port = binary.BigEndian.Uint16(data[21:23])
-								}
-								if ip != nil {
-									remoteBoundAddr = &net.TCPAddr{IP: ip, Port: int(port)}
-								}
-							}
-							break WaitAck
-						}
-					case <-timer:
-						// Повторная отправка CONNECT если нет ответа 3 секунды
-						sendEncodedPacket(payload, margin, GetBlockSize())
-						recordSentPacket(typeConnect)
-						timer = time.After(5 * time.Second)
-					case <-overallTimer:
-						break WaitAck
+					if newDelay, changed := video.AdaptToRemoteFPS(hb.TargetFPS); changed {
+						log.Printf("Client: Adapting capture delay to %v (Target FPS: %d)", newDelay, hb.TargetFPS)
 					}
-				}
 
-				if !success {
-					log.Printf("Client: Failed to establish tunnel to %s (ID: %d), status: 0x%02x", targetAddr, connID, lastStatus)
-					var err error
-					if lastStatus != socks5RespSuccess {
-						err = fmt.Errorf("socks5 error: 0x%02x", lastStatus)
-					} else {
-						err = fmt.Errorf("timeout")
+					// Периодический лог качества на клиенте
+					if time.Since(lastClientLog) > 5*time.Second {
+						replays, dups := getReplayStatsAndReset()
+						log.Printf("Client: Quality: SID=%d, RemoteFPS=%.1f, RemoteTarget=%d, Sent:[%s], RecvFPS=%d, FECRecovered=%d, Compression=%.2f, Replays=%d, Dups=%d, Overflows=%d",
+							hb.SessionID, hb.FPS, hb.TargetFPS, getSentStatsAndReset(), getRecvFPS(), pd.fec.Recovered(), getCompressionRatio(), replays, dups, pd.Overflows())
+						lastClientLog = time.Now()
+						refreshProfile(serverNode, margin)
 					}
-					_ = SendSocksResponse(c, err, nil)
-					return
 				}
-
-				_ = SendSocksResponse(c, nil, remoteBoundAddr)
-				log.Printf("Client: Tunnel established to %s (ID: %d)", targetAddr, connID)
-
-				runTunnelWithPrefix(c, video, margin, connID, bestFPS, ch)
-			}(localConn)
+			case <-stateTicker.C:
+				// Сервер потерян: переподключаемся с возобновлением,
+				// потоки при этом живут до истечения stream_grace
+				if sess.Check(hbInterval) == stateLost {
+					log.Printf("Client: Server lost, re-syncing")
+					break Session
+				}
+			case <-ticker.C:
+				fpsMetrics, ms := getPerfMetrics()
+				hbSeq++
+				hb := HeartbeatData{
+					FPS:          fpsMetrics,
+					ProcessingMS: ms,
+					Timestamp:    time.Now().Unix(),
+					TargetFPS:    rateCtl.FPS(),
+					ReceivedFPS:  getRecvFPS(),
+					Ready:        true,
+					SessionID:    video.SessionID,
+					Seq:          hbSeq,
+				}
+				sendControlPacket(encodeControl(typeHeartbeat, &hb, sessionVersion()), margin)
+				recordSentPacket(typeHeartbeat)
+			}
 		}
-		close(stopSession)
-		ln.Close()
-		time.Sleep(1 * time.Second)
+		ticker.Stop()
+		stateTicker.Stop()
 	}
 }
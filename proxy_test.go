@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// linkDispatchers соединяет два диспетчера через frameSink: кадры с полем margin
+// стороны a доставляются в b и наоборот. drop, если задан, решает, потерять ли кадр.
+func linkDispatchers(t *testing.T, a, b *PacketDispatcher, marginA int, drop func() bool) {
+	t.Helper()
+	rateCtl.Reset(rcMaxFPS)
+	var (
+		mu     sync.Mutex
+		closed bool
+		wg     sync.WaitGroup
+	)
+	sink := func(frame []byte, margin int) {
+		mu.Lock()
+		lost := closed || (drop != nil && drop())
+		if !lost {
+			wg.Add(1)
+		}
+		mu.Unlock()
+		if lost {
+			return
+		}
+		to := a
+		if margin == marginA {
+			to = b
+		}
+		frame = append([]byte(nil), frame...)
+		go func() {
+			defer wg.Done()
+			to.DispatchFrame(frame)
+		}()
+	}
+	frameSink.Store(&sink)
+	// DispatchFrame читает глобальные настройки, которые тесты восстанавливают в своих
+	// Cleanup: дожидаемся кадров в пути и только потом отключаем связь
+	t.Cleanup(func() {
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		wg.Wait()
+		frameSink.Store(nil)
+	})
+}
+
+// tcpPair возвращает два конца локального TCP-соединения.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func TestAllocateSkipsLiveAndQuarantinedIDs(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	seen := make(map[uint16]bool)
+	for i := 0; i < 1000; i++ {
+		id, _, _, err := pd.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 0 || seen[id] {
+			t.Fatalf("allocation %d returned duplicate or zero ID %d", i, id)
+		}
+		seen[id] = true
+	}
+
+	id, epoch, _, _ := pd.Allocate()
+	pd.Unregister(id, epoch)
+	for i := 0; i < 2000; i++ {
+		next, e, _, _ := pd.Allocate()
+		if next == id {
+			t.Fatalf("quarantined ID %d reused", id)
+		}
+		pd.Unregister(next, e)
+	}
+
+	// После карантина ID снова доступен, но уже со следующей эпохой
+	pd.mu.Lock()
+	delete(pd.closedIDs, id)
+	for other := 1; other <= 65535; other++ {
+		if uint16(other) != id {
+			pd.connChannels[uint16(other)] = &connEntry{}
+		}
+	}
+	pd.mu.Unlock()
+	next, nextEpoch, _, err := pd.Allocate()
+	if err != nil || next != id || nextEpoch != epoch+1 {
+		t.Fatalf("expected ID %d epoch %d, got %d epoch %d (err %v)", id, epoch+1, next, nextEpoch, err)
+	}
+	if _, _, _, err := pd.Allocate(); err == nil {
+		t.Fatal("expected exhaustion error")
+	}
+}
+
+func TestDispatchDropsStaleEpoch(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	ch := pd.Register(42, 5)
+
+	pd.Dispatch([]byte{typeNack, 0, 42, 4, 1})
+	pd.Dispatch([]byte{typeNack, 0, 42, 5, 2})
+
+	select {
+	case p := <-ch:
+		if p[4] != 2 {
+			t.Fatalf("stale packet delivered: %v", p)
+		}
+	default:
+		t.Fatal("current packet not delivered")
+	}
+	select {
+	case p := <-ch:
+		t.Fatalf("unexpected packet %v", p)
+	default:
+	}
+
+	// Unregister чужой эпохи не должен снимать новое соединение
+	pd.Unregister(42, 4)
+	if e, ok := pd.Lookup(42); !ok || e != 5 {
+		t.Fatalf("connection unregistered by stale epoch")
+	}
+}
+
+func TestEvictFreesIDForNewEpoch(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	old := pd.Register(7, 1)
+	pd.Evict(7)
+	pd.Register(7, 2)
+
+	select {
+	case p := <-old:
+		if p[0] != typeDisconnect || p[3] != 1 {
+			t.Fatalf("unexpected packet %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("evicted stream did not get DISCONNECT")
+	}
+	if e, _ := pd.Lookup(7); e != 2 {
+		t.Fatalf("expected epoch 2, got %d", e)
+	}
+}
+
+func TestEvictQuarantinesAndExpires(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	pd.Register(7, 1)
+	pd.mu.RLock()
+	e := pd.connChannels[7]
+	pd.mu.RUnlock()
+	pd.Evict(7)
+
+	select {
+	case <-e.done:
+	default:
+		t.Fatal("evicted entry is not marked done")
+	}
+	pd.mu.RLock()
+	_, closed := pd.closedIDs[7]
+	pd.mu.RUnlock()
+	if !closed {
+		t.Fatal("evicted ID is not quarantined")
+	}
+
+	// После карантина ID и его эпоха забываются, живые соединения не трогаются
+	pd.Register(8, 3)
+	pd.expireClosedIDs(time.Now().Add(connIDQuarantine + time.Second))
+	pd.mu.RLock()
+	_, closed = pd.closedIDs[7]
+	_, epoch7 := pd.epochs[7]
+	_, epoch8 := pd.epochs[8]
+	pd.mu.RUnlock()
+	if closed || epoch7 {
+		t.Fatal("expired ID kept its quarantine or epoch")
+	}
+	if !epoch8 {
+		t.Fatal("epoch of a live connection was dropped")
+	}
+}
+
+func TestDispatchKeepsStreamOnQueueOverflow(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	stalled := pd.Register(1, 3)
+	live := pd.Register(2, 3)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= cap(stalled); i++ {
+			pd.Dispatch([]byte{typeData, 0, 1, 3, byte(i)})
+		}
+		pd.Dispatch([]byte{typeData, 0, 2, 3, 1})
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dispatcher blocked on a full stream queue")
+	}
+	if _, ok := pd.Lookup(1); !ok {
+		t.Fatal("stream was torn down because of a full queue")
+	}
+	if n := pd.Overflows(); n != 1 {
+		t.Fatalf("overflows = %d, want 1", n)
+	}
+	if p := <-live; p[4] != 1 {
+		t.Fatalf("other stream got %x", p)
+	}
+	// В очереди остаются данные в исходном порядке, без подставленного DISCONNECT
+	for i := 0; len(stalled) > 0; i++ {
+		if p := <-stalled; p[0] != typeData || p[4] != byte(i) {
+			t.Fatalf("queued packet %d = %x", i, p)
+		}
+	}
+}
+
+func TestDispatchDropsDatagramsWhenQueueFull(t *testing.T) {
+	pd := NewPacketDispatcher(10)
+	ch := pd.Register(9, 3)
+	done := make(chan struct{})
+	go func() {
+		// Очередь на 1024 пакета: лишние датаграммы отбрасываются, диспетчер не блокируется
+		for i := 0; i < 2000; i++ {
+			pd.Dispatch([]byte{typeDatagram, 0, 9, 3, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatcher blocked on a full datagram queue")
+	}
+	if len(ch) != cap(ch) {
+		t.Fatalf("expected full queue, got %d of %d", len(ch), cap(ch))
+	}
+}
+
+func TestConnAckRoundTrip(t *testing.T) {
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 2121},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 53},
+	} {
+		p := connAckPayload(typeBindAccept, 300, 9, socks5RespSuccess, addr)
+		if p[0] != typeBindAccept || p[1] != 1 || p[2] != 44 || p[3] != 9 {
+			t.Fatalf("bad header %v", p[:connHeaderLen])
+		}
+		status, got := parseConnAck(p)
+		if status != socks5RespSuccess || got == nil || got.String() != addr.String() {
+			t.Errorf("%v: got status %d addr %v", addr, status, got)
+		}
+	}
+	status, got := parseConnAck(connAckPayload(typeConnAck, 1, 1, socks5RespConnRefused, nil))
+	if status != socks5RespConnRefused || got.String() != "0.0.0.0:0" {
+		t.Errorf("got status %d addr %v", status, got)
+	}
+}
+
+func TestBindListenExpectsTarget(t *testing.T) {
+	ln, peer, err := bindListen("127.0.0.1:21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if !peer.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected peer 127.0.0.1, got %v", peer)
+	}
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("expected listener on loopback, got %v", ip)
+	}
+
+	ln, peer, err = bindListen("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if peer != nil {
+		t.Errorf("unspecified target must accept any peer, got %v", peer)
+	}
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	pdA, pdB := NewPacketDispatcher(10), NewPacketDispatcher(11)
+	// Теряется каждый пятый кадр, в том числе FIN и подтверждения
+	frames := 0
+	linkDispatchers(t, pdA, pdB, 10, func() bool {
+		frames++
+		return frames%5 == 0
+	})
+	appA, tunA := tcpPair(t)
+	appB, tunB := tcpPair(t)
+	done := make(chan struct{}, 2)
+	go func() {
+		runTunnelWithPrefix(tunA, nil, 10, 1, 7, prioNormal, pdA.Register(1, 7))
+		done <- struct{}{}
+	}()
+	go func() {
+		runTunnelWithPrefix(tunB, nil, 11, 1, 7, prioNormal, pdB.Register(1, 7))
+		done <- struct{}{}
+	}()
+
+	req := make([]byte, 20000)
+	rand.Read(req)
+	resp := make([]byte, 10000)
+	rand.Read(resp)
+
+	go func() {
+		appA.Write(req)
+		appA.CloseWrite()
+	}()
+	// EOF на B означает, что FIN дошел и превратился в CloseWrite
+	got, err := io.ReadAll(appB)
+	if err != nil || !bytes.Equal(got, req) {
+		t.Fatalf("B got %d bytes (err %v), want %d", len(got), err, len(req))
+	}
+	// Обратное направление продолжает работать после half-close
+	go func() {
+		appB.Write(resp)
+		appB.CloseWrite()
+	}()
+	got, err = io.ReadAll(appA)
+	if err != nil || !bytes.Equal(got, resp) {
+		t.Fatalf("A got %d bytes (err %v), want %d", len(got), err, len(resp))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			t.Fatal("tunnel did not close after both directions finished")
+		}
+	}
+}
+
+func TestTunnelFinLostClosesAfterRetries(t *testing.T) {
+	rateCtl.Reset(rcMaxFPS)
+	pd := NewPacketDispatcher(10)
+	// Удаленной стороны нет: кадры туннеля только просматриваются
+	fins := make(chan byte, 64)
+	sink := func(frame []byte, margin int) {
+		if len(frame) >= dataHeaderLen && frame[0] == typeData && frame[7]&flagFin != 0 {
+			select {
+			case fins <- frame[4]:
+			default:
+			}
+		}
+	}
+	frameSink.Store(&sink)
+	t.Cleanup(func() { frameSink.Store(nil) })
+
+	app, tun := tcpPair(t)
+	ch := pd.Register(1, 7)
+	done := make(chan struct{})
+	go func() {
+		runTunnelWithPrefix(tun, nil, 10, 1, 7, prioNormal, ch)
+		close(done)
+	}()
+
+	app.CloseWrite()
+	var finSeq byte
+	select {
+	case finSeq = <-fins:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FIN was not sent")
+	}
+	// FIN удаленной стороны без подтверждения нашего
+	pd.Dispatch([]byte{typeData, 0, 1, 7, 1, 0, recvWindow, flagFin})
+	if _, err := io.ReadAll(app); err != nil {
+		t.Fatalf("remote FIN not propagated: %v", err)
+	}
+	// NACK ускоряет повторы FIN вместо ожидания таймаута ретрансляции
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			if i < finMaxRetries {
+				t.Fatalf("tunnel closed after %d FIN retries, want at least %d", i, finMaxRetries)
+			}
+			return
+		case <-fins:
+			pd.Dispatch([]byte{typeNack, 0, 1, 7, finSeq})
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel kept waiting for the lost FIN")
+		}
+	}
+}
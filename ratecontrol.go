@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	rcMinFPS         = 1
+	rcMaxFPS         = 30
+	rcMinBlockSize   = 4
+	rcMaxBlockSize   = 12
+	rcUpdateInterval = 2 * time.Second
+	rcBlockHold      = 10 * time.Second
+)
+
+// RateController совместно выбирает FPS и размер блока (полезную нагрузку кадра)
+// по измерениям скорости доставки, потерь и RTT.
+//
+// Логика разделяет два вида деградации:
+//   - кадры не доходят (удаленная сторона подтверждает меньший FPS, растет RTT) — снижаем FPS;
+//   - кадры доходят, но битые (растут ретрансляции) — увеличиваем размер блока.
+//
+// Сразу после калибровки контроллер находится в режиме быстрого разгона (startup),
+// который заканчивается при первом признаке перегрузки.
+type RateController struct {
+	mu sync.Mutex
+
+	fps     float64
+	startup bool
+
+	// Окно измерений между обновлениями
+	sent        int
+	retransmits int
+	remoteFPS   int
+	haveRemote  bool
+
+	lossEWMA float64
+	srtt     time.Duration
+	minRTT   time.Duration
+
+	lastUpdate      time.Time
+	lastBlockChange time.Time
+}
+
+// rateCtl — общий контроллер скорости для видеоканала (все туннели делят один канал).
+var rateCtl = NewRateController(5)
+
+func NewRateController(fps int) *RateController {
+	rc := &RateController{}
+	rc.reset(fps)
+	return rc
+}
+
+// Reset задает стартовую точку после калибровки.
+func (rc *RateController) Reset(fps int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.reset(fps)
+	log.Printf("Rate: Reset to %d FPS, blockSize %d", int(rc.fps), GetBlockSize())
+}
+
+func (rc *RateController) reset(fps int) {
+	rc.fps = clampFloat(float64(fps), rcMinFPS, rcMaxFPS)
+	rc.startup = true
+	rc.sent = 0
+	rc.retransmits = 0
+	rc.remoteFPS = 0
+	rc.haveRemote = false
+	rc.lossEWMA = 0
+	rc.srtt = 0
+	rc.minRTT = 0
+	rc.lastUpdate = time.Now()
+	rc.lastBlockChange = time.Now()
+}
+
+// FPS возвращает текущую целевую частоту отправки кадров.
+func (rc *RateController) FPS() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return int(rc.fps)
+}
+
+// RemoteFPS возвращает последний подтвержденный удаленной стороной FPS (0 — нет данных).
+func (rc *RateController) RemoteFPS() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.remoteFPS
+}
+
+// Probing сообщает, что контроллер разгоняется и ему нужна частая обратная связь.
+func (rc *RateController) Probing() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.startup
+}
+
+// LossRate возвращает сглаженную долю ретрансляций.
+func (rc *RateController) LossRate() float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.lossEWMA
+}
+
+// OnSent учитывает отправку нового пакета данных.
+func (rc *RateController) OnSent() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.sent++
+}
+
+// OnRetransmit учитывает повторную отправку пакета.
+func (rc *RateController) OnRetransmit() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.retransmits++
+}
+
+// OnRTT учитывает время подтверждения пакета, отправленного без повторов.
+func (rc *RateController) OnRTT(d time.Duration) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.srtt == 0 {
+		rc.srtt = d
+	} else {
+		rc.srtt = (7*rc.srtt + d) / 8
+	}
+	if rc.minRTT == 0 || d < rc.minRTT {
+		rc.minRTT = d
+	}
+}
+
+// OnRemoteFPS принимает FPS, который удаленная сторона подтвердила в heartbeat.
+func (rc *RateController) OnRemoteFPS(n int) {
+	rc.onFeedback(n, time.Now())
+}
+
+func (rc *RateController) onFeedback(n int, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if n > 0 {
+		rc.remoteFPS = n
+		rc.haveRemote = true
+	}
+	if now.Sub(rc.lastUpdate) < rcUpdateInterval {
+		return
+	}
+	rc.update(now)
+}
+
+func (rc *RateController) update(now time.Time) {
+	if rc.sent > 0 {
+		loss := float64(rc.retransmits) / float64(rc.sent)
+		if loss > 1 {
+			loss = 1
+		}
+		rc.lossEWMA = 0.7*rc.lossEWMA + 0.3*loss
+	}
+	delivery := 1.0
+	if rc.haveRemote && rc.fps > 0 {
+		delivery = float64(rc.remoteFPS) / rc.fps
+	}
+	rttInflated := rc.minRTT > 0 && rc.srtt > 2*rc.minRTT+200*time.Millisecond
+
+	oldFPS, oldBS := int(rc.fps), GetBlockSize()
+	bs := oldBS
+	canChangeBlock := now.Sub(rc.lastBlockChange) >= rcBlockHold
+
+	switch {
+	case delivery < 0.7 || rttInflated:
+		// Кадры теряются или копятся в очереди: плавно снижаем FPS к подтвержденному значению
+		rc.startup = false
+		target := rc.fps * 0.8
+		if rc.haveRemote && float64(rc.remoteFPS) < target {
+			target = float64(rc.remoteFPS)
+			if target < rc.fps*0.5 {
+				target = rc.fps * 0.5
+			}
+		}
+		rc.fps = target
+	case rc.lossEWMA > 0.15:
+		// Кадры доходят, но повреждаются: укрупняем блок, FPS слегка снижаем
+		rc.startup = false
+		if canChangeBlock && bs < rcMaxBlockSize {
+			bs += 2
+		} else {
+			rc.fps *= 0.9
+		}
+	case rc.lossEWMA < 0.02 && delivery >= 0.9:
+		// Канал справляется: разгоняемся
+		if rc.startup {
+			rc.fps *= 1.5
+		} else if canChangeBlock && bs > rcMinBlockSize && rc.lossEWMA < 0.01 {
+			bs--
+		} else {
+			rc.fps++
+		}
+	}
+
+	rc.fps = clampFloat(rc.fps, rcMinFPS, rcMaxFPS)
+	if bs > rcMaxBlockSize {
+		bs = rcMaxBlockSize
+	}
+	if bs != oldBS {
+		SetBlockSize(bs)
+		rc.lastBlockChange = now
+	}
+	if int(rc.fps) != oldFPS || bs != oldBS {
+		log.Printf("Rate: FPS %d -> %d, blockSize %d -> %d (loss=%.2f, delivery=%.2f, srtt=%v)",
+			oldFPS, int(rc.fps), oldBS, bs, rc.lossEWMA, delivery, rc.srtt)
+	}
+
+	rc.sent = 0
+	rc.retransmits = 0
+	rc.lastUpdate = now
+}
+
+func clampFloat(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
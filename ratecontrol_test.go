@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setTestBlockSize задает глобальный размер блока на время теста.
+func setTestBlockSize(t *testing.T, s int) {
+	prev := GetBlockSize()
+	t.Cleanup(func() { SetBlockSize(prev) })
+	SetBlockSize(s)
+}
+
+func TestRateControllerStartupRamp(t *testing.T) {
+	setTestBlockSize(t, 6)
+	rc := NewRateController(10)
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		rc.OnSent()
+		rc.onFeedback(rc.FPS(), now.Add(time.Duration(i)*rcUpdateInterval))
+	}
+	if rc.FPS() != rcMaxFPS {
+		t.Errorf("Expected fast ramp to %d FPS after calibration, got %d", rcMaxFPS, rc.FPS())
+	}
+	if !rc.Probing() {
+		t.Error("Controller should stay in startup while the channel keeps up")
+	}
+}
+
+func TestRateControllerBackoffOnDelivery(t *testing.T) {
+	setTestBlockSize(t, 6)
+	rc := NewRateController(20)
+	now := time.Now().Add(rcUpdateInterval)
+	rc.onFeedback(8, now)
+	if fps := rc.FPS(); fps != 10 {
+		t.Errorf("Expected smooth backoff to half rate (10), got %d", fps)
+	}
+	if rc.Probing() {
+		t.Error("Startup should end on congestion")
+	}
+	if GetBlockSize() != 6 {
+		t.Errorf("Frame loss should not change block size, got %d", GetBlockSize())
+	}
+}
+
+func TestRateControllerBlockSizeOnCorruption(t *testing.T) {
+	setTestBlockSize(t, 6)
+	rc := NewRateController(10)
+	now := time.Now().Add(rcBlockHold)
+	for i := 0; i < 10; i++ {
+		rc.OnSent()
+		rc.OnRetransmit()
+	}
+	rc.onFeedback(10, now)
+	if GetBlockSize() != 8 {
+		t.Errorf("Expected block size to grow to 8 on corrupted frames, got %d", GetBlockSize())
+	}
+	if rc.FPS() != 10 {
+		t.Errorf("FPS should be kept when frames are delivered, got %d", rc.FPS())
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Защита от повтора пакетов. Каждый пакет несет монотонный счетчик отправителя:
+// зашифрованные — счетчик кадров в обертке typeSealed (свой на каждый ключ сессии),
+// синхропакеты — поле tagControlCounter, остальные открытые пакеты — обертку
+// [typeCounted][счетчик 8][пакет] (если удаленная сторона поддерживает capCounted).
+// Начальные значения двух последних счетчиков берутся из часов, чтобы они росли и между
+// перезапусками. Диспетчер (DispatchFrame через openPacket) принимает каждый счетчик
+// один раз в пределах окна replayWindowSize; все отвергнутые пакеты попадают в статистику.
+//
+// Новая сессия удаленной стороны принимается, только если ее счетчик не старше
+// наибольшего виденного более чем на replayClockSkew: так отвергаются записанные
+// пакеты прошлых сессий, а небольшой сдвиг часов при перезапуске допустим.
+//
+// Повтор последнего принятого счетчика — обычно тот же кадр, захваченный с экрана еще раз;
+// такие пакеты считаются отдельно от настоящих повторов.
+
+const (
+	replayWindowSize = 64
+	// Сколько сессий удаленной стороны помнить для проверки синхропакетов
+	replaySessions  = 16
+	replayClockSkew = 10 * time.Minute
+)
+
+// replayWindow — скользящее окно принятых счетчиков.
+type replayWindow struct {
+	mu     sync.Mutex
+	top    uint64
+	bitmap uint64 // Бит i — принят счетчик top-i
+	seen   bool
+}
+
+// Check принимает счетчик. dup сообщает, что отвергнут повтор последнего принятого.
+func (w *replayWindow) Check(ctr uint64) (ok, dup bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.seen {
+		w.seen, w.top, w.bitmap = true, ctr, 1
+		return true, false
+	}
+	if ctr > w.top {
+		shift := ctr - w.top
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.top = ctr
+		return true, false
+	}
+	off := w.top - ctr
+	if off >= replayWindowSize || w.bitmap&(1<<off) != 0 {
+		return false, off == 0
+	}
+	w.bitmap |= 1 << off
+	return true, false
+}
+
+var syncCounter, plainCounter atomic.Uint64
+
+func init() {
+	syncCounter.Store(uint64(time.Now().UnixNano()))
+	plainCounter.Store(uint64(time.Now().UnixNano()))
+}
+
+const countedHeaderLen = 1 + 8
+
+// wrapCounted оборачивает открытый пакет в typeCounted с очередным значением счетчика.
+func wrapCounted(p []byte) []byte {
+	out := make([]byte, 0, countedHeaderLen+len(p))
+	out = append(out, typeCounted)
+	out = binary.BigEndian.AppendUint64(out, plainCounter.Add(1))
+	return append(out, p...)
+}
+
+// appendControlCounter добавляет к управляющему сообщению очередное значение счетчика.
+func appendControlCounter(p []byte) []byte {
+	out := make([]byte, 0, len(p)+2+8)
+	out = append(out, p...)
+	out = append(out, tagControlCounter, 8)
+	return binary.BigEndian.AppendUint64(out, syncCounter.Add(1))
+}
+
+var (
+	replayMu       sync.Mutex
+	syncWindows    = make(map[int64]*replayWindow)
+	syncWindowLRU  []int64
+	syncTop        uint64
+	replayRejected int
+	dupRejected    int
+
+	// Окно открытых пакетов текущей сессии удаленной стороны
+	plainWindow = &replayWindow{}
+	plainSID    int64
+	plainFloor  uint64
+)
+
+// checkControlReplay проверяет счетчик синхропакета в окне его сессии. Пакеты без
+// счетчика (узлы без защиты от повтора) пропускаются.
+func checkControlReplay(p []byte) bool {
+	var sid int64
+	var ctr uint64
+	var hasCtr bool
+	if parseControl(p[1:], func(tag byte, v []byte) {
+		switch tag {
+		case tagSyncSessionID:
+			sid = tlvID(v)
+		case tagControlCounter:
+			if len(v) == 8 {
+				ctr, hasCtr = binary.BigEndian.Uint64(v), true
+			}
+		}
+	}) != nil || !hasCtr {
+		return true
+	}
+
+	replayMu.Lock()
+	w, ok := syncWindows[sid]
+	if !ok && ctr+uint64(replayClockSkew) < syncTop {
+		replayMu.Unlock()
+		return recordReplayCheck(false, false)
+	}
+	if ctr > syncTop {
+		syncTop = ctr
+	}
+	if !ok {
+		w = &replayWindow{}
+		syncWindows[sid] = w
+		syncWindowLRU = append(syncWindowLRU, sid)
+		if len(syncWindowLRU) > replaySessions {
+			delete(syncWindows, syncWindowLRU[0])
+			syncWindowLRU = syncWindowLRU[1:]
+		}
+	}
+	replayMu.Unlock()
+	return recordReplayCheck(w.Check(ctr))
+}
+
+// resetPlainReplay начинает окно открытых пакетов для сессии sid удаленной стороны.
+// Повторная синхронизация той же сессии окно не сбрасывает.
+func resetPlainReplay(sid int64) {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if sid == plainSID {
+		return
+	}
+	plainWindow.mu.Lock()
+	if top := plainWindow.top; top > plainFloor+uint64(replayClockSkew) {
+		plainFloor = top - uint64(replayClockSkew)
+	}
+	plainWindow.mu.Unlock()
+	plainSID = sid
+	plainWindow = &replayWindow{}
+}
+
+// checkPlainReplay проверяет счетчик пакета typeCounted.
+func checkPlainReplay(ctr uint64) bool {
+	replayMu.Lock()
+	w, floor := plainWindow, plainFloor
+	replayMu.Unlock()
+	if ctr < floor {
+		return recordReplayCheck(false, false)
+	}
+	return recordReplayCheck(w.Check(ctr))
+}
+
+// recordReplayCheck учитывает отвергнутые пакеты в статистике.
+func recordReplayCheck(ok, dup bool) bool {
+	if ok {
+		return true
+	}
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	if dup {
+		dupRejected++
+	} else {
+		replayRejected++
+	}
+	return false
+}
+
+// getReplayStatsAndReset возвращает число отвергнутых повторов и повторных захватов кадра.
+func getReplayStatsAndReset() (replays, dups int) {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	replays, dups = replayRejected, dupRejected
+	replayRejected, dupRejected = 0, 0
+	return replays, dups
+}
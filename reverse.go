@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Обратная переадресация портов (как ssh -R).
+//
+// Правило клиента "-reverse 8080=127.0.0.1:80" просит сервер слушать порт 8080 и
+// передавать принятые соединения через туннель на 127.0.0.1:80 со стороны клиента.
+// Клиент регистрирует правило пакетом CONNECT с командой cmdReverseListen и адресом
+// слушателя; сервер держит порт открытым, пока жив этот поток. На каждое входящее
+// соединение сервер сам отправляет CONNECT клиенту (ID из диапазона serverIDMin) с
+// адресом слушателя в качестве назначения. Клиент соединяется только с адресами из
+// своих правил, поэтому сервер не может открыть через него произвольное соединение.
+//
+// Сервер открывает только адреса из списка reverse_allow своего конфига; без списка
+// обратная переадресация выключена. Остальные регистрации получают ответ 0x02.
+
+const (
+	// cmdReverseListen — команда CONNECT для регистрации обратного правила. Команды
+	// от 0x80 внутренние для туннеля и не пересекаются с командами SOCKS5.
+	cmdReverseListen = 0x80
+
+	reverseRetryInterval = 10 * time.Second
+)
+
+var (
+	reverseMu        sync.Mutex
+	reverseListeners = make(map[string]net.Listener) // Адрес правила -> слушатель сервера
+)
+
+// reverseAllowed проверяет адрес слушателя по списку reverse_allow конфига сервера.
+// Адрес без узла (все интерфейсы) должен быть указан в списке как 0.0.0.0 или ::.
+func reverseAllowed(addr string) bool {
+	if currentCfg == nil || len(currentCfg.ReverseAllow) == 0 {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if host == "" {
+		ip = net.IPv4zero
+		host = ip.String()
+	}
+	for i := range currentCfg.ReverseAllow {
+		if currentCfg.ReverseAllow[i].matches(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseListen открывает на сервере порт обратного правила, если адрес разрешен
+// конфигом. Слушатель прежней регистрации того же адреса (клиент перезапустился)
+// закрывается.
+func reverseListen(addr string) (net.Listener, error) {
+	if !reverseAllowed(addr) {
+		log.Printf("Server: Reverse forward on %s denied, address is not in reverse_allow", addr)
+		return nil, fmt.Errorf("reverse forward: %s: %w", addr, errSocksNotAllowed)
+	}
+	reverseMu.Lock()
+	defer reverseMu.Unlock()
+	if old, ok := reverseListeners[addr]; ok {
+		log.Printf("Server: Reverse forward %s registered again, closing previous listener", addr)
+		old.Close()
+		delete(reverseListeners, addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	reverseListeners[addr] = ln
+	return ln, nil
+}
+
+// runReverseListener принимает соединения обратного правила, пока клиент держит поток
+// регистрации, и открывает для каждого соединение на клиенте.
+func runReverseListener(ln net.Listener, rule string, pd *PacketDispatcher, video *ScreenVideoConn, margin int, connID uint16, epoch byte, incoming chan []byte) {
+	defer func() {
+		reverseMu.Lock()
+		if reverseListeners[rule] == ln {
+			delete(reverseListeners, rule)
+		}
+		reverseMu.Unlock()
+		ln.Close()
+	}()
+	log.Printf("Server: Reverse forward %d listening on %s", connID, ln.Addr())
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveReverseConn(c, rule, pd, video, margin)
+		}
+	}()
+
+	for {
+		select {
+		case data := <-incoming:
+			if data[0] == typeDisconnect {
+				log.Printf("Server: Reverse forward %d on %s closed by client", connID, rule)
+				return
+			}
+		case <-stopped:
+			log.Printf("Server: Reverse forward %d on %s stopped listening", connID, rule)
+			sendControlPacket([]byte{typeDisconnect, byte(connID >> 8), byte(connID), epoch}, margin)
+			recordSentPacket(typeDisconnect)
+			return
+		}
+	}
+}
+
+// serveReverseConn передает входящее соединение сервера клиенту.
+func serveReverseConn(c net.Conn, rule string, pd *PacketDispatcher, video *ScreenVideoConn, margin int) {
+	defer c.Close()
+	prio := priorityForTarget(rule)
+	connID, epoch, ch, _, err := openStream(pd, margin, socks5CmdConnect, rule, prio)
+	if err != nil {
+		log.Printf("Server: Reverse forward %s from %s failed: %v", rule, c.RemoteAddr(), err)
+		return
+	}
+	defer pd.Unregister(connID, epoch)
+
+	log.Printf("Server: Reverse tunnel established from %s (ID: %d)", c.RemoteAddr(), connID)
+	runTunnelWithPrefix(c, video, margin, connID, epoch, prio, ch)
+}
+
+// maintainReverse держит регистрацию правила на сервере и повторяет ее после разрыва.
+func maintainReverse(rule ForwardRule, pd *PacketDispatcher, margin int) {
+	warned := false
+	for {
+		if !peerSupports(capReverse) {
+			if !warned {
+				log.Printf("Client: Reverse forward %s waiting, server does not support it", rule)
+				warned = true
+			}
+			time.Sleep(reverseRetryInterval)
+			continue
+		}
+		warned = false
+		connID, epoch, ch, bound, err := openStream(pd, margin, cmdReverseListen, rule.Listen, prioNormal)
+		if err != nil {
+			log.Printf("Client: Reverse forward %s not registered: %v", rule, err)
+			time.Sleep(reverseRetryInterval)
+			continue
+		}
+		log.Printf("Client: Reverse forward %d: server listening on %v for %s", connID, bound, rule.Target)
+		for data := range ch {
+			if data[0] == typeDisconnect {
+				break
+			}
+		}
+		pd.Unregister(connID, epoch)
+		log.Printf("Client: Reverse forward %d for %s closed, registering again", connID, rule)
+		time.Sleep(reverseRetryInterval)
+	}
+}
+
+// findReverseRule возвращает правило с данным адресом слушателя сервера.
+func findReverseRule(rules []ForwardRule, listen string) (ForwardRule, bool) {
+	for _, r := range rules {
+		if r.Listen == listen {
+			return r, true
+		}
+	}
+	return ForwardRule{}, false
+}
+
+// serveReverseConnects обрабатывает CONNECT сервера на клиенте: соединяется с адресом
+// назначения правила и отвечает CONNACK.
+func serveReverseConnects(pd *PacketDispatcher, video *ScreenVideoConn, margin int, rules []ForwardRule) {
+	var pendingMu sync.Mutex
+	pending := make(map[uint16]byte)
+
+	for data := range pd.connectCh {
+		if len(data) < connHeaderLen+2 {
+			continue
+		}
+		go func(data []byte) {
+			connID := uint16(data[1])<<8 | uint16(data[2])
+			epoch := data[3]
+			cmd := data[4]
+			prio := data[5]
+			listen := strings.TrimRight(string(data[6:]), "\x00")
+			if connID < serverIDMin {
+				return
+			}
+
+			// Повтор CONNECT той же эпохи подтверждаем еще раз
+			activeEpoch, active := pd.Lookup(connID)
+			if active && activeEpoch == epoch {
+				sendControlPacket(connAckPayload(typeConnAck, connID, epoch, socks5RespSuccess, nil), margin)
+				recordSentPacket(typeConnAck)
+				return
+			}
+			if active {
+				pd.Evict(connID)
+			}
+			pendingMu.Lock()
+			if _, ok := pending[connID]; ok {
+				pendingMu.Unlock()
+				return
+			}
+			pending[connID] = epoch
+			pendingMu.Unlock()
+			release := func() {
+				pendingMu.Lock()
+				delete(pending, connID)
+				pendingMu.Unlock()
+			}
+
+			rule, ok := findReverseRule(rules, listen)
+			if !ok || cmd != socks5CmdConnect {
+				log.Printf("Client: Rejecting reverse CONNECT %d for unknown rule %q (command: %d)", connID, listen, cmd)
+				release()
+				sendControlPacket(connAckPayload(typeConnAck, connID, epoch, socks5RespNotAllowed, nil), margin)
+				recordSentPacket(typeConnAck)
+				return
+			}
+			log.Printf("Client: Decoded reverse CONNECT to %s (ID: %d, epoch: %d)", rule.Target, connID, epoch)
+			conn, err := net.DialTimeout("tcp", rule.Target, 10*time.Second)
+			if err != nil {
+				log.Printf("Client: Reverse dial failed to %s: %v", rule.Target, err)
+				release()
+				sendControlPacket(connAckPayload(typeConnAck, connID, epoch, socksReplyCode(err), nil), margin)
+				recordSentPacket(typeConnAck)
+				return
+			}
+			defer conn.Close()
+
+			// Регистрируем до CONNACK: данные сервера могут прийти сразу за ним
+			ch := pd.Register(connID, epoch)
+			release()
+			defer pd.Unregister(connID, epoch)
+			sendControlPacket(connAckPayload(typeConnAck, connID, epoch, socks5RespSuccess, conn.LocalAddr()), margin)
+			recordSentPacket(typeConnAck)
+			runTunnelWithPrefix(conn, video, margin, connID, epoch, prio, ch)
+		}(data)
+	}
+}
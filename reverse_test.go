@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAllocateIDRangesDoNotOverlap(t *testing.T) {
+	client := NewPacketDispatcher(10)
+	server := NewPacketDispatcher(11)
+	server.serverIDs = true
+	for i := 0; i < 2000; i++ {
+		if id, _, _, err := client.Allocate(); err != nil || id == 0 || id >= serverIDMin {
+			t.Fatalf("client allocated ID %d (err %v)", id, err)
+		}
+		if id, _, _, err := server.Allocate(); err != nil || id < serverIDMin {
+			t.Fatalf("server allocated ID %d (err %v)", id, err)
+		}
+	}
+}
+
+func TestReverseListenReplacesPrevious(t *testing.T) {
+	defer withReverseAllow([]ExitRule{{Hosts: []string{"127.0.0.1"}}})()
+	first, err := reverseListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := reverseListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := first.Accept(); err == nil {
+		t.Fatal("previous listener for the same rule is still open")
+	}
+	reverseMu.Lock()
+	current := reverseListeners["127.0.0.1:0"]
+	delete(reverseListeners, "127.0.0.1:0")
+	reverseMu.Unlock()
+	if current != second {
+		t.Fatal("registry does not point to the new listener")
+	}
+}
+
+func TestFindReverseRule(t *testing.T) {
+	rules := []ForwardRule{
+		{Listen: "127.0.0.1:8080", Target: "127.0.0.1:80"},
+		{Listen: "0.0.0.0:2222", Target: "10.0.0.5:22"},
+	}
+	if r, ok := findReverseRule(rules, "0.0.0.0:2222"); !ok || r.Target != "10.0.0.5:22" {
+		t.Fatalf("got %+v, %v", r, ok)
+	}
+	// Клиент не соединяется с адресами вне своих правил
+	if _, ok := findReverseRule(rules, "127.0.0.1:22"); ok {
+		t.Fatal("unknown listener matched a rule")
+	}
+}
+
+// withReverseAllow подменяет список reverse_allow и возвращает функцию восстановления.
+func withReverseAllow(rules []ExitRule) func() {
+	prev := currentCfg
+	currentCfg = &Config{ReverseAllow: rules}
+	return func() { currentCfg = prev }
+}
+
+func TestReverseListenDeniedByDefault(t *testing.T) {
+	defer withReverseAllow(nil)()
+	if ln, err := reverseListen("127.0.0.1:0"); !errors.Is(err, errSocksNotAllowed) {
+		if ln != nil {
+			ln.Close()
+		}
+		t.Fatalf("reverse listen without reverse_allow: %v", err)
+	}
+}
+
+func TestReverseAllowed(t *testing.T) {
+	defer withReverseAllow([]ExitRule{
+		{Hosts: []string{"127.0.0.1"}, Ports: []int{8080, 8443}},
+		{Hosts: []string{"10.0.0.0/8"}},
+	})()
+	cases := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.0.1:22", false},
+		{"10.1.2.3:2222", true},
+		{"0.0.0.0:8080", false},
+		{":8080", false},
+		{"192.168.1.1:8080", false},
+		{"bad", false},
+	}
+	for _, c := range cases {
+		if got := reverseAllowed(c.addr); got != c.want {
+			t.Errorf("reverseAllowed(%q) = %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
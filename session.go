@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Состояние сессии с удаленной стороной, общее для клиента и сервера.
+//
+//	IDLE -> CALIBRATING -> ESTABLISHED <-> DEGRADED -> LOST
+//
+// Переходы между ESTABLISHED, DEGRADED и LOST определяются Heartbeat: каждый принятый
+// Heartbeat возвращает сессию в ESTABLISHED, пауза дольше sessionDegradedAfter
+// интервалов переводит ее в DEGRADED, дольше sessionLostAfter — в LOST. Клиент при
+// потере сервера запускает повторную синхронизацию, сервер замедляет захват и ждет ее.
+type SessionState int
+
+const (
+	stateIdle SessionState = iota
+	stateCalibrating
+	stateEstablished
+	stateDegraded
+	stateLost
+)
+
+const (
+	sessionDegradedAfter = 2
+	sessionLostAfter     = 3
+)
+
+var sessionStateNames = [...]string{"IDLE", "CALIBRATING", "ESTABLISHED", "DEGRADED", "LOST"}
+
+func (s SessionState) String() string {
+	if int(s) < len(sessionStateNames) {
+		return sessionStateNames[s]
+	}
+	return fmt.Sprintf("STATE(%d)", int(s))
+}
+
+type sessionMachine struct {
+	mu     sync.Mutex
+	role   string // Префикс логов: "Server" или "Client"
+	state  SessionState
+	since  time.Time
+	lastHB time.Time
+}
+
+// activeSession — сессия текущего режима, ее состояние показывается в окне отладки.
+var (
+	activeSessionMu sync.Mutex
+	activeSession   *sessionMachine
+)
+
+func newSessionMachine(role string) *sessionMachine {
+	m := &sessionMachine{role: role, since: time.Now()}
+	activeSessionMu.Lock()
+	activeSession = m
+	activeSessionMu.Unlock()
+	return m
+}
+
+// sessionStatus возвращает состояние текущей сессии для строки статуса.
+func sessionStatus() string {
+	activeSessionMu.Lock()
+	m := activeSession
+	activeSessionMu.Unlock()
+	if m == nil {
+		return stateIdle.String()
+	}
+	return m.State().String()
+}
+
+func (m *sessionMachine) State() SessionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Calibrated сообщает, что синхронизация завершена (сессия могла с тех пор ухудшиться).
+func (m *sessionMachine) Calibrated() bool {
+	return m.State() >= stateEstablished
+}
+
+// Set переводит сессию в состояние s и пишет переход в лог.
+func (m *sessionMachine) Set(s SessionState, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(s, reason)
+}
+
+func (m *sessionMachine) set(s SessionState, reason string) {
+	if s == m.state {
+		return
+	}
+	log.Printf("%s: Session %s -> %s after %v (%s)", m.role, m.state, s, time.Since(m.since).Round(time.Second), reason)
+	if s == stateEstablished {
+		// Синхронизация или возобновление начинают отсчет Heartbeat заново
+		m.lastHB = time.Now()
+	}
+	m.state = s
+	m.since = time.Now()
+}
+
+// Heartbeat отмечает Heartbeat удаленной стороны.
+func (m *sessionMachine) Heartbeat() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastHB = time.Now()
+	if m.state == stateDegraded || m.state == stateLost {
+		m.set(stateEstablished, "heartbeat received")
+	}
+}
+
+// Check переводит установленную сессию в DEGRADED или LOST по длительности
+// паузы в Heartbeat и возвращает текущее состояние.
+func (m *sessionMachine) Check(hbInterval time.Duration) SessionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state < stateEstablished {
+		return m.state
+	}
+	gap := time.Since(m.lastHB)
+	switch {
+	case gap > sessionLostAfter*hbInterval:
+		m.set(stateLost, fmt.Sprintf("no heartbeat for %v", gap.Round(time.Second)))
+	case gap > sessionDegradedAfter*hbInterval && m.state == stateEstablished:
+		m.set(stateDegraded, fmt.Sprintf("no heartbeat for %v", gap.Round(time.Second)))
+	}
+	return m.state
+}
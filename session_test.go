@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionMachineHeartbeatTransitions(t *testing.T) {
+	const hb = time.Second
+	m := newSessionMachine("Test")
+	if m.Check(hb) != stateIdle || m.Calibrated() {
+		t.Fatal("new session must be idle")
+	}
+	m.Set(stateCalibrating, "sync")
+	m.Set(stateEstablished, "sync complete")
+
+	if got := m.Check(hb); got != stateEstablished {
+		t.Fatalf("fresh session: got %s", got)
+	}
+	m.lastHB = time.Now().Add(-(sessionDegradedAfter*hb + time.Millisecond))
+	if got := m.Check(hb); got != stateDegraded {
+		t.Fatalf("expected DEGRADED, got %s", got)
+	}
+	m.lastHB = time.Now().Add(-(sessionLostAfter*hb + time.Millisecond))
+	if got := m.Check(hb); got != stateLost {
+		t.Fatalf("expected LOST, got %s", got)
+	}
+	if !m.Calibrated() {
+		t.Error("lost session keeps its calibration")
+	}
+	m.Heartbeat()
+	if got := m.Check(hb); got != stateEstablished {
+		t.Fatalf("heartbeat must restore the session, got %s", got)
+	}
+	if sessionStatus() != "ESTABLISHED" {
+		t.Errorf("status line shows %q", sessionStatus())
+	}
+}
+
+func TestSessionMachineCalibrationIgnoresHeartbeatGap(t *testing.T) {
+	m := newSessionMachine("Test")
+	m.Set(stateCalibrating, "sync")
+	m.lastHB = time.Now().Add(-time.Hour)
+	if got := m.Check(time.Second); got != stateCalibrating {
+		t.Fatalf("calibration must not time out by heartbeats, got %s", got)
+	}
+	// Завершение калибровки начинает отсчет Heartbeat заново
+	m.Set(stateEstablished, "sync complete")
+	if got := m.Check(time.Second); got != stateEstablished {
+		t.Fatalf("got %s right after sync", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 и SOCKS4a на том же слушателе, что и SOCKS5: версия определяется по первому
+// байту запроса. Поддерживаются CONNECT и BIND. Адрес 0.0.0.x (x != 0) означает
+// SOCKS4a: после USERID идет имя узла, которое разрешается на сервере, как и имена
+// в SOCKS5. В SOCKS4 нет пароля, поэтому при заданных socks_users такие запросы
+// отклоняются.
+
+const (
+	socks4Ver          = 0x04
+	socks4RespGranted  = 90
+	socks4RespRejected = 91
+	socks4MaxField     = 255 // Наибольшая длина USERID и имени узла
+)
+
+// readSocks4Request читает запрос SOCKS4 после байтов VN и CD.
+func readSocks4Request(conn net.Conn, cmd byte, users []SocksUser) (*SocksRequest, error) {
+	portIP := make([]byte, 6)
+	if _, err := io.ReadFull(conn, portIP); err != nil {
+		return nil, fmt.Errorf("read SOCKS4 request: %v", err)
+	}
+	userID, err := readSocks4String(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read SOCKS4 user ID: %v", err)
+	}
+	port := binary.BigEndian.Uint16(portIP[:2])
+	ip := net.IP(portIP[2:6])
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readSocks4String(conn); err != nil {
+			return nil, fmt.Errorf("read SOCKS4a host: %v", err)
+		}
+	}
+
+	req := &SocksRequest{Version: socks4Ver, Cmd: cmd, Target: net.JoinHostPort(host, strconv.Itoa(int(port)))}
+	if len(users) > 0 {
+		sendSocks4Response(conn, errSocksNotAllowed, nil)
+		return nil, fmt.Errorf("SOCKS4 user %q: password authentication required: %w", userID, errSocksNotAllowed)
+	}
+	if cmd != socks5CmdConnect && cmd != socks5CmdBind {
+		sendSocks4Response(conn, errSocksCmdNotSupported, nil)
+		return nil, fmt.Errorf("SOCKS4 command %d: %w", cmd, errSocksCmdNotSupported)
+	}
+	log.Printf("SOCKS4: Handshake successful for %s (command: %d)", req.Target, cmd)
+	return req, nil
+}
+
+// readSocks4String читает строку, завершенную нулевым байтом. Читаем по байту, чтобы
+// не забрать из сокета данные, которые клиент отправил сразу за запросом.
+func readSocks4String(conn net.Conn) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for len(buf) <= socks4MaxField {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", fmt.Errorf("field longer than %d bytes", socks4MaxField)
+}
+
+// sendSocks4Response отправляет ответ SOCKS4: VN=0, CD, порт и IPv4-адрес.
+// В SOCKS4 нет кодов причин, любая ошибка — 91.
+func sendSocks4Response(conn net.Conn, err error, boundAddr net.Addr) error {
+	resp := make([]byte, 8)
+	resp[1] = socks4RespGranted
+	if err != nil {
+		resp[1] = socks4RespRejected
+		log.Printf("SOCKS4: Sending error response: %v", err)
+	} else {
+		log.Printf("SOCKS4: Sending success response")
+	}
+	if a, ok := boundAddr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(resp[2:], uint16(a.Port))
+		if ip4 := a.IP.To4(); ip4 != nil {
+			copy(resp[4:], ip4)
+		}
+	}
+	_, werr := conn.Write(resp)
+	return werr
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socks4Exchange отправляет запрос SOCKS4, отвечает успехом (если запрос принят)
+// и возвращает запрос, ответ прокси и ошибку.
+func socks4Exchange(t *testing.T, users []SocksUser, clientBytes []byte) (*SocksRequest, []byte, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	type result struct {
+		req *SocksRequest
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer server.Close()
+		req, err := readSocksRequest(server, users)
+		if err == nil {
+			err = req.Reply(server, nil, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080})
+		}
+		done <- result{req, err}
+	}()
+	go client.Write(clientBytes)
+	client.SetDeadline(time.Now().Add(time.Second))
+	resp, _ := io.ReadAll(client)
+	client.Close()
+	r := <-done
+	return r.req, resp, r.err
+}
+
+func TestSocks4Connect(t *testing.T) {
+	msg := []byte{socks4Ver, socks5CmdConnect, 0, 80, 93, 184, 216, 34}
+	msg = append(msg, "user\x00"...)
+	req, resp, err := socks4Exchange(t, nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != socks4Ver || req.Target != "93.184.216.34:80" {
+		t.Errorf("unexpected request: %+v", req)
+	}
+	if !bytes.Equal(resp, []byte{0, socks4RespGranted, 0x04, 0x38, 10, 0, 0, 1}) {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestSocks4aHostname(t *testing.T) {
+	msg := []byte{socks4Ver, socks5CmdConnect, 0x01, 0xBB, 0, 0, 0, 1}
+	msg = append(msg, "\x00example.com\x00"...)
+	req, _, err := socks4Exchange(t, nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Target != "example.com:443" {
+		t.Errorf("expected example.com:443, got %s", req.Target)
+	}
+}
+
+func TestSocks4Rejected(t *testing.T) {
+	connect := append([]byte{socks4Ver, socks5CmdConnect, 0, 80, 127, 0, 0, 1}, "alice\x00"...)
+
+	// Без пароля при заданных пользователях
+	_, resp, err := socks4Exchange(t, []SocksUser{{Username: "alice", Password: "secret"}}, connect)
+	if !errors.Is(err, errSocksNotAllowed) {
+		t.Fatalf("expected errSocksNotAllowed, got %v", err)
+	}
+	if len(resp) != 8 || resp[1] != socks4RespRejected {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	// Неизвестная команда
+	bad := append([]byte{socks4Ver, 9, 0, 80, 127, 0, 0, 1}, 0)
+	if _, _, err := socks4Exchange(t, nil, bad); !errors.Is(err, errSocksCmdNotSupported) {
+		t.Fatalf("expected errSocksCmdNotSupported, got %v", err)
+	}
+
+	// Обработчик только SOCKS5 отвечает отказом SOCKS4
+	server, client := net.Pipe()
+	go client.Write(connect)
+	respCh := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		respCh <- b
+	}()
+	_, err = handleSocksHandshake(server, nil)
+	server.Close()
+	if !errors.Is(err, errSocksCmdNotSupported) {
+		t.Fatalf("expected errSocksCmdNotSupported, got %v", err)
+	}
+	if resp := <-respCh; len(resp) != 8 || resp[1] != socks4RespRejected {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
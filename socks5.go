@@ -2,22 +2,24 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
 	"time"
 )
 
 const (
-	socks5Ver          = 0x05
-	socks5MethodNoAuth = 0x00
-	socks5MethodNone   = 0xFF
-	socks5CmdConnect   = 0x01
-	socks5AtypIPv4     = 0x01
-	socks5AtypDomain   = 0x03
-	socks5AtypIPv6     = 0x04
+	socks5Ver             = 0x05
+	socks5MethodNoAuth    = 0x00
+	socks5MethodNone      = 0xFF
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
 
 	socks5RespSuccess     = 0x00
 	socks5RespFailure     = 0x01
@@ -30,8 +32,45 @@ const (
 	socks5RespAddrNotSupp = 0x08
 )
 
+var errSocksCmdNotSupported = errors.New("command not supported")
+
+// SocksRequest — запрос клиента SOCKS после рукопожатия.
+type SocksRequest struct {
+	Version byte // socks5Ver или socks4Ver: в этой версии отправляются ответы
+	Cmd     byte
+	// "host:port": для CONNECT — назначение, для BIND — ожидаемый источник входящего
+	// соединения, для UDP ASSOCIATE — адрес, с которого клиент будет слать датаграммы
+	Target string
+	User   *SocksUser // nil, если аутентификация не требуется
+}
+
 // HandleSocksHandshake выполняет рукопожатие SOCKS5 и возвращает адрес назначения.
+// Другие команды, кроме CONNECT, и запросы SOCKS4 отклоняются: ответ на них отправляется
+// через SocksRequest.Reply (см. HandleSocksRequest).
 func HandleSocksHandshake(conn net.Conn) (string, error) {
+	return handleSocksHandshake(conn, socksUsers())
+}
+
+func handleSocksHandshake(conn net.Conn, users []SocksUser) (string, error) {
+	req, err := readSocksRequest(conn, users)
+	if err != nil {
+		return "", err
+	}
+	if req.Version != socks5Ver || req.Cmd != socks5CmdConnect {
+		req.Reply(conn, errSocksCmdNotSupported, nil)
+		return "", fmt.Errorf("SOCKS%d command %d: %w", req.Version, req.Cmd, errSocksCmdNotSupported)
+	}
+	return req.Target, nil
+}
+
+// HandleSocksRequest выполняет рукопожатие SOCKS5 или SOCKS4/4a (socks4.go) и возвращает
+// запрос клиента. Если в конфиге заданы пользователи, клиент SOCKS5 должен пройти
+// аутентификацию (socksauth.go), а SOCKS4 без пароля не принимается.
+func HandleSocksRequest(conn net.Conn) (*SocksRequest, error) {
+	return readSocksRequest(conn, socksUsers())
+}
+
+func readSocksRequest(conn net.Conn, users []SocksUser) (*SocksRequest, error) {
 	log.Printf("SOCKS5: Start handshake from %s", conn.RemoteAddr())
 
 	// Устанавливаем таймаут на рукопожатие (10 секунд)
@@ -41,45 +80,62 @@ func HandleSocksHandshake(conn net.Conn) (string, error) {
 	// 1. Выбор метода
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", fmt.Errorf("read handshake header: %v", err)
+		return nil, fmt.Errorf("read handshake header: %v", err)
+	}
+	if header[0] == socks4Ver {
+		return readSocks4Request(conn, header[1], users)
 	}
 	if header[0] != socks5Ver {
-		return "", fmt.Errorf("invalid SOCKS version: %d", header[0])
+		return nil, fmt.Errorf("invalid SOCKS version: %d", header[0])
 	}
 	nmethods := int(header[1])
 	methods := make([]byte, nmethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return "", fmt.Errorf("read methods: %v", err)
+		return nil, fmt.Errorf("read methods: %v", err)
 	}
 
-	foundNoAuth := false
+	// Без пользователей вход без пароля, иначе только по имени и паролю
+	want := byte(socks5MethodNoAuth)
+	if len(users) > 0 {
+		want = socks5MethodUserPass
+	}
+	found := false
 	for _, m := range methods {
-		if m == socks5MethodNoAuth {
-			foundNoAuth = true
+		if m == want {
+			found = true
 			break
 		}
 	}
 
-	if !foundNoAuth {
+	if !found {
 		conn.Write([]byte{socks5Ver, socks5MethodNone})
-		return "", fmt.Errorf("no acceptable authentication methods")
+		return nil, fmt.Errorf("no acceptable authentication methods")
+	}
+
+	if _, err := conn.Write([]byte{socks5Ver, want}); err != nil {
+		return nil, fmt.Errorf("write auth response: %v", err)
 	}
 
-	// Отвечаем, что используем No Auth
-	if _, err := conn.Write([]byte{socks5Ver, socks5MethodNoAuth}); err != nil {
-		return "", fmt.Errorf("write auth response: %v", err)
+	var user *SocksUser
+	if want == socks5MethodUserPass {
+		var err error
+		if user, err = socksAuthenticate(conn, users); err != nil {
+			return nil, err
+		}
 	}
 
 	// 2. Чтение запроса
 	reqHeader := make([]byte, 4)
 	if _, err := io.ReadFull(conn, reqHeader); err != nil {
-		return "", fmt.Errorf("read request header: %v", err)
+		return nil, fmt.Errorf("read request header: %v", err)
 	}
 	if reqHeader[0] != socks5Ver {
-		return "", fmt.Errorf("invalid SOCKS version in request: %d", reqHeader[0])
+		return nil, fmt.Errorf("invalid SOCKS version in request: %d", reqHeader[0])
 	}
-	if reqHeader[1] != socks5CmdConnect {
-		return "", fmt.Errorf("unsupported command: %d", reqHeader[1])
+	cmd := reqHeader[1]
+	if cmd != socks5CmdConnect && cmd != socks5CmdBind && cmd != socks5CmdUDPAssociate {
+		SendSocksResponse(conn, errSocksCmdNotSupported, nil)
+		return nil, fmt.Errorf("command %d: %w", cmd, errSocksCmdNotSupported)
 	}
 
 	var addr string
@@ -87,55 +143,72 @@ func HandleSocksHandshake(conn net.Conn) (string, error) {
 	case socks5AtypIPv4:
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", fmt.Errorf("read ipv4: %v", err)
+			return nil, fmt.Errorf("read ipv4: %v", err)
 		}
 		addr = net.IP(ip).String()
 	case socks5AtypDomain:
 		lenBuf := make([]byte, 1)
 		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return "", fmt.Errorf("read domain length: %v", err)
+			return nil, fmt.Errorf("read domain length: %v", err)
 		}
 		domainLen := int(lenBuf[0])
 		domain := make([]byte, domainLen)
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", fmt.Errorf("read domain: %v", err)
+			return nil, fmt.Errorf("read domain: %v", err)
 		}
 		addr = string(domain)
 	case socks5AtypIPv6:
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return "", fmt.Errorf("read ipv6: %v", err)
+			return nil, fmt.Errorf("read ipv6: %v", err)
 		}
 		addr = fmt.Sprintf("[%s]", net.IP(ip).String())
 	default:
-		return "", fmt.Errorf("unsupported address type: %d", reqHeader[3])
+		SendSocksResponse(conn, errSocksAddrNotSupported, nil)
+		return nil, fmt.Errorf("address type %d: %w", reqHeader[3], errSocksAddrNotSupported)
 	}
 
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portBuf); err != nil {
-		return "", fmt.Errorf("read port: %v", err)
+		return nil, fmt.Errorf("read port: %v", err)
 	}
 	port := binary.BigEndian.Uint16(portBuf)
 	target := fmt.Sprintf("%s:%d", addr, port)
-	log.Printf("SOCKS5: Handshake successful for %s", target)
-	return target, nil
+	req := &SocksRequest{Version: socks5Ver, Cmd: cmd, Target: target, User: user}
+	if user != nil {
+		// Для UDP ASSOCIATE права проверяются по адресу каждой датаграммы, для BIND
+		// адрес — ожидаемый источник, который часто не указан
+		allowed := user.Allows(target)
+		switch cmd {
+		case socks5CmdUDPAssociate:
+			allowed = true
+		case socks5CmdBind:
+			allowed = user.AllowsBind(target)
+		}
+		if !allowed {
+			SendSocksResponse(conn, errSocksNotAllowed, nil)
+			return nil, fmt.Errorf("user %q: %s: %w", user.Username, target, errSocksNotAllowed)
+		}
+		log.Printf("SOCKS5: Handshake successful for %s (command: %d, user: %s)", target, cmd, user.Username)
+		return req, nil
+	}
+	log.Printf("SOCKS5: Handshake successful for %s (command: %d)", target, cmd)
+	return req, nil
+}
+
+// Reply отправляет ответ в версии протокола запроса.
+func (r *SocksRequest) Reply(conn net.Conn, err error, boundAddr net.Addr) error {
+	if r.Version == socks4Ver {
+		return sendSocks4Response(conn, err, boundAddr)
+	}
+	return SendSocksResponse(conn, err, boundAddr)
 }
 
 // SendSocksResponse отправляет ответ SOCKS5 клиенту.
 // Если addr != nil, используется его адрес и порт.
 func SendSocksResponse(conn net.Conn, err error, boundAddr net.Addr) error {
-	rep := byte(socks5RespSuccess)
+	rep := socksReplyCode(err)
 	if err != nil {
-		rep = socks5RespFailure
-		// Пытаемся сопоставить ошибку со стандартными кодами SOCKS5
-		errStr := err.Error()
-		if strings.Contains(errStr, "refused") {
-			rep = socks5RespConnRefused
-		} else if strings.Contains(errStr, "unreachable") {
-			rep = socks5RespHostUnreach
-		} else if strings.Contains(errStr, "timeout") {
-			rep = socks5RespTTLExpired // Или Failure
-		}
 		log.Printf("SOCKS5: Sending error response (rep: 0x%02x): %v", rep, err)
 	} else {
 		log.Printf("SOCKS5: Sending success response")
@@ -145,16 +218,20 @@ func SendSocksResponse(conn net.Conn, err error, boundAddr net.Addr) error {
 	addr := make([]byte, 4)
 	port := uint16(0)
 
-	if boundAddr != nil {
-		if tcpAddr, ok := boundAddr.(*net.TCPAddr); ok {
-			if ip4 := tcpAddr.IP.To4(); ip4 != nil {
-				atyp = socks5AtypIPv4
-				addr = ip4
-			} else {
-				atyp = socks5AtypIPv6
-				addr = tcpAddr.IP
-			}
-			port = uint16(tcpAddr.Port)
+	var boundIP net.IP
+	switch a := boundAddr.(type) {
+	case *net.TCPAddr:
+		boundIP, port = a.IP, uint16(a.Port)
+	case *net.UDPAddr:
+		boundIP, port = a.IP, uint16(a.Port)
+	}
+	if boundIP != nil {
+		if ip4 := boundIP.To4(); ip4 != nil {
+			atyp = socks5AtypIPv4
+			addr = ip4
+		} else {
+			atyp = socks5AtypIPv6
+			addr = boundIP
 		}
 	}
 
@@ -170,3 +247,56 @@ func SendSocksResponse(conn net.Conn, err error, boundAddr net.Addr) error {
 	_, werr := conn.Write(resp)
 	return werr
 }
+
+// appendSocksAddr добавляет к b адрес в формате SOCKS5: ATYP, адрес, порт.
+func appendSocksAddr(b []byte, host string, port int) []byte {
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip.To4()...)
+	case ip != nil:
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	default:
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// parseSocksAddr разбирает адрес SOCKS5 в начале b и возвращает "host:port" и длину адреса.
+func parseSocksAddr(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, fmt.Errorf("empty address")
+	}
+	var host string
+	n := 1
+	switch b[0] {
+	case socks5AtypIPv4:
+		n += 4
+		if len(b) >= n {
+			host = net.IP(b[1:n]).String()
+		}
+	case socks5AtypIPv6:
+		n += 16
+		if len(b) >= n {
+			host = net.IP(b[1:n]).String()
+		}
+	case socks5AtypDomain:
+		if len(b) < 2 {
+			return "", 0, fmt.Errorf("truncated address")
+		}
+		n += 1 + int(b[1])
+		if len(b) >= n {
+			host = string(b[2:n])
+		}
+	default:
+		return "", 0, fmt.Errorf("unsupported address type: %d", b[0])
+	}
+	if len(b) < n+2 {
+		return "", 0, fmt.Errorf("truncated address")
+	}
+	port := binary.BigEndian.Uint16(b[n:])
+	return net.JoinHostPort(host, fmt.Sprint(port)), n + 2, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -71,3 +74,176 @@ func TestSocks5Handshake(t *testing.T) {
 		t.Error("Timeout waiting for handshake")
 	}
 }
+
+// socksExchange запускает handleSocksHandshake с пользователями users, отправляет
+// клиентские байты и возвращает ответ прокси (до закрытия соединения) и ошибку рукопожатия.
+func socksExchange(t *testing.T, users []SocksUser, clientBytes []byte) ([]byte, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	errChan := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := handleSocksHandshake(server, users)
+		if err == nil {
+			err = SendSocksResponse(server, nil, nil)
+		}
+		errChan <- err
+	}()
+	go client.Write(clientBytes)
+	client.SetDeadline(time.Now().Add(time.Second))
+	resp, _ := io.ReadAll(client)
+	client.Close()
+	return resp, <-errChan
+}
+
+func userPassAuth(user, pass string) []byte {
+	b := []byte{socksAuthVer, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	return append(b, pass...)
+}
+
+func connectRequest(host string, port byte) []byte {
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	return append(req, 0, port)
+}
+
+func TestSocks5UserPassAuth(t *testing.T) {
+	users := []SocksUser{
+		{Username: "alice", Password: "secret"},
+		{Username: "bob", Password: "hunter2", AllowHosts: []string{"*.example.com"}, AllowPorts: []int{443}},
+	}
+	greeting := []byte{5, 2, socks5MethodNoAuth, socks5MethodUserPass}
+
+	t.Run("valid", func(t *testing.T) {
+		msg := append(append(append([]byte(nil), greeting...), userPassAuth("alice", "secret")...), connectRequest("google.com", 80)...)
+		resp, err := socksExchange(t, users, msg)
+		if err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if !bytes.HasPrefix(resp, []byte{5, socks5MethodUserPass, socksAuthVer, socksAuthSuccess, 5, socks5RespSuccess}) {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		msg := append(append([]byte(nil), greeting...), userPassAuth("alice", "wrong")...)
+		resp, err := socksExchange(t, users, msg)
+		if err == nil {
+			t.Fatal("handshake succeeded with a wrong password")
+		}
+		if !bytes.Equal(resp, []byte{5, socks5MethodUserPass, socksAuthVer, socksAuthFailure}) {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	})
+
+	t.Run("no auth offered", func(t *testing.T) {
+		resp, err := socksExchange(t, users, []byte{5, 1, socks5MethodNoAuth})
+		if err == nil {
+			t.Fatal("handshake succeeded without credentials")
+		}
+		if !bytes.Equal(resp, []byte{5, socks5MethodNone}) {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	})
+
+	t.Run("policy denied", func(t *testing.T) {
+		msg := append(append(append([]byte(nil), greeting...), userPassAuth("bob", "hunter2")...), connectRequest("google.com", 80)...)
+		resp, err := socksExchange(t, users, msg)
+		if !errors.Is(err, errSocksNotAllowed) {
+			t.Fatalf("expected errSocksNotAllowed, got %v", err)
+		}
+		if len(resp) < 6 || resp[5] != socks5RespNotAllowed {
+			t.Errorf("unexpected response: %v", resp)
+		}
+	})
+}
+
+func TestSocksUserAllows(t *testing.T) {
+	u := SocksUser{AllowHosts: []string{"*.example.com", "10.0.0.0/8", "host.local", "::1"}, AllowPorts: []int{80, 443}}
+	cases := []struct {
+		target string
+		want   bool
+	}{
+		{"example.com:443", true},
+		{"WWW.Example.com:80", true},
+		{"badexample.com:80", false},
+		{"10.1.2.3:80", true},
+		{"11.1.2.3:80", false},
+		{"host.local:443", true},
+		{"[::1]:80", true},
+		{"example.com:22", false},
+	}
+	for _, c := range cases {
+		if got := u.Allows(c.target); got != c.want {
+			t.Errorf("Allows(%q) = %v, want %v", c.target, got, c.want)
+		}
+	}
+	if !(&SocksUser{}).Allows("anything.net:1") {
+		t.Error("user without restrictions must allow any target")
+	}
+}
+
+func TestSocksUserAllowsBind(t *testing.T) {
+	u := SocksUser{AllowHosts: []string{"10.0.0.0/8"}, AllowPorts: []int{21}}
+	cases := []struct {
+		target string
+		want   bool
+	}{
+		{"0.0.0.0:0", true},
+		{"[::]:0", true},
+		{"0.0.0.0:21", true},
+		{"0.0.0.0:22", false},
+		{"10.1.2.3:0", true},
+		{"11.1.2.3:0", false},
+		{"10.1.2.3:22", false},
+	}
+	for _, c := range cases {
+		if got := u.AllowsBind(c.target); got != c.want {
+			t.Errorf("AllowsBind(%q) = %v, want %v", c.target, got, c.want)
+		}
+	}
+}
+
+func TestSocksAddrRoundTrip(t *testing.T) {
+	for _, target := range []string{"10.1.2.3:53", "[2001:db8::1]:443", "example.com:8080"} {
+		host, portStr, _ := net.SplitHostPort(target)
+		port, _ := strconv.Atoi(portStr)
+		b := appendSocksAddr(nil, host, port)
+		b = append(b, "payload"...)
+		got, n, err := parseSocksAddr(b)
+		if err != nil || got != target || string(b[n:]) != "payload" {
+			t.Errorf("%s: got %q, n=%d, err=%v", target, got, n, err)
+		}
+	}
+	if _, _, err := parseSocksAddr([]byte{socks5AtypIPv4, 1, 2}); err == nil {
+		t.Error("truncated address accepted")
+	}
+}
+
+func TestSocks5UDPAssociateRequest(t *testing.T) {
+	udpReq := []byte{5, 1, 0, 5, socks5CmdUDPAssociate, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+
+	// Обработчик только CONNECT отвечает 0x07
+	resp, err := socksExchange(t, nil, udpReq)
+	if !errors.Is(err, errSocksCmdNotSupported) {
+		t.Fatalf("expected errSocksCmdNotSupported, got %v", err)
+	}
+	if len(resp) < 4 || resp[3] != socks5RespCmdNotSupp {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write(udpReq)
+	go io.Copy(io.Discard, client)
+	req, err := readSocksRequest(server, nil)
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Cmd != socks5CmdUDPAssociate || req.Target != "0.0.0.0:0" {
+		t.Errorf("unexpected request: %+v", req)
+	}
+}
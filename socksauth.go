@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Аутентификация SOCKS5 по имени и паролю (RFC 1929).
+//
+// Если в конфиге заданы socks_users, слушатель клиента требует метод 0x02 и не
+// принимает клиентов без пароля. Для каждого пользователя можно ограничить узлы
+// и порты назначения; запрос вне разрешенных получает ответ 0x02 (not allowed).
+
+const (
+	socks5MethodUserPass = 0x02
+
+	socksAuthVer     = 0x01
+	socksAuthSuccess = 0x00
+	socksAuthFailure = 0x01
+)
+
+var errSocksNotAllowed = errors.New("connection not allowed by ruleset")
+
+// SocksUser — учетная запись SOCKS5 и ее ограничения.
+type SocksUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Разрешенные узлы: точное имя или IP, "*.example.com" (сам домен и поддомены)
+	// или подсеть "10.0.0.0/8". Подсеть проверяется только для адресов, заданных IP:
+	// имена разрешаются на сервере. Пустой список — любой узел.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+	// Разрешенные порты назначения; пустой список — любой порт
+	AllowPorts []int `json:"allow_ports,omitempty"`
+}
+
+// socksUsers возвращает пользователей из конфига.
+func socksUsers() []SocksUser {
+	if currentCfg == nil {
+		return nil
+	}
+	return currentCfg.SocksUsers
+}
+
+// socksAuthenticate выполняет подсогласование RFC 1929 и возвращает пользователя.
+func socksAuthenticate(conn net.Conn, users []SocksUser) (*SocksUser, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("read auth header: %v", err)
+	}
+	if header[0] != socksAuthVer {
+		return nil, fmt.Errorf("invalid auth version: %d", header[0])
+	}
+	uname := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return nil, fmt.Errorf("read username: %v", err)
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return nil, fmt.Errorf("read password length: %v", err)
+	}
+	passwd := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return nil, fmt.Errorf("read password: %v", err)
+	}
+
+	user := findSocksUser(users, uname, passwd)
+	if user == nil {
+		conn.Write([]byte{socksAuthVer, socksAuthFailure})
+		return nil, fmt.Errorf("authentication failed for user %q", uname)
+	}
+	if _, err := conn.Write([]byte{socksAuthVer, socksAuthSuccess}); err != nil {
+		return nil, fmt.Errorf("write auth response: %v", err)
+	}
+	return user, nil
+}
+
+// findSocksUser возвращает пользователя с данными именем и паролем или nil.
+func findSocksUser(users []SocksUser, name, password []byte) *SocksUser {
+	var user *SocksUser
+	for i := range users {
+		u := &users[i]
+		// Пароль сравнивается за постоянное время, перебор пользователей не прерывается
+		nameOK := subtle.ConstantTimeCompare(name, []byte(u.Username))
+		passOK := subtle.ConstantTimeCompare(password, []byte(u.Password))
+		if nameOK&passOK == 1 && user == nil {
+			user = u
+		}
+	}
+	return user
+}
+
+// Allows проверяет, разрешено ли пользователю подключение к target ("host:port").
+func (u *SocksUser) Allows(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	if len(u.AllowPorts) > 0 {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || !portListed(u.AllowPorts, port) {
+			return false
+		}
+	}
+	return u.allowsHost(host)
+}
+
+// AllowsBind проверяет ожидаемый адрес входящего соединения BIND. Клиенты обычно
+// не знают его заранее и передают 0.0.0.0:0: неуказанные адрес и порт не ограничиваются.
+func (u *SocksUser) AllowsBind(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	if port != 0 && len(u.AllowPorts) > 0 && !portListed(u.AllowPorts, port) {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return true
+	}
+	return u.allowsHost(host)
+}
+
+func (u *SocksUser) allowsHost(host string) bool {
+	if len(u.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, pattern := range u.AllowHosts {
+		if hostMatches(pattern, host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// portListed сообщает, есть ли порт в списке.
+func portListed(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches сравнивает узел (имя в нижнем регистре) и его IP с шаблоном: точное имя
+// или IP, "*.example.com" (сам домен и поддомены) или подсеть "10.0.0.0/8". Подсеть
+// проверяется только при известном IP.
+func hostMatches(pattern, host string, ip net.IP) bool {
+	pattern = strings.ToLower(pattern)
+	if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+		return ip != nil && cidr.Contains(ip)
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern || (ip != nil && ip.Equal(net.ParseIP(pattern)))
+}
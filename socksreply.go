@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Коды ответа SOCKS по ошибкам. Один классификатор используется и сервером для CONNACK,
+// и клиентом для ответа приложению, поэтому клиент SOCKS получает тот же код, который
+// сервер получил от ОС. Коды ошибок сокетов различаются по платформам: таблица
+// errnoReplies задана в socksreply_windows.go и socksreply_stub.go.
+
+var errSocksAddrNotSupported = errors.New("address type not supported")
+
+// socksReplyError — код ответа, полученный от удаленной стороны в CONNACK или BIND_ACCEPT.
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	return fmt.Sprintf("socks5 error: 0x%02x", byte(e))
+}
+
+// socksReplyCode возвращает код ответа SOCKS5 для ошибки открытия соединения.
+func socksReplyCode(err error) byte {
+	if err == nil {
+		return socks5RespSuccess
+	}
+	var remote socksReplyError
+	if errors.As(err, &remote) {
+		return byte(remote)
+	}
+	switch {
+	case errors.Is(err, errSocksNotAllowed):
+		return socks5RespNotAllowed
+	case errors.Is(err, errSocksCmdNotSupported):
+		return socks5RespCmdNotSupp
+	case errors.Is(err, errSocksAddrNotSupported):
+		return socks5RespAddrNotSupp
+	}
+	// Имя не разрешилось (в том числе по таймауту DNS): узел недоступен
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5RespHostUnreach
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if rep, ok := errnoReplies[errno]; ok {
+			return rep
+		}
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return socks5RespTTLExpired
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5RespTTLExpired
+	}
+	return socks5RespFailure
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// errnoReplies сопоставляет коды ошибок сокетов с кодами ответа SOCKS5.
+var errnoReplies = map[syscall.Errno]byte{
+	syscall.ECONNREFUSED: socks5RespConnRefused,
+	syscall.ENETUNREACH:  socks5RespNetUnreach,
+	syscall.EHOSTUNREACH: socks5RespHostUnreach,
+	syscall.EHOSTDOWN:    socks5RespHostUnreach,
+	syscall.ETIMEDOUT:    socks5RespTTLExpired,
+}
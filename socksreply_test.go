@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func dialOpError(err error) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+}
+
+func TestSocksReplyCode(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"nil", nil, socks5RespSuccess},
+		{"not allowed", fmt.Errorf("exit policy: %w", errSocksNotAllowed), socks5RespNotAllowed},
+		{"command", fmt.Errorf("command 9: %w", errSocksCmdNotSupported), socks5RespCmdNotSupp},
+		{"address type", fmt.Errorf("address type 7: %w", errSocksAddrNotSupported), socks5RespAddrNotSupp},
+		{"remote status", fmt.Errorf("open: %w", socksReplyError(socks5RespNetUnreach)), socks5RespNetUnreach},
+		{"dns not found", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}}, socks5RespHostUnreach},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}, socks5RespHostUnreach},
+		{"deadline", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, socks5RespTTLExpired},
+		{"context deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), socks5RespTTLExpired},
+		// Текст ошибки больше не учитывается
+		{"text only", errors.New("connection refused by peer"), socks5RespFailure},
+		{"unknown", io.ErrUnexpectedEOF, socks5RespFailure},
+	}
+	for _, c := range cases {
+		if got := socksReplyCode(c.err); got != c.want {
+			t.Errorf("%s: got 0x%02x, want 0x%02x", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSocksReplyCodeErrno(t *testing.T) {
+	if len(errnoReplies) == 0 {
+		t.Fatal("errno table is empty")
+	}
+	for errno, want := range errnoReplies {
+		if got := socksReplyCode(dialOpError(errno)); got != want {
+			t.Errorf("%v: got 0x%02x, want 0x%02x", errno, got, want)
+		}
+	}
+}
+
+func TestSocksReplyCodeRefusedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = net.DialTimeout("tcp", addr, 2*time.Second)
+	if err == nil {
+		t.Skip("closed port accepted a connection")
+	}
+	if got := socksReplyCode(err); got != socks5RespConnRefused {
+		t.Fatalf("%v: got 0x%02x, want 0x%02x", err, got, socks5RespConnRefused)
+	}
+}
+
+func TestSendSocksResponseCode(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		SendSocksResponse(server, &net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}, nil)
+	}()
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != socks5RespHostUnreach {
+		t.Fatalf("got reply 0x%02x, want 0x%02x", resp[1], socks5RespHostUnreach)
+	}
+}
+
+func TestSocks5UnsupportedAddressType(t *testing.T) {
+	req := []byte{socks5Ver, 1, 0x00, socks5Ver, socks5CmdConnect, 0x00, 0x05, 1, 2, 3, 4, 0, 80}
+	resp, err := socksExchange(t, nil, req)
+	if !errors.Is(err, errSocksAddrNotSupported) {
+		t.Fatalf("expected address type error, got %v", err)
+	}
+	if len(resp) < 4 || resp[3] != socks5RespAddrNotSupp {
+		t.Fatalf("unexpected response %x", resp)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// Коды Winsock и Win32, которые возвращает ConnectEx. Константы syscall.ECONNREFUSED и
+// подобные на Windows условные и с ними не совпадают.
+const (
+	wsaeNetUnreach         syscall.Errno = 10051
+	wsaeTimedOut           syscall.Errno = 10060
+	wsaeConnRefused        syscall.Errno = 10061
+	wsaeHostDown           syscall.Errno = 10064
+	wsaeHostUnreach        syscall.Errno = 10065
+	errorSemTimeout        syscall.Errno = 121
+	errorConnectionRefused syscall.Errno = 1225
+	errorNetworkUnreach    syscall.Errno = 1231
+	errorHostUnreach       syscall.Errno = 1232
+)
+
+// errnoReplies сопоставляет коды ошибок сокетов с кодами ответа SOCKS5.
+var errnoReplies = map[syscall.Errno]byte{
+	wsaeConnRefused:        socks5RespConnRefused,
+	errorConnectionRefused: socks5RespConnRefused,
+	wsaeNetUnreach:         socks5RespNetUnreach,
+	errorNetworkUnreach:    socks5RespNetUnreach,
+	wsaeHostUnreach:        socks5RespHostUnreach,
+	wsaeHostDown:           socks5RespHostUnreach,
+	errorHostUnreach:       socks5RespHostUnreach,
+	wsaeTimedOut:           socks5RespTTLExpired,
+	errorSemTimeout:        socks5RespTTLExpired,
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP ASSOCIATE через видеотуннель.
+//
+// Клиент открывает ассоциацию пакетом CONNECT с командой socks5CmdUDPAssociate,
+// сервер отвечает CONNACK и держит для нее свой UDP-сокет. Датаграммы идут пакетами
+// typeDatagram: [заголовок соединения][адрес SOCKS5: ATYP, адрес, порт][данные].
+// Клиент указывает в адресе назначение, сервер — отправителя ответа. Пакеты не
+// подтверждаются и не повторяются: потерянная или не поместившаяся в кадр датаграмма
+// просто пропадает, как в обычном UDP.
+//
+// Ассоциация живет, пока открыто TCP-соединение управления клиента SOCKS5. Сервер
+// закрывает ассоциацию, по которой udpAssocTimeout не было датаграмм, и сообщает об
+// этом клиенту пакетом DISCONNECT.
+
+const (
+	udpAssocTimeout = 2 * time.Minute
+
+	udpMaxPeers         = 1024 // Адресов, от которых сервер принимает ответы
+	udpPendingTargets   = 16   // Имен, разрешаемых одновременно
+	udpPendingDatagrams = 8    // Датаграмм, ждущих разрешения одного имени
+)
+
+// remoteOpener открывает соединение на сервере и возвращает его ID, эпоху, канал
+// входящих пакетов и адрес, выданный сервером.
+type remoteOpener func(cmd byte, target string, prio byte) (uint16, byte, chan []byte, net.Addr, error)
+
+// udpAssoc — состояние ассоциации, общее для клиента и сервера.
+type udpAssoc struct {
+	connID     uint16
+	epoch      byte
+	margin     int
+	stop       chan struct{}
+	stopOnce   sync.Once
+	closeOnce  sync.Once
+	lastActive atomic.Int64
+	sent       atomic.Int64
+	recv       atomic.Int64
+	dropped    atomic.Int64
+}
+
+func newUDPAssoc(connID uint16, epoch byte, margin int) *udpAssoc {
+	a := &udpAssoc{connID: connID, epoch: epoch, margin: margin, stop: make(chan struct{})}
+	a.touch()
+	return a
+}
+
+func (a *udpAssoc) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssoc) idle() time.Duration {
+	return time.Since(time.Unix(0, a.lastActive.Load()))
+}
+
+func (a *udpAssoc) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+}
+
+// send отправляет датаграмму ([адрес SOCKS5][данные]) в туннель. Датаграмма, которая
+// не помещается в кадр, отбрасывается.
+func (a *udpAssoc) send(addrAndData []byte, prio byte) {
+	bSize := GetBlockSize()
+	if connHeaderLen+len(addrAndData) > GetMaxPayloadSize(a.margin, bSize)-frameOverhead() {
+		a.dropped.Add(1)
+		return
+	}
+	if !frameSched.Acquire(prio, a.stop) {
+		return
+	}
+	payload := make([]byte, connHeaderLen, connHeaderLen+len(addrAndData))
+	payload[0] = typeDatagram
+	payload[1] = byte(a.connID >> 8)
+	payload[2] = byte(a.connID)
+	payload[3] = a.epoch
+	payload = append(payload, addrAndData...)
+	sendEncodedPacket(payload, a.margin, bSize)
+	recordSentPacket(typeDatagram)
+	a.sent.Add(1)
+	a.touch()
+}
+
+// disconnect сообщает удаленной стороне о закрытии ассоциации.
+func (a *udpAssoc) disconnect() {
+	a.closeOnce.Do(func() {
+		sendControlPacket([]byte{typeDisconnect, byte(a.connID >> 8), byte(a.connID), a.epoch}, a.margin)
+		recordSentPacket(typeDisconnect)
+	})
+}
+
+func (a *udpAssoc) logClosed(role, reason string) {
+	log.Printf("%s: UDP association %d closed (%s): sent %d, received %d, dropped %d datagrams",
+		role, a.connID, reason, a.sent.Load(), a.recv.Load(), a.dropped.Load())
+}
+
+// serveUDPAssociate обслуживает запрос UDP ASSOCIATE на клиенте.
+func serveUDPAssociate(c net.Conn, req *SocksRequest, pd *PacketDispatcher, margin int, open remoteOpener) {
+	if !peerSupports(capDatagram) {
+		log.Printf("Client: UDP ASSOCIATE from %s rejected, server does not support datagrams", c.RemoteAddr())
+		_ = SendSocksResponse(c, errSocksCmdNotSupported, nil)
+		return
+	}
+	tcpLocal, _ := c.LocalAddr().(*net.TCPAddr)
+	tcpRemote, _ := c.RemoteAddr().(*net.TCPAddr)
+	if tcpLocal == nil || tcpRemote == nil {
+		_ = SendSocksResponse(c, errSocksCmdNotSupported, nil)
+		return
+	}
+	// Сокет датаграмм открываем на том же адресе, на котором принято TCP-соединение
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpLocal.IP})
+	if err != nil {
+		log.Printf("Client: Cannot open UDP socket for %s: %v", c.RemoteAddr(), err)
+		_ = SendSocksResponse(c, err, nil)
+		return
+	}
+	defer udpConn.Close()
+
+	connID, epoch, ch, _, err := open(socks5CmdUDPAssociate, req.Target, prioNormal)
+	if err != nil {
+		_ = SendSocksResponse(c, err, nil)
+		return
+	}
+	defer pd.Unregister(connID, epoch)
+	if err := SendSocksResponse(c, nil, udpConn.LocalAddr()); err != nil {
+		return
+	}
+	log.Printf("Client: UDP association %d for %s relaying on %s", connID, c.RemoteAddr(), udpConn.LocalAddr())
+
+	a := newUDPAssoc(connID, epoch, margin)
+	reason := "control connection closed"
+	readerDone := make(chan struct{})
+	defer func() {
+		// Читатель сокета еще может отправлять в туннель: дожидаемся его выхода
+		a.Stop()
+		udpConn.Close()
+		<-readerDone
+		a.logClosed("Client", reason)
+	}()
+
+	// Закрытие TCP-соединения управления завершает ассоциацию (RFC 1928)
+	go func() {
+		io.Copy(io.Discard, c)
+		a.Stop()
+	}()
+
+	// Датаграммы принимаются только с адреса, объявленного в запросе (RFC 1928, раздел 7).
+	// Нулевой IP или порт в нем означает, что клиент его не знает: тогда берется IP
+	// TCP-соединения управления, а порт — той датаграммы, что пришла первой
+	clientIP, clientPort := udpClientAddr(req.Target, tcpRemote.IP)
+	var clientAddr atomic.Pointer[net.UDPAddr]
+	if clientPort != 0 {
+		clientAddr.Store(&net.UDPAddr{IP: clientIP, Port: clientPort})
+	}
+	go func() {
+		defer close(readerDone)
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				a.Stop()
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			if prev := clientAddr.Load(); prev == nil {
+				clientAddr.Store(from)
+			} else if prev.Port != from.Port {
+				continue
+			}
+			// Заголовок датаграммы SOCKS5: RSV(2), FRAG(1), адрес; фрагменты не поддерживаются
+			if n < 4 || buf[2] != 0 {
+				a.dropped.Add(1)
+				continue
+			}
+			target, _, err := parseSocksAddr(buf[3:n])
+			if err != nil {
+				a.dropped.Add(1)
+				continue
+			}
+			if req.User != nil && !req.User.Allows(target) {
+				a.dropped.Add(1)
+				continue
+			}
+			a.send(buf[3:n], priorityForTarget(target))
+		}
+	}()
+
+	for {
+		select {
+		case data := <-ch:
+			switch data[0] {
+			case typeDatagram:
+				addr := clientAddr.Load()
+				if addr == nil {
+					continue
+				}
+				out := make([]byte, 3, 3+len(data)-connHeaderLen)
+				out = append(out, data[connHeaderLen:]...)
+				if _, err := udpConn.WriteToUDP(out, addr); err == nil {
+					a.recv.Add(1)
+				}
+			case typeDisconnect:
+				reason = "closed by server"
+				return
+			}
+		case <-a.stop:
+			a.disconnect()
+			return
+		}
+	}
+}
+
+// udpClientAddr возвращает адрес, с которого клиент SOCKS5 будет слать датаграммы,
+// по DST.ADDR и DST.PORT запроса UDP ASSOCIATE. Неуказанный IP (или имя) заменяется
+// на controlIP, неуказанный порт возвращается нулем.
+func udpClientAddr(declared string, controlIP net.IP) (net.IP, int) {
+	host, portStr, err := net.SplitHostPort(declared)
+	if err != nil {
+		return controlIP, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return ip, port
+	}
+	return controlIP, port
+}
+
+// udpPeerKey возвращает адрес узла UDP в виде ключа карты (IPv4 без префикса IPv6).
+func udpPeerKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// udpResolved — результат разрешения адреса назначения датаграммы.
+type udpResolved struct {
+	target string
+	addr   *net.UDPAddr
+	err    error
+}
+
+// runUDPRelay обслуживает ассоциацию на сервере: отправляет датаграммы клиента
+// адресатам и возвращает клиенту ответы.
+//
+// В туннель передаются только датаграммы от адресов, которым клиент сам отправлял
+// датаграммы (RFC 1928, раздел 7): остальные узлы, которые могут достучаться до порта
+// ретранслятора, подмешать в ассоциацию ничего не могут. Имена назначения разрешаются
+// вне цикла приема, чтобы медленный DNS не задерживал датаграммы другим адресатам;
+// датаграммы к еще не разрешенному имени ждут в небольшой очереди.
+func runUDPRelay(relay *net.UDPConn, margin int, connID uint16, epoch byte, incoming chan []byte) {
+	a := newUDPAssoc(connID, epoch, margin)
+	reason := "closed by client"
+	var wg sync.WaitGroup
+	defer func() {
+		a.Stop()
+		relay.Close()
+		wg.Wait()
+		a.logClosed("Server", reason)
+	}()
+
+	var peersMu sync.Mutex
+	peers := make(map[netip.AddrPort]bool)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				a.Stop()
+				return
+			}
+			peersMu.Lock()
+			known := peers[udpPeerKey(from)]
+			peersMu.Unlock()
+			if !known {
+				a.dropped.Add(1)
+				continue
+			}
+			pkt := appendSocksAddr(make([]byte, 0, 22+n), from.IP.String(), from.Port)
+			a.send(append(pkt, buf[:n]...), priorityForTarget(from.String()))
+		}
+	}()
+
+	sendTo := func(addr *net.UDPAddr, data []byte) {
+		if addr == nil {
+			a.dropped.Add(1)
+			return
+		}
+		peersMu.Lock()
+		if len(peers) >= udpMaxPeers {
+			clear(peers)
+		}
+		peers[udpPeerKey(addr)] = true
+		peersMu.Unlock()
+		if _, err := relay.WriteToUDP(data, addr); err != nil {
+			a.dropped.Add(1)
+			return
+		}
+		a.recv.Add(1)
+		a.touch()
+	}
+
+	// Имена назначения разрешаем один раз на ассоциацию
+	resolved := make(map[string]*net.UDPAddr)
+	pending := make(map[string][][]byte)
+	results := make(chan udpResolved)
+	ticker := time.NewTicker(udpAssocTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-incoming:
+			switch data[0] {
+			case typeDatagram:
+				target, n, err := parseSocksAddr(data[connHeaderLen:])
+				if err != nil {
+					a.dropped.Add(1)
+					continue
+				}
+				payload := data[connHeaderLen+n:]
+				if addr, ok := resolved[target]; ok {
+					sendTo(addr, payload)
+					continue
+				}
+				if queue, ok := pending[target]; ok {
+					if len(queue) >= udpPendingDatagrams {
+						a.dropped.Add(1)
+						continue
+					}
+					pending[target] = append(queue, payload)
+					continue
+				}
+				if len(pending) >= udpPendingTargets {
+					a.dropped.Add(1)
+					continue
+				}
+				pending[target] = [][]byte{payload}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					addr, err := exitResolveUDP(target)
+					select {
+					case results <- udpResolved{target, addr, err}:
+					case <-a.stop:
+					}
+				}()
+			case typeDisconnect:
+				return
+			}
+		case r := <-results:
+			queue := pending[r.target]
+			delete(pending, r.target)
+			if r.err != nil && !errors.Is(r.err, errSocksNotAllowed) {
+				log.Printf("Server: UDP association %d: cannot resolve %s: %v", connID, r.target, r.err)
+				a.dropped.Add(int64(len(queue)))
+				continue
+			}
+			if len(resolved) >= 256 {
+				clear(resolved)
+			}
+			// Запрещенный политикой адрес тоже запоминаем, чтобы не проверять его заново
+			resolved[r.target] = r.addr
+			for _, data := range queue {
+				sendTo(r.addr, data)
+			}
+		case <-ticker.C:
+			if a.idle() > udpAssocTimeout {
+				reason = "idle timeout"
+				a.disconnect()
+				return
+			}
+		case <-a.stop:
+			reason = "socket error"
+			a.disconnect()
+			return
+		}
+	}
+}
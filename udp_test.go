@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpEcho запускает UDP-сервер, который возвращает каждую датаграмму отправителю.
+func udpEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// startUDPAssociate соединяет клиентскую и серверную половины ассоциации через
+// диспетчеры в памяти и возвращает адреса ретрансляторов клиента и сервера.
+func startUDPAssociate(t *testing.T, declared string) (*net.UDPAddr, *net.UDPAddr) {
+	t.Helper()
+	saved := currentCfg
+	currentCfg = &Config{ExitPolicy: &ExitPolicy{AllowPrivate: true}}
+	setSessionCaps(Capabilities{Features: capDatagram})
+	t.Cleanup(func() {
+		currentCfg = saved
+		setSessionCaps(Capabilities{})
+	})
+
+	pdC, pdS := NewPacketDispatcher(10), NewPacketDispatcher(11)
+	pdS.serverIDs = true
+	linkDispatchers(t, pdC, pdS, 10, nil)
+
+	// Обе половины ассоциации читают глобальные настройки: до их восстановления
+	// закрываем сокеты и дожидаемся выхода горутин (Cleanup выполняются в обратном порядке)
+	var (
+		wg       sync.WaitGroup
+		relaysMu sync.Mutex
+		relays   []*net.UDPConn
+		server   *net.UDPAddr
+	)
+	t.Cleanup(func() {
+		relaysMu.Lock()
+		for _, r := range relays {
+			r.Close()
+		}
+		relaysMu.Unlock()
+		wg.Wait()
+	})
+	open := func(cmd byte, target string, prio byte) (uint16, byte, chan []byte, net.Addr, error) {
+		id, epoch, ch, err := pdC.Allocate()
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+		relaysMu.Lock()
+		relays = append(relays, relay)
+		server = relay.LocalAddr().(*net.UDPAddr)
+		relaysMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runUDPRelay(relay, 11, id, epoch, pdS.Register(id, epoch))
+		}()
+		return id, epoch, ch, relay.LocalAddr(), nil
+	}
+
+	control, conn := tcpPair(t)
+	req := &SocksRequest{Version: socks5Ver, Cmd: socks5CmdUDPAssociate, Target: declared}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveUDPAssociate(conn, req, pdC, 10, open)
+	}()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5RespSuccess || reply[3] != socks5AtypIPv4 {
+		t.Fatalf("UDP ASSOCIATE reply %x", reply)
+	}
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	return &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}, server
+}
+
+// udpSocksDatagram собирает датаграмму SOCKS5 для адреса назначения.
+func udpSocksDatagram(to *net.UDPAddr, data string) []byte {
+	return append(appendSocksAddr([]byte{0, 0, 0}, to.IP.String(), to.Port), data...)
+}
+
+func readUDP(t *testing.T, conn *net.UDPConn, wait time.Duration) ([]byte, bool) {
+	t.Helper()
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+func TestUDPAssociateRelay(t *testing.T) {
+	echo := udpEcho(t)
+	relay, _ := startUDPAssociate(t, "0.0.0.0:0")
+
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	if _, err := app.WriteToUDP(udpSocksDatagram(echo, "ping"), relay); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := readUDP(t, app, 5*time.Second)
+	if !ok {
+		t.Fatal("no reply through the tunnel")
+	}
+	// Ответ приходит с заголовком SOCKS5 и адресом отправителя
+	if want := udpSocksDatagram(echo, "ping"); !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestUDPAssociateUsesDeclaredAddress(t *testing.T) {
+	echo := udpEcho(t)
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	relay, _ := startUDPAssociate(t, app.LocalAddr().String())
+	// Первой приходит датаграмма с чужого порта: она не должна занять ассоциацию
+	other.WriteToUDP(udpSocksDatagram(echo, "intruder"), relay)
+	if got, ok := readUDP(t, other, 500*time.Millisecond); ok {
+		t.Fatalf("datagram from an undeclared port relayed: %q", got)
+	}
+	app.WriteToUDP(udpSocksDatagram(echo, "declared"), relay)
+	got, ok := readUDP(t, app, 5*time.Second)
+	if !ok || !bytes.HasSuffix(got, []byte("declared")) {
+		t.Fatalf("declared client got %q (ok %v)", got, ok)
+	}
+}
+
+func TestUDPRelayDropsUnknownSources(t *testing.T) {
+	echo := udpEcho(t)
+	relay, serverRelay := startUDPAssociate(t, "0.0.0.0:0")
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	app.WriteToUDP(udpSocksDatagram(echo, "ping"), relay)
+	if _, ok := readUDP(t, app, 5*time.Second); !ok {
+		t.Fatal("no reply through the tunnel")
+	}
+
+	// Узел, которому клиент ничего не отправлял, пишет прямо в порт ретранслятора сервера
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stranger.WriteToUDP([]byte("injected"), serverRelay)
+	if got, ok := readUDP(t, app, 500*time.Millisecond); ok {
+		t.Fatalf("datagram from an unknown source relayed: %q", got)
+	}
+}
+
+func TestUDPClientAddr(t *testing.T) {
+	control := net.IPv4(192, 0, 2, 1)
+	cases := []struct {
+		declared string
+		ip       string
+		port     int
+	}{
+		{"0.0.0.0:0", "192.0.2.1", 0},
+		{"0.0.0.0:5353", "192.0.2.1", 5353},
+		{"198.51.100.7:0", "198.51.100.7", 0},
+		{"198.51.100.7:4000", "198.51.100.7", 4000},
+		{"[::]:0", "192.0.2.1", 0},
+		{"client.example:4000", "192.0.2.1", 4000},
+	}
+	for _, c := range cases {
+		ip, port := udpClientAddr(c.declared, control)
+		if !ip.Equal(net.ParseIP(c.ip)) || port != c.port {
+			t.Errorf("%s: got %v:%d, want %s:%d", c.declared, ip, port, c.ip, c.port)
+		}
+	}
+}